@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+)
+
+// AddressBook is the part of the Manager the crawler and the DNS server
+// depend on, so that they can be tested against an in-memory fake.
+type AddressBook interface {
+	// AddAddresses adds addrs and returns the ones that were not known
+	// before, and AddAddressesFromPeer does the same for addresses
+	// advertised by source, subject to its limits.
+	AddAddresses(addrs []*appmessage.NetAddress) []*appmessage.NetAddress
+	AddAddressesFromPeer(source *appmessage.NetAddress, addrs []*appmessage.NetAddress) []*appmessage.NetAddress
+
+	// Addresses returns the addresses to crawl next.
+	Addresses(accelerate bool) []*appmessage.NetAddress
+
+	// GoodAddresses returns addresses to answer a query of qtype with.
+	GoodAddresses(qtype uint16, includeAllSubnetworks bool, subnetworkID *externalapi.DomainSubnetworkID,
+		defaultPortOnly bool) []*appmessage.NetAddress
+
+	// IsServed returns whether ip is the address of a node GoodAddresses
+	// may answer with.
+	IsServed(ip net.IP) bool
+
+	// LastUpdate returns the time the good addresses last changed.
+	LastUpdate() time.Time
+
+	// AddressCount and GoodAddressCount return the numbers of known and of
+	// good addresses.
+	AddressCount() int
+	GoodAddressCount() int
+
+	// Attempt is called before connecting to addr, and one of Good, Bad
+	// and BadHandshake once the attempt is over.
+	Attempt(addr *appmessage.NetAddress)
+	Good(addr *appmessage.NetAddress, subnetworkID *externalapi.DomainSubnetworkID)
+	Bad(addr *appmessage.NetAddress, reason FailureReason)
+	BadHandshake(addr *appmessage.NetAddress, reason FailureReason)
+	RecordLatency(addr *appmessage.NetAddress, dialLatency, handshakeLatency, pingLatency time.Duration)
+
+	Ban(ip net.IP, reason string)
+	IsBanned(ip net.IP) bool
+
+	LastBootstrap() time.Time
+	SetLastBootstrap(t time.Time)
+
+	// RetestRequested is signaled when nodes are scheduled to be crawled
+	// right away.
+	RetestRequested() <-chan struct{}
+}
+
+var _ AddressBook = (*Manager)(nil)
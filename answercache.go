@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/miekg/dns"
+)
+
+const (
+	// answerSetsPerPool is the number of answer sets precomputed for each
+	// pool, which queries are answered with at random.
+	answerSetsPerPool = 32
+
+	// answerCacheRefreshInterval is how often the answer sets are rebuilt
+	// if nodes changed since they were last built.
+	answerCacheRefreshInterval = time.Second
+
+	// answerCacheMaxAge is how often the answer sets are rebuilt
+	// regardless, since nodes stop being served as time passes.
+	answerCacheMaxAge = 30 * time.Second
+)
+
+// answerPoolKey identifies the nodes a query asks for: its address family,
+// whether they must listen on the default port, and their subnetwork, which
+// is ignored if allSubnetworks is set and unknown unless hasSubnetwork is.
+type answerPoolKey struct {
+	qtype           uint16
+	defaultPortOnly bool
+	allSubnetworks  bool
+	hasSubnetwork   bool
+	subnetwork      externalapi.DomainSubnetworkID
+}
+
+// answerPools holds the precomputed answer sets of every non-empty pool, and
+// the IP addresses of all nodes in the pools. updated is the time the nodes
+// in the pools last changed, which digest identifies.
+type answerPools struct {
+	built   time.Time
+	updated time.Time
+	digest  [sha256.Size]byte
+	sets    map[answerPoolKey][][]*appmessage.NetAddress
+	ips     map[string]struct{}
+}
+
+// answerCache keeps the answer sets of GoodAddresses, so that queries
+// neither take the manager lock nor scan the address book. It is a
+// ManagerObserver, to learn when the answer sets are outdated.
+type answerCache struct {
+	// buildMtx serializes the building of answer sets.
+	buildMtx sync.Mutex
+
+	// pools holds the current *answerPools.
+	pools atomic.Value
+
+	// changed is set to 1 when a node changed since the answer sets were
+	// last built.
+	changed int32
+}
+
+func newAnswerCache() *answerCache {
+	return &answerCache{}
+}
+
+func (c *answerCache) markChanged() {
+	atomic.StoreInt32(&c.changed, 1)
+}
+
+// NodeAdded implements ManagerObserver.
+func (c *answerCache) NodeAdded(addr *appmessage.NetAddress) {}
+
+// NodeGood implements ManagerObserver.
+func (c *answerCache) NodeGood(addr *appmessage.NetAddress) {
+	c.markChanged()
+}
+
+// NodeBad implements ManagerObserver.
+func (c *answerCache) NodeBad(addr *appmessage.NetAddress, reason FailureReason) {
+	c.markChanged()
+}
+
+// NodeRemoved implements ManagerObserver.
+func (c *answerCache) NodeRemoved(addr *appmessage.NetAddress) {
+	c.markChanged()
+}
+
+// answerPools returns the current answer sets, building them if there are
+// none yet. Without an answer cache, they are built on every call.
+func (m *Manager) answerPools() *answerPools {
+	if m.answers == nil {
+		return m.buildAnswerPools()
+	}
+	if pools, ok := m.answers.pools.Load().(*answerPools); ok {
+		return pools
+	}
+
+	m.answers.buildMtx.Lock()
+	defer m.answers.buildMtx.Unlock()
+
+	// Another caller may have built them while this one was waiting.
+	if pools, ok := m.answers.pools.Load().(*answerPools); ok {
+		return pools
+	}
+	pools := m.buildAnswerPools()
+	m.answers.pools.Store(pools)
+	return pools
+}
+
+// LastUpdate returns the time the nodes answers are picked from last changed,
+// or the zero time if no answers were built yet.
+func (m *Manager) LastUpdate() time.Time {
+	if m.answers == nil {
+		return time.Time{}
+	}
+	pools, ok := m.answers.pools.Load().(*answerPools)
+	if !ok {
+		return time.Time{}
+	}
+	return pools.updated
+}
+
+// refreshAnswerPools rebuilds the answer sets if nodes changed since they
+// were built, or if they are older than answerCacheMaxAge.
+func (m *Manager) refreshAnswerPools() {
+	if m.answers == nil {
+		return
+	}
+	m.answers.buildMtx.Lock()
+	defer m.answers.buildMtx.Unlock()
+
+	pools, ok := m.answers.pools.Load().(*answerPools)
+	changed := atomic.SwapInt32(&m.answers.changed, 0) == 1
+	if ok && !changed && m.clock.Now().Sub(pools.built) < answerCacheMaxAge {
+		return
+	}
+	m.answers.pools.Store(m.buildAnswerPools())
+}
+
+// buildAnswerPools sorts the servable nodes of a recent snapshot into pools
+// and precomputes answerSetsPerPool answer sets of each pool.
+func (m *Manager) buildAnswerPools() *answerPools {
+	criteria := m.activeServingCriteria()
+	whitelistOnly := !m.whitelist.isEmpty()
+	preferLowLatency := ActiveConfig().PreferLowLatency
+	weighted := ActiveConfig().WeightedAnswers
+
+	candidates := make(map[answerPoolKey][]*Node)
+	ips := make(map[string]struct{})
+	var members []string
+	for _, node := range m.snapshot(criteria.now.Add(-snapshotMaxAge)).nodes {
+		if !node.isServable(criteria) {
+			continue
+		}
+		if whitelistOnly && !m.whitelist.contains(node.Addr.IP) {
+			continue
+		}
+
+		ips[node.Addr.IP.String()] = struct{}{}
+		members = append(members, nodeKey(node.Addr)+" "+subnetworkKey(node.SubnetworkID))
+		qtype := uint16(dns.TypeAAAA)
+		if node.Addr.IP.To4() != nil {
+			qtype = dns.TypeA
+		}
+		for _, defaultPortOnly := range []bool{false, true} {
+			if defaultPortOnly && node.Addr.Port != m.network.defaultPort() {
+				continue
+			}
+			all := answerPoolKey{qtype: qtype, defaultPortOnly: defaultPortOnly, allSubnetworks: true}
+			candidates[all] = append(candidates[all], node)
+
+			subnetwork := answerPoolKey{qtype: qtype, defaultPortOnly: defaultPortOnly}
+			if node.SubnetworkID != nil {
+				subnetwork.hasSubnetwork = true
+				subnetwork.subnetwork = *node.SubnetworkID
+			}
+			candidates[subnetwork] = append(candidates[subnetwork], node)
+		}
+	}
+
+	pools := &answerPools{
+		built:   criteria.now,
+		updated: criteria.now,
+		sets:    make(map[answerPoolKey][][]*appmessage.NetAddress, len(candidates)),
+		ips:     ips,
+	}
+
+	// The answers only count as updated if the nodes in the pools changed,
+	// since the answer sets are picked at random on every build.
+	sort.Strings(members)
+	digest := sha256.New()
+	for _, member := range members {
+		digest.Write([]byte(member))
+		digest.Write([]byte{0})
+	}
+	copy(pools.digest[:], digest.Sum(nil))
+	if m.answers != nil {
+		previous, ok := m.answers.pools.Load().(*answerPools)
+		if ok && previous.digest == pools.digest {
+			pools.updated = previous.updated
+		}
+	}
+
+	for key, nodes := range candidates {
+		// Answers of the lowest latency nodes are all the same.
+		setCount := answerSetsPerPool
+		if preferLowLatency {
+			sort.Slice(nodes, func(i, j int) bool {
+				return nodes[i].latency() < nodes[j].latency()
+			})
+			setCount = 1
+		}
+		sets := make([][]*appmessage.NetAddress, setCount)
+		for i := range sets {
+			sets[i] = m.pickAnswer(nodes, preferLowLatency, weighted)
+		}
+		pools.sets[key] = sets
+	}
+	return pools
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+)
+
+// asnGroup returns the autonomous system number of the node as a group for
+// groupCap, which is empty if it is unknown.
+func (n *Node) asnGroup() string {
+	if n.ASN == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(n.ASN), 10)
+}
+
+// tagASN records the autonomous system of the node, if an ASN database is
+// loaded and the node was not tagged yet.
+func (m *Manager) tagASN(node *Node) {
+	if m.asnDB == nil || node.ASN != 0 {
+		return
+	}
+	record, ok, err := m.asnDB.lookup(node.Addr.IP)
+	if err != nil {
+		log.Debugf("Failed to look up the ASN of %s: %v", node.Addr.IP, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if asn, ok := fields["autonomous_system_number"].(uint64); ok {
+		node.ASN = uint32(asn)
+	}
+	if org, ok := fields["autonomous_system_organization"].(string); ok {
+		node.ASOrg = org
+	}
+}
+
+// ASNCounts returns the number of good nodes per autonomous system. Nodes of
+// an unknown autonomous system are counted under 0.
+func (m *Manager) ASNCounts() map[uint32]int {
+	criteria := m.activeServingCriteria()
+	counts := make(map[uint32]int)
+
+	m.mtx.RLock()
+	for _, node := range m.nodes {
+		if node.isServable(criteria) {
+			counts[node.ASN]++
+		}
+	}
+	m.mtx.RUnlock()
+
+	return counts
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// axfrMessageSize bounds the size of each message of a zone transfer, well
+// below the 64KB limit of a DNS message over TCP.
+const axfrMessageSize = 16384
+
+// zoneRRs returns the records of the zone as transferred to secondaries: the
+// SOA, NS and glue records, along with the addresses of a set of nodes at the
+// apex. Names below the apex, which select nodes by subnetwork, aren't
+// transferred.
+func (d *DNSServer) zoneRRs() []dns.RR {
+	rrs := append(d.nsRRs(d.hostname), d.glueRRs()...)
+	ttl := uint32(ActiveConfig().AnswerTTL / time.Second)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, addr := range d.book.GoodAddresses(qtype, true, nil, true) {
+			rrs = append(rrs, addressRR(d.hostname, addr.IP, ttl))
+		}
+	}
+
+	// A transfer starts and ends with the SOA record.
+	soa := d.soaRR()
+	return append(append([]dns.RR{soa}, rrs...), soa)
+}
+
+// zoneTransfer returns the packed messages transferring a zone, if b is an
+// AXFR or IXFR query for one of the zones served by d received over TCP from
+// an address allowed to transfer it. IXFR queries are answered with the whole
+// zone, as RFC 1995 allows. Otherwise, it returns false and the query is
+// answered as usual, which refuses it.
+//
+// Signed zones are never transferred. Their answers are signed online, with
+// signatures far shorter lived than the SOA expire and NSEC records made up
+// per query, so a secondary could neither deny names nor keep serving them
+// validly once the seeder is down.
+func (d *DNSServer) zoneTransfer(addr net.Addr, b []byte) ([][]byte, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || d.axfrAllow == nil || !d.axfrAllow.contains(tcpAddr.IP) {
+		return nil, false
+	}
+	query := new(dns.Msg)
+	err := query.Unpack(b)
+	if err != nil || len(query.Question) != 1 {
+		return nil, false
+	}
+	question := query.Question[0]
+	if question.Qtype != dns.TypeAXFR && question.Qtype != dns.TypeIXFR {
+		return nil, false
+	}
+	zone := d.zoneOf(strings.ToLower(question.Name))
+	if zone == nil || !strings.EqualFold(question.Name, zone.hostname) {
+		return nil, false
+	}
+
+	if zone.signer != nil {
+		log.Infof("%s: refusing to transfer the signed zone %s", addr, zone.hostname)
+		return nil, false
+	}
+
+	rrs := zone.zoneRRs()
+	log.Infof("%s: transferring %d records of the zone", addr, len(rrs))
+
+	newMessage := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetReply(query)
+		msg.Authoritative = true
+		msg.Compress = true
+		return msg
+	}
+	var messages [][]byte
+	msg := newMessage()
+	for _, rr := range rrs {
+		msg.Answer = append(msg.Answer, rr)
+		if len(msg.Answer) > 1 && msg.Len() > axfrMessageSize {
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+			packed, err := msg.Pack()
+			if err != nil {
+				log.Infof("%s: failed to pack zone transfer: %v", addr, err)
+				return nil, false
+			}
+			messages = append(messages, packed)
+			msg = newMessage()
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		log.Infof("%s: failed to pack zone transfer: %v", addr, err)
+		return nil, false
+	}
+	return append(messages, packed), true
+}
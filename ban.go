@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// banHandshakeFailures is the number of consecutive failed handshakes
+	// after which a node is banned. Unlike failed dials, which usually just
+	// mean the node is offline, failed handshakes mean the node accepted
+	// the connection but did not behave as a kaspad node should.
+	banHandshakeFailures = 5
+)
+
+// Ban describes why and until when an address is banned
+type Ban struct {
+	Until  time.Time
+	Reason string
+}
+
+// Ban bans the specified ip address, on all ports, for the configured ban
+// duration. Banned addresses are dropped from the manager and are neither
+// crawled nor served until the ban expires.
+func (m *Manager) Ban(ip net.IP, reason string) {
+	m.mtx.Lock()
+	m.ban(ip, reason)
+	m.mtx.Unlock()
+}
+
+// ban is the lock-free implementation of Ban. It must be called with the
+// manager lock held for writes.
+func (m *Manager) ban(ip net.IP, reason string) {
+	addrStr := ip.String()
+	m.bans[addrStr] = &Ban{
+		Until:  m.clock.Now().Add(ActiveConfig().BanDuration),
+		Reason: reason,
+	}
+	for key := range m.ips[addrStr] {
+		m.removeNode(key)
+	}
+	m.updateSizeGauges()
+	log.Infof("Banned %s for %s: %s", addrStr, ActiveConfig().BanDuration, reason)
+}
+
+// IsBanned returns whether the specified ip address is currently banned
+func (m *Manager) IsBanned(ip net.IP) bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.isBanned(ip)
+}
+
+// isBanned is the lock-free implementation of IsBanned. It must be called
+// with the manager lock held.
+func (m *Manager) isBanned(ip net.IP) bool {
+	ban, exists := m.bans[ip.String()]
+	return exists && m.clock.Now().Before(ban.Until)
+}
+
+func (m *Manager) pruneBans() {
+	var count int
+	now := m.clock.Now()
+	m.mtx.Lock()
+	for k, ban := range m.bans {
+		if !now.Before(ban.Until) {
+			delete(m.bans, k)
+			count++
+		}
+	}
+	m.updateSizeGauges()
+	m.mtx.Unlock()
+
+	if count > 0 {
+		log.Infof("Lifted %d expired bans", count)
+	}
+}
+
+func (m *Manager) deserializeBans() error {
+	filePath := m.bansFile
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	r, err := os.Open(filePath)
+	if err != nil {
+		return errors.Errorf("%s error opening file: %v", filePath, err)
+	}
+	defer r.Close()
+
+	var bans map[string]*Ban
+	dec := json.NewDecoder(r)
+	err = dec.Decode(&bans)
+	if err != nil {
+		return errors.Errorf("error reading %s: %v", filePath, err)
+	}
+	if bans == nil {
+		bans = make(map[string]*Ban)
+	}
+	now := m.clock.Now()
+	for ip, ban := range bans {
+		if ban == nil || !now.Before(ban.Until) {
+			delete(bans, ip)
+		}
+	}
+
+	m.mtx.Lock()
+	m.bans = bans
+	m.updateSizeGauges()
+	m.mtx.Unlock()
+
+	log.Infof("%d bans loaded", len(bans))
+	return nil
+}
+
+func (m *Manager) saveBans() {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	err := writeJSONFile(m.bansFile, &m.bans, false)
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// deadFilterBits and deadFilterHashes size each generation of the
+	// dead address filter. With a million addresses per generation, about
+	// one in 3000 other addresses is mistaken for a dead one. Each
+	// generation takes 2 MiB, so the filter of each network's manager
+	// takes up to 4 MiB.
+	deadFilterBits   = 1 << 24
+	deadFilterHashes = 10
+
+	// deadFilterRotation is how long a generation of the dead address
+	// filter collects addresses. Dead addresses are ignored for one to two
+	// rotations, after which nodes that came back can be found again.
+	deadFilterRotation = 3 * 24 * time.Hour
+)
+
+// bloomFilter is a fixed size Bloom filter of strings.
+type bloomFilter struct {
+	bits   []uint64
+	hashes int
+	key    []byte
+}
+
+// newBloomFilter returns an empty filter of size bits using the given number
+// of hashes, keyed by key, which must be secret, so that collisions cannot be
+// predicted.
+func newBloomFilter(size, hashes int, key []byte) *bloomFilter {
+	return &bloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		hashes: hashes,
+		key:    key,
+	}
+}
+
+// positions calls fn with each bit position of s, using double hashing of
+// the HMAC of s.
+func (f *bloomFilter) positions(s string, fn func(position uint64)) {
+	h := hmac.New(sha256.New, f.key)
+	h.Write([]byte(s))
+	sum := h.Sum(nil)
+	h1, h2 := binary.LittleEndian.Uint64(sum[:8]), binary.LittleEndian.Uint64(sum[8:16])|1
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		fn((h1 + i*h2) % size)
+	}
+}
+
+func (f *bloomFilter) add(s string) {
+	f.positions(s, func(position uint64) {
+		f.bits[position/64] |= 1 << (position % 64)
+	})
+}
+
+// contains returns whether s was added, or, rarely, whether it collides with
+// added strings.
+func (f *bloomFilter) contains(s string) bool {
+	contains := true
+	f.positions(s, func(position uint64) {
+		if f.bits[position/64]&(1<<(position%64)) == 0 {
+			contains = false
+		}
+	})
+	return contains
+}
+
+// deadAddressFilter remembers the keys of nodes that were removed as dead, in
+// two generations of Bloom filters, so that gossip of long-dead addresses can
+// be ignored without keeping their records. A nil filter remembers nothing.
+// It is guarded by the manager lock.
+type deadAddressFilter struct {
+	key       []byte
+	current   *bloomFilter
+	previous  *bloomFilter
+	rotatedAt time.Time
+}
+
+func newDeadAddressFilter(key []byte, now time.Time) *deadAddressFilter {
+	return &deadAddressFilter{
+		key:       key,
+		current:   newBloomFilter(deadFilterBits, deadFilterHashes, key),
+		rotatedAt: now,
+	}
+}
+
+func (f *deadAddressFilter) add(nodeKey string) {
+	if f == nil {
+		return
+	}
+	f.current.add(nodeKey)
+}
+
+func (f *deadAddressFilter) contains(nodeKey string) bool {
+	if f == nil {
+		return false
+	}
+	return f.current.contains(nodeKey) || (f.previous != nil && f.previous.contains(nodeKey))
+}
+
+// rotate starts a new generation if the current one is deadFilterRotation
+// old, forgetting the addresses of the previous one.
+func (f *deadAddressFilter) rotate(now time.Time) {
+	if f == nil || now.Sub(f.rotatedAt) < deadFilterRotation {
+		return
+	}
+	f.previous = f.current
+	f.current = newBloomFilter(deadFilterBits, deadFilterHashes, f.key)
+	f.rotatedAt = now
+}
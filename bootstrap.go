@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// bootstrapSeeds returns the DNS seeds to bootstrap from: the network's
+// built-in seeds followed, for the active network, by the configured extra
+// seeds.
+func bootstrapSeeds(network *seederNetwork) []string {
+	seeds := append([]string{}, network.params().DNSSeeds...)
+	if network != nil {
+		return seeds
+	}
+	for _, seed := range strings.Split(ActiveConfig().BootstrapSeeds, ",") {
+		seed = strings.TrimSpace(seed)
+		if seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// bootstrap queries all bootstrap DNS seeds of network in parallel, adds the
+// returned addresses to book and returns how many of them were new.
+func bootstrap(book AddressBook, network *seederNetwork) int {
+	seeds := bootstrapSeeds(network)
+
+	var wgSeeds sync.WaitGroup
+	var mtx sync.Mutex
+	var added int
+	for _, seed := range seeds {
+		seed := seed
+		wgSeeds.Add(1)
+		spawn("bootstrap-seed", func() {
+			defer wgSeeds.Done()
+
+			ips, err := hostLookup(seed)
+			if err != nil {
+				log.Infof("DNS seed %s lookup failed: %v", seed, err)
+				return
+			}
+
+			addrs := make([]*appmessage.NetAddress, 0, len(ips))
+			for _, ip := range ips {
+				addrs = append(addrs, appmessage.NewNetAddressIPPort(ip, network.defaultPort()))
+			}
+			newAddrs := book.AddAddresses(addrs)
+			log.Infof("DNS seed %s returned %d addresses, %d new", seed, len(addrs), len(newAddrs))
+
+			mtx.Lock()
+			added += len(newAddrs)
+			mtx.Unlock()
+		})
+	}
+	wgSeeds.Wait()
+
+	log.Infof("Bootstrapped %d new addresses from %d DNS seeds", added, len(seeds))
+	return added
+}
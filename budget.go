@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// attemptBudget is a token bucket that limits the rate of outbound connection
+// attempts. It is only used by the creep goroutine, so it is not safe for
+// concurrent use.
+type attemptBudget struct {
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+// newAttemptBudget returns a budget that allows perMinute connection attempts
+// per minute, of which up to perMinute may be made at once. A perMinute of 0
+// disables the budget.
+func newAttemptBudget(perMinute int) *attemptBudget {
+	return &attemptBudget{
+		perMinute: perMinute,
+		tokens:    float64(perMinute),
+		last:      time.Now(),
+	}
+}
+
+// take withdraws up to n attempts from the budget and returns the number of
+// attempts that may be made now.
+func (b *attemptBudget) take(n int) int {
+	if b.perMinute == 0 {
+		return n
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Minutes() * float64(b.perMinute)
+	b.tokens = math.Min(b.tokens, float64(b.perMinute))
+	b.last = now
+
+	if granted := int(b.tokens); granted < n {
+		n = granted
+	}
+	b.tokens -= float64(n)
+	return n
+}
+
+// refillInterval returns the time it takes for a single attempt to be added
+// back to the budget.
+func (b *attemptBudget) refillInterval() time.Duration {
+	return time.Minute / time.Duration(b.perMinute)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+// churnReportDays is the number of days churn is kept track of.
+const churnReportDays = 30
+
+// ChurnDay counts the transitions of nodes during a single UTC day.
+type ChurnDay struct {
+	// Date is the day, formatted as YYYY-MM-DD.
+	Date string
+
+	// Joins counts the addresses that were added to the address book.
+	Joins int
+
+	// Departures counts the nodes that were removed from the address
+	// book, whether they expired, were evicted or were banned.
+	Departures int
+
+	// Flaps counts the nodes that went from good to bad or back.
+	Flaps int
+}
+
+// churnCSVHeader is the header row of CSV churn reports.
+var churnCSVHeader = []string{"date", "joins", "departures", "flaps"}
+
+// churnTracker is a ManagerObserver that counts the daily churn of the
+// address book.
+type churnTracker struct {
+	mtx   sync.Mutex
+	clock clock
+
+	// days holds up to churnReportDays days, oldest first.
+	days []ChurnDay
+
+	// good holds, by node key, whether the last crawl of each node that
+	// was crawled since startup succeeded.
+	good map[string]bool
+}
+
+func newChurnTracker(clock clock) *churnTracker {
+	return &churnTracker{
+		clock: clock,
+		good:  make(map[string]bool),
+	}
+}
+
+// today returns the counters of the current day, starting a new day if
+// needed. It must be called with the tracker lock held.
+func (t *churnTracker) today() *ChurnDay {
+	date := t.clock.Now().UTC().Format("2006-01-02")
+	if len(t.days) == 0 || t.days[len(t.days)-1].Date != date {
+		t.days = append(t.days, ChurnDay{Date: date})
+		if len(t.days) > churnReportDays {
+			t.days = t.days[len(t.days)-churnReportDays:]
+		}
+	}
+	return &t.days[len(t.days)-1]
+}
+
+// setGood records the outcome of a crawl of the node with the given key, and
+// counts a flap if it differs from the previous one.
+func (t *churnTracker) setGood(key string, good bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if wasGood, ok := t.good[key]; ok && wasGood != good {
+		t.today().Flaps++
+	}
+	t.good[key] = good
+}
+
+// NodeAdded implements ManagerObserver.
+func (t *churnTracker) NodeAdded(addr *appmessage.NetAddress) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.today().Joins++
+}
+
+// NodeGood implements ManagerObserver.
+func (t *churnTracker) NodeGood(addr *appmessage.NetAddress) {
+	t.setGood(nodeKey(addr), true)
+}
+
+// NodeBad implements ManagerObserver.
+func (t *churnTracker) NodeBad(addr *appmessage.NetAddress, reason FailureReason) {
+	t.setGood(nodeKey(addr), false)
+}
+
+// NodeRemoved implements ManagerObserver.
+func (t *churnTracker) NodeRemoved(addr *appmessage.NetAddress) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.today().Departures++
+	delete(t.good, nodeKey(addr))
+}
+
+// report returns the churn of the tracked days, oldest first.
+func (t *churnTracker) report() []ChurnDay {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return append([]ChurnDay(nil), t.days...)
+}
+
+// ChurnReport returns the daily churn of the address book since startup, for
+// up to churnReportDays days, oldest first.
+func (m *Manager) ChurnReport() []ChurnDay {
+	return m.churn.report()
+}
+
+// writeChurnReport writes days to w in the given export format.
+func writeChurnReport(w io.Writer, days []ChurnDay, format string) error {
+	switch format {
+	case exportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(days)
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(churnCSVHeader)
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			err := cw.Write([]string{
+				day.Date, strconv.Itoa(day.Joins), strconv.Itoa(day.Departures), strconv.Itoa(day.Flaps),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return errors.Errorf("unknown export format %s", format)
+	}
+}
+
+// exportChurnToFile writes the churn report to churn.<format> in the home
+// directory, in the configured export format.
+func exportChurnToFile() {
+	format := ActiveConfig().ExportFormat
+	filePath, ok := homeDirFile("churn." + format)
+	if !ok {
+		return
+	}
+
+	days := amgr.ChurnReport()
+	err := writeFileAtomically(filePath, func(w io.Writer) error {
+		return writeChurnReport(w, days, format)
+	})
+	if err != nil {
+		log.Errorf("Failed to write churn report to %s: %v", filePath, err)
+		return
+	}
+	log.Infof("Wrote churn report of %d days to %s", len(days), filePath)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"time"
+)
+
+// clock tells the current time. The manager reads the time through a clock
+// so that tests can control it.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
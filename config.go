@@ -6,11 +6,13 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kaspanet/kaspad/infrastructure/config"
 
@@ -19,6 +21,7 @@ import (
 
 	"github.com/jessevdk/go-flags"
 	"github.com/kaspanet/kaspad/util"
+	"github.com/miekg/dns"
 )
 
 const (
@@ -27,8 +30,65 @@ const (
 	defaultErrLogFilename = "dnsseeder_err.log"
 	defaultListenPort     = "5354"
 	defaultGrpcListenPort = "3737"
+	defaultThreads        = 8
+	defaultMaxHalfOpen    = defaultThreads
+
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultGetAddrTimeout   = 30 * time.Second
+
+	defaultBanDuration = 24 * time.Hour
+
+	defaultNetGroupDialInterval = time.Second
+
+	defaultGetAddrRounds   = 1
+	defaultGetAddrInterval = 5 * time.Second
+
+	defaultStaleGood     = time.Hour
+	defaultStaleBad      = time.Hour
+	defaultCrawlInterval = 10 * time.Minute
+	defaultCrawlJitter   = 10 * time.Second
+
+	defaultExpireNew  = 8 * time.Hour
+	defaultExpireGood = 8 * time.Hour
+	defaultMaxNodes   = 50000
+	defaultMinQuality = 0.01
+
+	defaultBootstrapThreshold = 10
+
+	defaultDumpInterval = 30 * time.Second
+
+	defaultHistoryInterval  = 10 * time.Minute
+	defaultHistoryRetention = 365 * 24 * time.Hour
+
+	defaultMaxAddrsPerMsg      = 500
+	defaultMaxAddrsPerPeerHour = 1000
+
+	defaultGoodTTL = 2 * time.Hour
+
+	defaultMinSuccesses = 1
+
+	defaultAnswerTTL = 30 * time.Second
+
+	defaultDNSRateLimit = 0
+	defaultDNSRateBurst = 50
+
+	defaultMaxTCPConns          = 256
+	defaultMaxTCPConnsPerClient = 8
+
+	defaultSOARefresh = 24 * time.Hour
+	defaultSOARetry   = time.Hour
+	defaultSOAExpire  = 7 * 24 * time.Hour
 )
 
+// defaultNetworkGoodTTLs are the good TTLs of the networks whose churn
+// differs from the defaultGoodTTL, keyed by network name without the kaspa-
+// prefix.
+var defaultNetworkGoodTTLs = map[string]time.Duration{
+	"mainnet": 4 * time.Hour,
+	"testnet": 3 * time.Hour,
+}
+
 var (
 	// Default configuration options
 	defaultHomeDir    = util.AppDir("dnsseeder", false)
@@ -46,46 +106,202 @@ func ActiveConfig() *ConfigFlags {
 
 // ConfigFlags holds the configurations set by the command line argument
 type ConfigFlags struct {
-	KnownPeers  string `short:"p" long:"peers" description:"List of already known peer addresses"`
-	ShowVersion bool   `short:"V" long:"version" description:"Display version information and exit"`
-	Host        string `short:"H" long:"host" description:"Seed DNS address"`
-	Listen      string `long:"listen" short:"l" description:"Listen on address:port"`
-	Nameserver  string `short:"n" long:"nameserver" description:"hostname of nameserver"`
-	Seeder      string `short:"s" long:"default-seeder" description:"IP address of a  working node"`
-	Profile     string `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
-	GRPCListen  string `long:"grpclisten" description:"Listen gRPC requests on address:port"`
+	KnownPeers  string   `short:"p" long:"peers" description:"List of already known peer addresses"`
+	ShowVersion bool     `short:"V" long:"version" description:"Display version information and exit"`
+	Host        string   `short:"H" long:"host" description:"Seed DNS address"`
+	Zone        []string `long:"zone" description:"Also serve the zone of the given hostname for another network, given as hostname=network with network one of mainnet, testnet, simnet and devnet. The network of each zone is crawled by an address manager of its own, which keeps its state in a subdirectory of the home directory named after the network; may be specified multiple times"`
+	Listen      []string `long:"listen" short:"l" description:"Listen on address:port for DNS queries over both UDP and TCP, or over only one of them if prefixed with udp:// or tcp://; may be specified multiple times, e.g. to listen on both IPv4 and IPv6 addresses"`
+	Nameserver  []string `short:"n" long:"nameserver" description:"hostname of a nameserver of the zone, optionally followed by =IP[,IP...] to serve glue records for a nameserver within the zone; may be specified multiple times"`
+	Seeder      string   `short:"s" long:"default-seeder" description:"IP address of a  working node"`
+	Profile     string   `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
+	GRPCListen  string   `long:"grpclisten" description:"Listen gRPC requests on address:port"`
+	Threads     int      `long:"threads" description:"Number of crawler threads dialing peers concurrently"`
+	MaxHalfOpen int      `long:"maxhalfopen" description:"Maximum number of connections to peers being established at the same time, across all crawler threads"`
+
+	SkipNonDefaultPorts bool `long:"skipnondefaultports" description:"Do not crawl peers listening on a port other than the network's default port"`
+	AllowPrivate        bool `long:"allowprivate" description:"Accept peer addresses in private and loopback ranges, e.g. for devnet deployments"`
+
+	BanIP     []string `long:"banip" description:"Neither crawl nor serve addresses in the given CIDR range or of the given IP; may be specified multiple times"`
+	BanIPFile string   `long:"banipfile" description:"File listing one CIDR range or IP per line to neither crawl nor serve; reloaded when it changes"`
+
+	ServeWhitelist     []string `long:"servewhitelist" description:"Only serve addresses in the given CIDR range or of the given IP, while still crawling all addresses; may be specified multiple times"`
+	ServeWhitelistFile string   `long:"servewhitelistfile" description:"File listing one CIDR range or IP per line to exclusively serve; reloaded when it changes"`
+
+	DNSRateLimit  float64  `long:"dnsratelimit" description:"Number of DNS queries per second answered per client IP address, or per /64 for IPv6; queries beyond it are dropped. 0, the default, disables the limit"`
+	DNSRateBurst  int      `long:"dnsrateburst" description:"Number of DNS queries a client may send at once before being rate limited"`
+	DNSRateExempt []string `long:"dnsrateexempt" description:"Do not rate limit DNS queries from the given CIDR range or IP, such as known recursive resolvers; may be specified multiple times"`
+
+	MaxTCPConns          int `long:"maxtcpconns" description:"Maximum number of DNS clients connected over TCP at the same time; further connections are closed right away"`
+	MaxTCPConnsPerClient int `long:"maxtcpconnsperclient" description:"Maximum number of TCP connections of a single client IP address, or /64 for IPv6, at the same time"`
+
+	QueryLogSample float64 `long:"querylogsample" description:"Fraction (0-1) of the answered DNS queries to log with their client, name, type, response code, number of answers and latency; 0 disables query logging"`
+	DnstapSocket   string  `long:"dnstapsocket" description:"Unix socket of a dnstap reader, e.g. dnstap -u <socket>, to send all DNS queries and responses to"`
+
+	AXFRAllow []string `long:"axfrallow" description:"Allow zone transfers (AXFR) over TCP to the given CIDR range or IP, such as secondary nameservers; zone transfers are refused to everyone else. May be specified multiple times"`
+
+	NSID string `long:"nsid" description:"Identifier of this server, returned in the EDNS NSID option to queries that ask for it, e.g. to tell apart the instances behind an anycast address; empty disables NSID"`
+
+	NoChaos       bool   `long:"nochaos" description:"Refuse CHAOS class queries for version.bind and hostname.bind rather than answering them"`
+	ChaosVersion  string `long:"chaosversion" description:"Version to answer CHAOS class queries for version.bind with; defaults to the version of the seeder"`
+	ChaosHostname string `long:"chaoshostname" description:"Hostname to answer CHAOS class queries for hostname.bind with; defaults to the hostname of the system"`
+
+	AnyQueries string `long:"anyqueries" description:"How to answer ANY queries (hinfo, refuse, drop): hinfo answers with a single HINFO record as per RFC 8482, refuse with REFUSED and drop not at all"`
+
+	AnswerTTL time.Duration `long:"answer-ttl" description:"TTL of the A and AAAA records of served nodes; shorter TTLs spread clients over more nodes while longer ones reduce the query load"`
+
+	SOAMname   string        `long:"soa-mname" description:"Primary nameserver in the zone's SOA record; defaults to --nameserver"`
+	SOARname   string        `long:"soa-rname" description:"Email address of the zone's administrator, in the zone's SOA record; defaults to hostmaster at --host"`
+	SOARefresh time.Duration `long:"soa-refresh" description:"Refresh interval in the zone's SOA record"`
+	SOARetry   time.Duration `long:"soa-retry" description:"Retry interval in the zone's SOA record"`
+	SOAExpire  time.Duration `long:"soa-expire" description:"Expire time in the zone's SOA record"`
+
+	DNSSECKeys []string `long:"dnsseckey" description:"Sign DNS answers with the key pair in <prefix>.key and <prefix>.private, as written by dnssec-keygen; keys with the SEP flag sign the DNSKEY set; may be specified multiple times"`
+
+	MaxAddrsPerMsg      int `long:"maxaddrspermsg" description:"Maximum number of addresses accepted from a single address message"`
+	MaxAddrsPerPeerHour int `long:"maxaddrsperpeerhour" description:"Maximum number of addresses accepted from a single peer per hour"`
+
+	BootstrapSeeds     string `long:"bootstrapseeds" description:"Comma separated list of DNS seeds to bootstrap from in addition to the network's built-in seeds"`
+	BootstrapThreshold int    `long:"bootstrapthreshold" description:"Bootstrap from DNS seeds and quickly re-crawl recently good nodes whenever fewer than this many good nodes are known"`
+
+	DialTimeout      time.Duration `long:"dialtimeout" description:"How long to wait for a TCP connection to a peer to be established"`
+	HandshakeTimeout time.Duration `long:"handshaketimeout" description:"How long to wait for the version handshake with a peer to complete"`
+	GetAddrTimeout   time.Duration `long:"getaddrtimeout" description:"How long to wait for a peer to respond to an address request"`
+	GetAddrRounds    int           `long:"getaddrrounds" description:"Number of address requests to send to a peer per connection"`
+	GetAddrInterval  time.Duration `long:"getaddrinterval" description:"Time to wait between consecutive address requests to the same peer"`
+	BanDuration      time.Duration `long:"banduration" description:"How long to ban misbehaving peers for"`
+	LivenessProbe    bool          `long:"livenessprobe" description:"Only consider peers good if they also answer a ping after the handshake"`
+
+	AttemptsPerMinute    int           `long:"attemptsperminute" description:"Maximum number of connection attempts per minute; addresses beyond it are deferred to later crawl cycles. 0 disables the limit"`
+	NetGroupDialInterval time.Duration `long:"netgroupdialinterval" description:"Minimum time between dials to peers in the same /16 (IPv4) or /32 (IPv6) network group; 0 disables the limit"`
+
+	StaleGood     time.Duration `long:"stale-good" description:"Time after which a successfully crawled node is considered stale and is verified again"`
+	StaleBad      time.Duration `long:"stale-bad" description:"Minimum time before retrying a node whose last connection attempt failed"`
+	CrawlInterval time.Duration `long:"crawl-interval" description:"Time to wait before looking for stale addresses again when none are left"`
+	CrawlJitter   time.Duration `long:"crawl-jitter" description:"Window over which the dials of a crawl cycle are spread at random offsets; 0 dials all addresses at once"`
+	CrawlSample   float64       `long:"crawl-sample" description:"Fraction (0-1) of the stale addresses to crawl per cycle, picked at random with a preference for addresses close to expiring; cycles are then crawl-interval apart. 0 crawls all stale addresses"`
+
+	ExpireNew   time.Duration `long:"expire-new" description:"Time after which a node that was never successfully crawled is removed if it was not advertised again"`
+	ExpireGood  time.Duration `long:"expire-good" description:"Time after which a node that was successfully crawled before is removed if it was not successfully crawled again"`
+	MaxFailures int           `long:"max-failures" description:"Number of consecutive failed connection attempts after which a node is removed; 0 disables the limit"`
+	MinQuality  float64       `long:"min-quality" description:"Quality (0-1) below which a node is removed; quality halves with each failed connection attempt and recovers with successful ones. 0 disables the limit"`
+	MultiPort   string        `long:"multiport" description:"How to handle an IP address advertised on several ports (all, default-port, verified): all keeps every port, default-port drops the other ports once the address is known on the network's default port, verified keeps only the port last crawled successfully"`
+	MaxNodes    int           `long:"maxnodes" description:"Maximum number of nodes in the address book; once reached, nodes that were never reached are evicted first and successfully crawled nodes are never evicted; 0 disables the limit"`
+
+	MinUptime2H float64 `long:"min-uptime-2h" description:"Minimum reliability (0-1) over the last 2 hours for a node to be served; 0 disables the requirement"`
+	MinUptime8H float64 `long:"min-uptime-8h" description:"Minimum reliability (0-1) over the last 8 hours for a node to be served; 0 disables the requirement"`
+	MinUptime1D float64 `long:"min-uptime-1d" description:"Minimum reliability (0-1) over the last day for a node to be served; 0 disables the requirement"`
+	MinUptime1W float64 `long:"min-uptime-1w" description:"Minimum reliability (0-1) over the last week for a node to be served; 0 disables the requirement"`
+
+	MinSuccesses   int           `long:"min-successes" description:"Number of consecutive successful connection attempts a node needs to be served"`
+	MinSuccessSpan time.Duration `long:"min-success-span" description:"Minimum time since the first of a node's consecutive successful connection attempts for it to be served; 0 disables the requirement"`
+
+	GoodTTL []string `long:"good-ttl" description:"Maximum time since a node was last crawled successfully for it to be served, either as a duration for any network or as network=duration (e.g. mainnet=4h) for a single network; may be repeated. Defaults to 4h on mainnet, 3h on testnet and 2h elsewhere. 0 disables the limit"`
+
+	DumpInterval  time.Duration `long:"dumpinterval" description:"How often to save the address book and bans to disk"`
+	PeersBackups  int           `long:"peersbackups" description:"Number of backups of the peers file to keep, rotated at startup; 0 keeps none. Only applies to the json storage backend"`
+	Storage       string        `long:"storage" description:"Storage backend of the address book (json, leveldb); a new leveldb address book imports the nodes of the json one"`
+	CompressPeers bool          `long:"compresspeers" description:"Compress the peers file of the json storage with gzip; compressed and uncompressed peers files are both read regardless"`
+
+	HistoryInterval  time.Duration `long:"historyinterval" description:"How often to record the numbers of known and good nodes, overall and per subnetwork, in the network size history; 0 disables the history"`
+	HistoryRetention time.Duration `long:"historyretention" description:"How long to keep network size history samples for"`
+
+	ASNDB            string `long:"asndb" description:"Path to a GeoLite2 ASN database (MaxMind DB format) used to tag nodes with their autonomous system"`
+	GeoDB            string `long:"geodb" description:"Path to a GeoLite2 country database (MaxMind DB format) used to tag nodes with their country and continent"`
+	MaxPerASN        int    `long:"maxperasn" description:"Maximum number of nodes from the same autonomous system in a single response; 0 disables the limit. Requires --asndb"`
+	MaxPerNetGroup   int    `long:"maxpernetgroup" description:"Maximum number of nodes from the same /16 (IPv4) or /32 (IPv6) network group in a single response, and counted as good overall; 0 disables the limit"`
+	PreferLowLatency bool   `long:"preferlowlatency" description:"Serve the good nodes with the lowest ping latency, or handshake latency if they were not probed, instead of arbitrary good nodes"`
+	WeightedAnswers  bool   `long:"weightedanswers" description:"Pick the good nodes to serve at random, weighted by their reliability over the last day and their handshake latency, instead of uniformly"`
+
+	RandSeed int64 `long:"randseed" description:"Seed of the random choices of the address manager, such as which addresses to crawl and serve, to reproduce a previous run; 0 picks a seed at startup, which is logged. The keys placing addresses in buckets are always secret and random"`
+
+	ImportDump string `long:"importdump" description:"Import the addresses of a dnsseed.dump file written by the bitcoin seeder at startup"`
+
+	Ephemeral bool `long:"ephemeral" description:"Keep all state in memory: neither load nor save the address book, bans and crawl state, and write nothing to the home directory, so that SIGUSR1 only exports nodes to --exportfile"`
+
+	ExportFile   string `long:"exportfile" description:"File to export all known nodes to when receiving SIGUSR1; defaults to export.<format> in the home directory"`
+	ExportFormat string `long:"exportformat" description:"Format of node exports (csv, json)"`
+
 	config.NetworkFlags
-}
 
-func loadConfig() (*ConfigFlags, error) {
-	err := os.MkdirAll(defaultHomeDir, 0700)
-	if err != nil {
-		// Show a nicer error message if it's because a symlink is
-		// linked to a directory that does not exist (probably because
-		// it's not mounted).
-		var pathErr *os.PathError
-		if ok := errors.As(err, &pathErr); ok && os.IsExist(err) {
-			if link, linkErr := os.Readlink(pathErr.Path); linkErr == nil {
-				str := "is symlink %s -> %s mounted?"
-				err = errors.Errorf(str, pathErr.Path, link)
-			}
-		}
+	// goodTTL is the good TTL that applies to the active network.
+	goodTTL time.Duration
 
-		str := "failed to create home directory: %v"
-		err := errors.Wrap(err, str)
-		fmt.Fprintln(os.Stderr, err)
-		return nil, err
-	}
+	// nameservers holds the parsed Nameserver values.
+	nameservers []nameserver
+
+	// listenEndpoints holds the parsed Listen values.
+	listenEndpoints []listenEndpoint
+
+	// zones holds the parsed Zone values.
+	zones []seederZone
+}
 
-	// Default config.
-	activeConfig = &ConfigFlags{
-		Listen:     normalizeAddress("localhost", defaultListenPort),
+// defaultConfigFlags returns a ConfigFlags with all options set to their
+// default values.
+func defaultConfigFlags() *ConfigFlags {
+	return &ConfigFlags{
+		Listen:     []string{normalizeAddress("localhost", defaultListenPort)},
 		GRPCListen: normalizeAddress("localhost", defaultGrpcListenPort),
+		Threads:    defaultThreads,
+
+		MaxHalfOpen: defaultMaxHalfOpen,
+
+		BootstrapThreshold: defaultBootstrapThreshold,
+
+		DumpInterval: defaultDumpInterval,
+		Storage:      storageJSON,
+
+		HistoryInterval:  defaultHistoryInterval,
+		HistoryRetention: defaultHistoryRetention,
+
+		ExportFormat: exportFormatCSV,
+
+		MaxAddrsPerMsg:      defaultMaxAddrsPerMsg,
+		MaxAddrsPerPeerHour: defaultMaxAddrsPerPeerHour,
+
+		DialTimeout:      defaultDialTimeout,
+		HandshakeTimeout: defaultHandshakeTimeout,
+		GetAddrTimeout:   defaultGetAddrTimeout,
+		GetAddrRounds:    defaultGetAddrRounds,
+		GetAddrInterval:  defaultGetAddrInterval,
+		BanDuration:      defaultBanDuration,
+
+		NetGroupDialInterval: defaultNetGroupDialInterval,
+
+		StaleGood:     defaultStaleGood,
+		StaleBad:      defaultStaleBad,
+		CrawlInterval: defaultCrawlInterval,
+		CrawlJitter:   defaultCrawlJitter,
+
+		ExpireNew:  defaultExpireNew,
+		ExpireGood: defaultExpireGood,
+		MinQuality: defaultMinQuality,
+		MaxNodes:   defaultMaxNodes,
+		MultiPort:  multiPortAll,
+
+		MinSuccesses: defaultMinSuccesses,
+
+		AnswerTTL:  defaultAnswerTTL,
+		AnyQueries: anyQueriesHINFO,
+
+		DNSRateLimit: defaultDNSRateLimit,
+		DNSRateBurst: defaultDNSRateBurst,
+
+		MaxTCPConns:          defaultMaxTCPConns,
+		MaxTCPConnsPerClient: defaultMaxTCPConnsPerClient,
+
+		SOARefresh: defaultSOARefresh,
+		SOARetry:   defaultSOARetry,
+		SOAExpire:  defaultSOAExpire,
 	}
+}
+
+func loadConfig() (*ConfigFlags, error) {
+	activeConfig = defaultConfigFlags()
 
 	preCfg := activeConfig
 	preParser := flags.NewParser(preCfg, flags.Default)
-	_, err = preParser.Parse()
+	_, err := preParser.Parse()
 	if err != nil {
 		var flagsErr *flags.Error
 		if errors.As(err, &flagsErr) && flagsErr.Type == flags.ErrHelp {
@@ -127,6 +343,28 @@ func loadConfig() (*ConfigFlags, error) {
 		return nil, err
 	}
 
+	// Ephemeral seeders write nothing to the home directory.
+	if !activeConfig.Ephemeral {
+		err = os.MkdirAll(defaultHomeDir, 0700)
+		if err != nil {
+			// Show a nicer error message if it's because a symlink is
+			// linked to a directory that does not exist (probably because
+			// it's not mounted).
+			var pathErr *os.PathError
+			if ok := errors.As(err, &pathErr); ok && os.IsExist(err) {
+				if link, linkErr := os.Readlink(pathErr.Path); linkErr == nil {
+					str := "is symlink %s -> %s mounted?"
+					err = errors.Errorf(str, pathErr.Path, link)
+				}
+			}
+
+			str := "failed to create home directory: %v"
+			err := errors.Wrap(err, str)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+	}
+
 	if len(activeConfig.Host) == 0 {
 		str := "Please specify a hostname"
 		err := errors.Errorf(str)
@@ -140,14 +378,329 @@ func loadConfig() (*ConfigFlags, error) {
 		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
+	for _, nameserverStr := range activeConfig.Nameserver {
+		ns, err := parseNameserver(nameserverStr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		if len(ns.glue) > 0 && !dns.IsSubDomain(dns.Fqdn(strings.ToLower(activeConfig.Host)), ns.name) {
+			str := "Glue can only be served for nameservers within %s, not for %s"
+			err := errors.Errorf(str, activeConfig.Host, ns.name)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		activeConfig.nameservers = append(activeConfig.nameservers, ns)
+	}
+
+	if activeConfig.PreferLowLatency && activeConfig.WeightedAnswers {
+		str := "The --preferlowlatency and --weightedanswers options can't be used together"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.QueryLogSample < 0 || activeConfig.QueryLogSample > 1 {
+		str := "The query log sample rate must be between 0 and 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.AnyQueries != anyQueriesHINFO && activeConfig.AnyQueries != anyQueriesRefuse &&
+		activeConfig.AnyQueries != anyQueriesDrop {
+
+		str := "The way of answering ANY queries must be one of %s, %s, %s"
+		err := errors.Errorf(str, anyQueriesHINFO, anyQueriesRefuse, anyQueriesDrop)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.AnswerTTL < 0 || activeConfig.AnswerTTL > math.MaxInt32*time.Second {
+		str := "The answer TTL must be between 0 and %s"
+		err := errors.Errorf(str, math.MaxInt32*time.Second)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	for _, d := range []time.Duration{activeConfig.SOARefresh, activeConfig.SOARetry, activeConfig.SOAExpire} {
+		if d < time.Second || d > math.MaxUint32*time.Second {
+			str := "The SOA refresh, retry and expire times must be between 1s and %s"
+			err := errors.Errorf(str, math.MaxUint32*time.Second)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+	}
+	if activeConfig.SOARname != "" {
+		activeConfig.SOARname = mboxName(activeConfig.SOARname)
+	}
+
+	if activeConfig.Threads < 1 {
+		str := "The number of crawler threads must be at least 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MaxHalfOpen < 1 {
+		str := "The maximum number of half-open connections must be at least 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.DialTimeout <= 0 || activeConfig.HandshakeTimeout <= 0 || activeConfig.GetAddrTimeout <= 0 {
+		str := "The dial, handshake and getaddr timeouts must be positive"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.GetAddrRounds < 1 || activeConfig.GetAddrInterval < 0 {
+		str := "The number of getaddr rounds must be at least 1 and their interval must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.StaleGood <= 0 || activeConfig.StaleBad <= 0 || activeConfig.CrawlInterval <= 0 {
+		str := "The stale-good, stale-bad and crawl-interval durations must be positive"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
 
-	activeConfig.Listen = normalizeAddress(activeConfig.Listen, defaultListenPort)
+	if activeConfig.ExpireNew <= 0 || activeConfig.ExpireGood <= 0 || activeConfig.MaxFailures < 0 || activeConfig.MaxNodes < 0 {
+		str := "The expire-new and expire-good durations must be positive and max-failures and maxnodes must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MinQuality < 0 || activeConfig.MinQuality > 1 {
+		str := "The minimum quality must be between 0 and 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	for _, minUptime := range []float64{activeConfig.MinUptime2H, activeConfig.MinUptime8H,
+		activeConfig.MinUptime1D, activeConfig.MinUptime1W} {
+
+		if minUptime < 0 || minUptime > 1 {
+			str := "The minimum uptimes must be between 0 and 1"
+			err := errors.Errorf(str)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+	}
+
+	_, err = parseIPRanges(activeConfig.BanIP)
+	if err != nil {
+		str := "Invalid --banip: %v"
+		err := errors.Errorf(str, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	_, err = parseIPRanges(activeConfig.DNSRateExempt)
+	if err != nil {
+		str := "Invalid --dnsrateexempt: %v"
+		err := errors.Errorf(str, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	_, err = parseIPRanges(activeConfig.AXFRAllow)
+	if err != nil {
+		str := "Invalid --axfrallow: %v"
+		err := errors.Errorf(str, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.DNSRateLimit < 0 || (activeConfig.DNSRateLimit > 0 && activeConfig.DNSRateBurst < 1) {
+		str := "The DNS rate limit must not be negative and the DNS rate burst must be at least 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MaxTCPConns < 1 || activeConfig.MaxTCPConnsPerClient < 1 {
+		str := "The maximum numbers of TCP connections must be at least 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	_, err = parseIPRanges(activeConfig.ServeWhitelist)
+	if err != nil {
+		str := "Invalid --servewhitelist: %v"
+		err := errors.Errorf(str, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MaxAddrsPerMsg < 1 || activeConfig.MaxAddrsPerPeerHour < 1 {
+		str := "The maximum numbers of addresses accepted per message and per peer per hour must be at least 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.DumpInterval <= 0 || activeConfig.PeersBackups < 0 {
+		str := "The dump interval must be positive and the number of peers file backups must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.Storage != storageJSON && activeConfig.Storage != storageLevelDB {
+		str := "The storage backend must be one of %s, %s"
+		err := errors.Errorf(str, storageJSON, storageLevelDB)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.HistoryInterval < 0 || activeConfig.HistoryRetention <= 0 {
+		str := "The history interval must not be negative and the history retention must be positive"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MultiPort != multiPortAll && activeConfig.MultiPort != multiPortDefault &&
+		activeConfig.MultiPort != multiPortVerified {
+
+		str := "The multi-port policy must be one of %s, %s, %s"
+		err := errors.Errorf(str, multiPortAll, multiPortDefault, multiPortVerified)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.ExportFormat != exportFormatCSV && activeConfig.ExportFormat != exportFormatJSON {
+		str := "The export format must be one of %s, %s"
+		err := errors.Errorf(str, exportFormatCSV, exportFormatJSON)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MinSuccesses < 1 || activeConfig.MinSuccessSpan < 0 {
+		str := "The number of consecutive successes to serve a node must be at least 1 and their span must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.CrawlSample < 0 || activeConfig.CrawlSample > 1 {
+		str := "The crawl sample must be between 0 and 1"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.CrawlJitter < 0 {
+		str := "The crawl jitter must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.AttemptsPerMinute < 0 {
+		str := "The number of connection attempts per minute must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MaxPerNetGroup < 0 || activeConfig.MaxPerASN < 0 {
+		str := "The maximum numbers of nodes per network group and autonomous system must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.MaxPerASN > 0 && activeConfig.ASNDB == "" {
+		str := "The maximum number of nodes per autonomous system requires --asndb"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if activeConfig.NetGroupDialInterval < 0 {
+		str := "The netgroup dial interval must not be negative"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	if len(activeConfig.Listen) == 0 {
+		str := "Please specify an address to listen on"
+		err := errors.Errorf(str)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	for _, listenStr := range activeConfig.Listen {
+		endpoints, err := parseListenAddress(listenStr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		activeConfig.listenEndpoints = append(activeConfig.listenEndpoints, endpoints...)
+	}
 
 	err = activeConfig.ResolveNetwork(parser)
 	if err != nil {
 		return nil, err
 	}
 
+	network := strings.TrimPrefix(activeConfig.NetParams().Name, "kaspa-")
+	activeConfig.goodTTL, err = resolveGoodTTL(activeConfig.GoodTTL, network)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	if activeConfig.goodTTL != 0 && activeConfig.goodTTL <= activeConfig.StaleGood {
+		str := "The good TTL of %s must be longer than stale-good, or nodes would not be served between crawls"
+		err := errors.Errorf(str, network)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+
+	hostnames := []string{dns.Fqdn(strings.ToLower(activeConfig.Host))}
+	networks := map[string]bool{network: true}
+	for _, zoneStr := range activeConfig.Zone {
+		zone, err := parseZone(zoneStr, activeConfig.GoodTTL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		zoneNetwork := zone.network.name()
+		if networks[zoneNetwork] {
+			str := "The %s network is served by more than one zone"
+			err := errors.Errorf(str, zoneNetwork)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		networks[zoneNetwork] = true
+		for _, hostname := range hostnames {
+			if dns.IsSubDomain(hostname, zone.hostname) || dns.IsSubDomain(zone.hostname, hostname) {
+				str := "The zones %s and %s overlap"
+				err := errors.Errorf(str, hostname, zone.hostname)
+				fmt.Fprintln(os.Stderr, err)
+				return nil, err
+			}
+		}
+		hostnames = append(hostnames, zone.hostname)
+		if zone.network.goodTTL() != 0 && zone.network.goodTTL() <= activeConfig.StaleGood {
+			str := "The good TTL of %s must be longer than stale-good, or nodes would not be served between crawls"
+			err := errors.Errorf(str, zoneNetwork)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+		activeConfig.zones = append(activeConfig.zones, zone)
+	}
+
 	if activeConfig.Profile != "" {
 		profilePort, err := strconv.Atoi(activeConfig.Profile)
 		if err != nil || profilePort < 1024 || profilePort > 65535 {
@@ -155,16 +708,75 @@ func loadConfig() (*ConfigFlags, error) {
 		}
 	}
 
-	initLog(defaultLogFile, defaultErrLogFile)
+	if !activeConfig.Ephemeral {
+		initLog(defaultLogFile, defaultErrLogFile)
+	}
 
 	return activeConfig, nil
 }
 
+// parseZone parses a zone given as hostname=network, whose network has the
+// good TTL set for it by goodTTLs.
+func parseZone(s string, goodTTLs []string) (seederZone, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return seederZone{}, errors.Errorf("invalid zone %s: expected hostname=network", s)
+	}
+	network, err := newSeederNetwork(s[i+1:], goodTTLs)
+	if err != nil {
+		return seederZone{}, errors.Errorf("invalid zone %s: %v", s, err)
+	}
+	return seederZone{hostname: dns.Fqdn(strings.ToLower(s[:i])), network: network}, nil
+}
+
+// resolveGoodTTL returns the good TTL of network set by entries, which are
+// either durations for any network or network=duration pairs for a single
+// one, or the default of the network if entries set none. Entries for the
+// network itself take precedence over entries for any network.
+func resolveGoodTTL(entries []string, network string) (time.Duration, error) {
+	ttl, ok := defaultNetworkGoodTTLs[network]
+	if !ok {
+		ttl = defaultGoodTTL
+	}
+
+	var anyNetworkTTL, networkTTL *time.Duration
+	for _, entry := range entries {
+		value := entry
+		entryNetwork := ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			entryNetwork, value = entry[:i], entry[i+1:]
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, errors.Errorf("invalid good TTL %s", entry)
+		}
+		switch entryNetwork {
+		case "":
+			anyNetworkTTL = &d
+		case network:
+			networkTTL = &d
+		}
+	}
+
+	if networkTTL != nil {
+		return *networkTTL, nil
+	}
+	if anyNetworkTTL != nil {
+		return *anyNetworkTTL, nil
+	}
+	return ttl, nil
+}
+
 // normalizeAddress returns addr with the passed default port appended if
 // there is not already a port specified.
 func normalizeAddress(addr, defaultPort string) string {
 	_, _, err := net.SplitHostPort(addr)
 	if err != nil {
+		// Bracketed IPv6 addresses without a port are bracketed again by
+		// JoinHostPort.
+		if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+			addr = addr[1 : len(addr)-1]
+		}
 		return net.JoinHostPort(addr, defaultPort)
 	}
 	return addr
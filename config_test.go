@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useDefaultConfig makes the default configuration active for the duration
+// of the test, restoring the previously active one when it ends.
+func useDefaultConfig(t *testing.T) {
+	previous := activeConfig
+	activeConfig = defaultConfigFlags()
+	t.Cleanup(func() {
+		activeConfig = previous
+	})
+}
+
+func TestResolveGoodTTL(t *testing.T) {
+	tests := []struct {
+		entries   []string
+		network   string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{network: "mainnet", expected: 4 * time.Hour},
+		{network: "devnet", expected: defaultGoodTTL},
+		{entries: []string{"90m"}, network: "mainnet", expected: 90 * time.Minute},
+		{entries: []string{"mainnet=6h", "90m"}, network: "mainnet", expected: 6 * time.Hour},
+		{entries: []string{"mainnet=6h", "90m"}, network: "devnet", expected: 90 * time.Minute},
+		{entries: []string{"testnet=6h"}, network: "devnet", expected: defaultGoodTTL},
+		{entries: []string{"0"}, network: "mainnet", expected: 0},
+		{entries: []string{"mainnet=soon"}, network: "mainnet", expectErr: true},
+	}
+
+	for _, test := range tests {
+		ttl, err := resolveGoodTTL(test.entries, test.network)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%v on %s: expected an error", test.entries, test.network)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v on %s: unexpected error: %s", test.entries, test.network, err)
+			continue
+		}
+		if ttl != test.expected {
+			t.Errorf("%v on %s: expected %s but got %s", test.entries, test.network, test.expected, ttl)
+		}
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		address   string
+		expected  []listenEndpoint
+		expectErr bool
+	}{
+		{address: "127.0.0.1:53", expected: []listenEndpoint{{"udp", "127.0.0.1:53"}, {"tcp", "127.0.0.1:53"}}},
+		{address: "0.0.0.0", expected: []listenEndpoint{{"udp", "0.0.0.0:5354"}, {"tcp", "0.0.0.0:5354"}}},
+		{address: "[::]:53", expected: []listenEndpoint{{"udp", "[::]:53"}, {"tcp", "[::]:53"}}},
+		{address: "[::]", expected: []listenEndpoint{{"udp", "[::]:5354"}, {"tcp", "[::]:5354"}}},
+		{address: "2001:db8::53", expected: []listenEndpoint{{"udp", "[2001:db8::53]:5354"}, {"tcp", "[2001:db8::53]:5354"}}},
+		{address: "udp://[2001:db8::53]:53", expected: []listenEndpoint{{"udp", "[2001:db8::53]:53"}}},
+		{address: "tcp://localhost:53", expected: []listenEndpoint{{"tcp", "localhost:53"}}},
+		{address: "udp://", expectErr: true},
+		{address: "sctp://localhost:53", expectErr: true},
+		{address: "localhost:domain53", expectErr: true},
+	}
+
+	for _, test := range tests {
+		endpoints, err := parseListenAddress(test.address)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.address, err)
+			continue
+		}
+		if !reflect.DeepEqual(endpoints, test.expected) {
+			t.Errorf("%s: expected %v but got %v", test.address, test.expected, endpoints)
+		}
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	tests := []struct {
+		zone             string
+		expectedHostname string
+		expectedNetwork  string
+		expectedGoodTTL  time.Duration
+		expectErr        bool
+	}{
+		{zone: "Testnet-Seed.example.org=testnet", expectedHostname: "testnet-seed.example.org.",
+			expectedNetwork: "testnet", expectedGoodTTL: 3 * time.Hour},
+		{zone: "devnet-seed.example.org.=devnet", expectedHostname: "devnet-seed.example.org.",
+			expectedNetwork: "devnet", expectedGoodTTL: 90 * time.Minute},
+		{zone: "seed.example.org", expectErr: true},
+		{zone: "=testnet", expectErr: true},
+		{zone: "seed.example.org=othernet", expectErr: true},
+	}
+
+	for _, test := range tests {
+		zone, err := parseZone(test.zone, []string{"devnet=90m"})
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.zone)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.zone, err)
+			continue
+		}
+		if zone.hostname != test.expectedHostname || zone.network.name() != test.expectedNetwork ||
+			zone.network.goodTTL() != test.expectedGoodTTL {
+
+			t.Errorf("%s: expected %s of %s with a good TTL of %s but got %s of %s with a good TTL of %s",
+				test.zone, test.expectedHostname, test.expectedNetwork, test.expectedGoodTTL,
+				zone.hostname, zone.network.name(), zone.network.goodTTL())
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// crawlStateFilename is the name of the file the crawl scheduling
+	// state is persisted to.
+	crawlStateFilename = "crawl.json"
+)
+
+// crawlState holds the crawl scheduling state that is not tied to a single
+// node. Per node scheduling state, such as retry backoffs, is persisted with
+// the nodes themselves.
+type crawlState struct {
+	LastBootstrap time.Time
+}
+
+// LastBootstrap returns when the DNS seeds were last queried for addresses
+func (m *Manager) LastBootstrap() time.Time {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.crawlState.LastBootstrap
+}
+
+// SetLastBootstrap records that the DNS seeds were queried for addresses at t
+func (m *Manager) SetLastBootstrap(t time.Time) {
+	m.mtx.Lock()
+	m.crawlState.LastBootstrap = t
+	m.mtx.Unlock()
+}
+
+func (m *Manager) deserializeCrawlState() error {
+	filePath := m.crawlStateFile
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	r, err := os.Open(filePath)
+	if err != nil {
+		return errors.Errorf("%s error opening file: %v", filePath, err)
+	}
+	defer r.Close()
+
+	var state crawlState
+	dec := json.NewDecoder(r)
+	err = dec.Decode(&state)
+	if err != nil {
+		return errors.Errorf("error reading %s: %v", filePath, err)
+	}
+
+	m.mtx.Lock()
+	m.crawlState = state
+	m.mtx.Unlock()
+
+	return nil
+}
+
+func (m *Manager) saveCrawlState() {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	err := writeJSONFile(m.crawlStateFile, &m.crawlState, false)
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
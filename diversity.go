@@ -0,0 +1,35 @@
+package main
+
+// countDiversity adds delta to the counts of the network group and autonomous
+// system of the node. It must be called with the manager lock held for
+// writes.
+func (m *Manager) countDiversity(node *Node, delta int) {
+	if m.netGroupCounts == nil {
+		m.netGroupCounts = make(map[string]int)
+		m.asnCounts = make(map[string]int)
+	}
+	adjustCount(m.netGroupCounts, netGroup(node.Addr.IP), delta)
+	if asn := node.asnGroup(); asn != "" {
+		adjustCount(m.asnCounts, asn, delta)
+	}
+}
+
+// adjustCount adds delta to counts[key], and forgets the key once its count
+// drops to zero.
+func adjustCount(counts map[string]int, key string, delta int) {
+	counts[key] += delta
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// representation returns how many known nodes share the network group or,
+// if it is known and more crowded, the autonomous system of the node. It must
+// be called with the manager lock held.
+func (m *Manager) representation(node *Node) int {
+	count := m.netGroupCounts[netGroup(node.Addr.IP)]
+	if asn := node.asnGroup(); asn != "" && m.asnCounts[asn] > count {
+		count = m.asnCounts[asn]
+	}
+	return count
+}
@@ -5,70 +5,278 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
 
+	"github.com/kaspanet/dnsseeder/version"
 	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
 	"github.com/pkg/errors"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	// negativeTTL is how long resolvers may cache that there are no nodes
+	// of an address family.
+	negativeTTL = 60
+
+	// maxUDPResponseSize is the size above which responses sent over UDP
+	// are truncated, so that resolvers retry over TCP, unless the query
+	// advertises a larger buffer with EDNS0.
+	maxUDPResponseSize = 512
+
+	// ednsUDPSize is the largest UDP payload the server advertises with
+	// EDNS0 and sends, which avoids IP fragmentation on common paths.
+	ednsUDPSize = 1232
+
+	// tcpIdleTimeout is how long TCP connections are kept open without a
+	// query being received.
+	tcpIdleTimeout = 10 * time.Second
+
+	// tcpFirstQueryTimeout is how long a new TCP connection is kept open
+	// without its first query being received, which is shorter than
+	// tcpIdleTimeout so that connections that are never used hold no slot
+	// for long.
+	tcpFirstQueryTimeout = 2 * time.Second
+
+	// hinfoTTL is the TTL of the HINFO records ANY queries are answered
+	// with, as suggested by RFC 8482.
+	hinfoTTL = 3600
+
+	// statsTTL is the TTL of the TXT record holding the seeder's
+	// statistics.
+	statsTTL = 60
+
+	// nsTTL is the TTL of the NS records of the zone and of the glue
+	// records of its nameservers.
+	nsTTL = 86400
+
+	// srvLabels prefixes the names selecting nodes to look up the SRV
+	// records of the nodes, which carry the ports they listen on.
+	srvLabels = "_seed._tcp."
+
+	// nodeLabelPrefix prefixes the labels below the apex naming the targets
+	// of the SRV records, which hold the hex encoded IP of a node.
+	nodeLabelPrefix = "node-"
+)
+
+// Ways of answering ANY queries.
+const (
+	// anyQueriesHINFO answers with a single synthesized HINFO record, as
+	// per RFC 8482.
+	anyQueriesHINFO = "hinfo"
+
+	// anyQueriesRefuse answers with REFUSED.
+	anyQueriesRefuse = "refuse"
+
+	// anyQueriesDrop leaves ANY queries unanswered.
+	anyQueriesDrop = "drop"
+)
+
+// nameserver is a nameserver of the zone, along with the glue addresses to
+// serve for it if it is within the zone.
+type nameserver struct {
+	name string
+	glue []net.IP
+}
+
+// parseNameserver parses a nameserver given as its hostname, optionally
+// followed by = and a comma separated list of its IP addresses.
+func parseNameserver(s string) (nameserver, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if parts[0] == "" {
+		return nameserver{}, errors.Errorf("invalid nameserver %s: missing hostname", s)
+	}
+	ns := nameserver{name: dns.Fqdn(strings.ToLower(parts[0]))}
+	if len(parts) == 2 {
+		for _, ipStr := range strings.Split(parts[1], ",") {
+			ip := net.ParseIP(strings.TrimSpace(ipStr))
+			if ip == nil {
+				return nameserver{}, errors.Errorf("invalid nameserver %s: invalid IP address %s", s, ipStr)
+			}
+			ns.glue = append(ns.glue, ip)
+		}
+	}
+	return ns, nil
+}
+
+// listenEndpoint is an address to listen on for DNS queries over network,
+// which is either udp or tcp.
+type listenEndpoint struct {
+	network string
+	address string
+}
+
+// parseListenAddress parses an address to listen on, optionally prefixed
+// with udp:// or tcp:// to listen over only that network, and returns the
+// endpoints to listen on. The port defaults to defaultListenPort.
+func parseListenAddress(s string) ([]listenEndpoint, error) {
+	networks := []string{"udp", "tcp"}
+	address := s
+	for _, network := range networks {
+		if strings.HasPrefix(s, network+"://") {
+			networks = []string{network}
+			address = strings.TrimPrefix(s, network+"://")
+			break
+		}
+	}
+	if address == "" || strings.Contains(address, "://") {
+		return nil, errors.Errorf("invalid listen address %s", s)
+	}
+	address = normalizeAddress(address, defaultListenPort)
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Errorf("invalid listen address %s: %v", s, err)
+	}
+	_, err = net.LookupPort("udp", port)
+	if err != nil {
+		return nil, errors.Errorf("invalid listen address %s: %v", s, err)
+	}
+
+	endpoints := make([]listenEndpoint, 0, len(networks))
+	for _, network := range networks {
+		endpoints = append(endpoints, listenEndpoint{network: network, address: address})
+	}
+	return endpoints, nil
+}
+
 // DNSServer struct
 type DNSServer struct {
-	hostname   string
-	listen     string
-	nameserver string
+	hostname    string
+	listen      []listenEndpoint
+	nameservers []nameserver
+	book        AddressBook
+
+	// zones holds the servers of the zones answered along with the
+	// server's own, such as those of other networks.
+	zones []*DNSServer
+
+	// signer signs the answers of queries that ask for DNSSEC records. It
+	// is nil if DNSSEC is disabled.
+	signer *dnssecSigner
+
+	// axfrAllow holds the ranges of the clients allowed to transfer the
+	// zone. It is nil if zone transfers are refused to everyone.
+	axfrAllow *ipRangeList
+
+	// limiter drops the queries of clients that exceed the rate limit. It
+	// is nil if queries aren't rate limited.
+	limiter *queryLimiter
+
+	// tcpConns limits the number of TCP connections open at the same time.
+	tcpConns *connLimiter
+
+	// queryLog logs a sample of the queries, and tap sends all queries and
+	// responses to a dnstap reader. Either is nil if disabled.
+	queryLog *queryLogger
+	tap      *dnstapWriter
 }
 
-// Start - starts server
-func (d *DNSServer) Start() {
+// Start - starts server, and serves requests on its listen endpoints over
+// UDP and TCP until ctx is canceled
+func (d *DNSServer) Start(ctx context.Context) {
 	defer wg.Done()
 
-	rr := fmt.Sprintf("%s 86400 IN NS %s", d.hostname, d.nameserver)
-	authority, err := dns.NewRR(rr)
+	authority := d.nsRRs(d.hostname)
+
+	exempt, err := newIPRangeList(ActiveConfig().DNSRateExempt, "")
 	if err != nil {
-		log.Infof("NewRR: %v", err)
+		log.Infof("DNS rate limit exemptions: %v", err)
 		return
 	}
+	d.limiter = newQueryLimiter(ActiveConfig().DNSRateLimit, ActiveConfig().DNSRateBurst, exempt)
+	d.tcpConns = newConnLimiter(ActiveConfig().MaxTCPConns, ActiveConfig().MaxTCPConnsPerClient)
 
-	udpAddr, err := net.ResolveUDPAddr("udp4", d.listen)
-	if err != nil {
-		log.Infof("ResolveUDPAddr: %v", err)
-		return
+	if len(ActiveConfig().AXFRAllow) > 0 {
+		d.axfrAllow, err = newIPRangeList(ActiveConfig().AXFRAllow, "")
+		if err != nil {
+			log.Infof("Zone transfer clients: %v", err)
+			return
+		}
 	}
 
-	udpListen, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		log.Infof("ListenUDP: %v", err)
-		return
+	var udpConns []*net.UDPConn
+	var tcpListeners []net.Listener
+	defer func() {
+		for _, udpConn := range udpConns {
+			udpConn.Close()
+		}
+		for _, tcpListener := range tcpListeners {
+			tcpListener.Close()
+		}
+	}()
+	for _, endpoint := range d.listen {
+		switch endpoint.network {
+		case "udp":
+			udpAddr, err := net.ResolveUDPAddr("udp", endpoint.address)
+			if err != nil {
+				log.Infof("ResolveUDPAddr: %v", err)
+				return
+			}
+			udpConn, err := net.ListenUDP("udp", udpAddr)
+			if err != nil {
+				log.Infof("ListenUDP: %v", err)
+				return
+			}
+			udpConns = append(udpConns, udpConn)
+		case "tcp":
+			tcpListener, err := net.Listen("tcp", endpoint.address)
+			if err != nil {
+				log.Infof("ListenTCP: %v", err)
+				return
+			}
+			tcpListeners = append(tcpListeners, tcpListener)
+		}
+		log.Infof("Listening for DNS queries over %s on %s", endpoint.network, endpoint.address)
 	}
-	defer udpListen.Close()
 
-	for {
-		b := make([]byte, 512)
-	mainLoop:
-		err := udpListen.SetReadDeadline(time.Now().Add(time.Second))
+	d.queryLog = newQueryLogger(ActiveConfig().QueryLogSample)
+	if ActiveConfig().DnstapSocket != "" {
+		identity, err := os.Hostname()
 		if err != nil {
-			log.Infof("SetReadDeadline: %v", err)
-			os.Exit(1)
+			log.Warnf("Failed to get the hostname to identify dnstap messages: %v", err)
 		}
-		_, addr, err := udpListen.ReadFromUDP(b)
+		d.tap = newDnstapWriter(ActiveConfig().DnstapSocket, identity, "dnsseeder "+version.Version())
+		wg.Add(1)
+		spawn("DNSServer.Start-dnstapWriter.run", func() { d.tap.run(ctx) })
+	}
+
+	for _, udpConn := range udpConns {
+		udpConn := udpConn
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveUDP", func() { d.serveUDP(ctx, authority, udpConn) })
+	}
+	for _, tcpListener := range tcpListeners {
+		tcpListener := tcpListener
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveTCP", func() { d.serveTCP(ctx, authority, tcpListener) })
+	}
+
+	// Closing the listeners on return unblocks the pending reads and
+	// accepts.
+	<-ctx.Done()
+	log.Infof("DNS server shutdown")
+}
+
+// serveUDP answers the queries received on udpConn until ctx is canceled.
+func (d *DNSServer) serveUDP(ctx context.Context, authority []dns.RR, udpConn *net.UDPConn) {
+	defer wg.Done()
+
+	for {
+		b := make([]byte, ednsUDPSize)
+		n, addr, err := udpConn.ReadFromUDP(b)
 		if err != nil {
-			var netErr net.Error
-			if errors.As(err, &netErr) && netErr.Timeout() {
-				if atomic.LoadInt32(&systemShutdown) == 0 {
-					// use goto in order to do not re-allocate 'b' buffer
-					goto mainLoop
-				}
-				log.Infof("DNS server shutdown")
+			if ctx.Err() != nil {
 				return
 			}
 			var opErr *net.OpError
@@ -80,44 +288,265 @@ func (d *DNSServer) Start() {
 			continue
 		}
 
+		if !d.limiter.allow(addr.IP, time.Now()) {
+			log.Debugf("%s: rate limited", addr)
+			continue
+		}
+
 		wg.Add(1)
 
-		spawn("DNSServer.Start-DNSServer.handleDNSRequest",
-			func() { d.handleDNSRequest(addr, authority, udpListen, b) })
+		spawn("DNSServer.serveUDP-DNSServer.handleDNSRequest",
+			func() { d.handleDNSRequest(addr, authority, udpConn, b[:n]) })
 	}
 }
 
-// NewDNSServer - create DNS server
-func NewDNSServer(hostname, nameserver, listen string) *DNSServer {
+// serveTCP accepts connections on tcpListen until ctx is canceled, and
+// answers the queries sent over each of them.
+func (d *DNSServer) serveTCP(ctx context.Context, authority []dns.RR, tcpListen net.Listener) {
+	defer wg.Done()
+
+	for {
+		conn, err := tcpListen.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Infof("Accept: %v", err)
+			continue
+		}
+
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !d.tcpConns.acquire(tcpAddr.IP) {
+			log.Debugf("%s: too many TCP connections", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		spawn("DNSServer.serveTCP-DNSServer.handleTCPConn", func() {
+			defer d.tcpConns.release(tcpAddr.IP)
+			d.handleTCPConn(ctx, authority, conn)
+		})
+	}
+}
+
+// handleTCPConn answers the queries sent over conn, each of which is
+// preceded by its length as a two-byte big-endian integer, until the client
+// closes it, stays idle for tcpIdleTimeout, or tcpFirstQueryTimeout before
+// its first query, or ctx is canceled.
+func (d *DNSServer) handleTCPConn(ctx context.Context, authority []dns.RR, conn net.Conn) {
+	defer wg.Done()
+	defer conn.Close()
+
+	addr := conn.RemoteAddr()
+	timeout := tcpFirstQueryTimeout
+	for ctx.Err() == nil {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		timeout = tcpIdleTimeout
+		if err != nil {
+			log.Infof("%s: SetDeadline: %v", addr, err)
+			return
+		}
+
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			log.Infof("%s: failed to read query: %v", addr, err)
+			return
+		}
+
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok && !d.limiter.allow(tcpAddr.IP, time.Now()) {
+			log.Debugf("%s: rate limited", addr)
+			return
+		}
+
+		if messages, ok := d.zoneTransfer(addr, b); ok {
+			for _, message := range messages {
+				err := writeTCPMessage(conn, message)
+				if err != nil {
+					log.Infof("%s: failed to write zone transfer: %v", addr, err)
+					return
+				}
+			}
+			continue
+		}
+
+		sendBytes, ok := d.answer(addr, authority, b, false)
+		if !ok {
+			return
+		}
+		err = writeTCPMessage(conn, sendBytes)
+		if err != nil {
+			log.Infof("%s: failed to write response: %v", addr, err)
+			return
+		}
+	}
+}
+
+// writeTCPMessage writes the packed message b to conn, preceded by its
+// length as a two-byte big-endian integer.
+func writeTCPMessage(conn net.Conn, b []byte) error {
+	message := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(message, uint16(len(b)))
+	copy(message[2:], b)
+	_, err := conn.Write(message)
+	return err
+}
+
+// NewDNSServer - create DNS server for the zone served by nameservers,
+// listening on the listen endpoints and answering with the good addresses of
+// book, signed by signer unless it is nil. The glue of nameservers outside
+// the zone is dropped, since it can't be served.
+func NewDNSServer(hostname string, nameservers []nameserver, listen []listenEndpoint, book AddressBook,
+	signer *dnssecSigner) *DNSServer {
+
 	if hostname[len(hostname)-1] != '.' {
 		hostname = hostname + "."
 	}
-	if nameserver[len(nameserver)-1] != '.' {
-		nameserver = nameserver + "."
+
+	zoneNameservers := make([]nameserver, len(nameservers))
+	for i, ns := range nameservers {
+		zoneNameservers[i] = ns
+		if !dns.IsSubDomain(hostname, ns.name) {
+			zoneNameservers[i].glue = nil
+		}
 	}
+	nameservers = zoneNameservers
 
 	return &DNSServer{
-		hostname:   hostname,
-		listen:     listen,
-		nameserver: nameserver,
+		hostname:    hostname,
+		listen:      listen,
+		nameservers: nameservers,
+		book:        book,
+		signer:      signer,
+	}
+}
+
+// nsRRs returns the NS records of name, which are those of the zone.
+func (d *DNSServer) nsRRs(name string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(d.nameservers))
+	for _, ns := range d.nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: nsTTL},
+			Ns:  ns.name,
+		})
+	}
+	return rrs
+}
+
+// glueRRs returns the glue records of the nameservers within the zone.
+func (d *DNSServer) glueRRs() []dns.RR {
+	var rrs []dns.RR
+	for _, ns := range d.nameservers {
+		for _, ip := range ns.glue {
+			rrs = append(rrs, addressRR(ns.name, ip, nsTTL))
+		}
+	}
+	return rrs
+}
+
+// nameExists returns whether name, which must be within the zone, exists:
+// the names selecting nodes, their _seed._tcp SRV names, the SRV targets
+// naming single nodes and the nameservers within the zone do.
+func (d *DNSServer) nameExists(name string) bool {
+	name = strings.ToLower(name)
+	if d.nameserverGlue(name) != nil || d.nodeIP(name) != nil {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(name, srvLabels):
+		name = name[len(srvLabels):]
+	case strings.HasPrefix(name, "_tcp."):
+		// _tcp is an empty non-terminal above the SRV names.
+		name = name[len("_tcp."):]
 	}
+	return d.selectsNodes(name)
 }
 
-func (d *DNSServer) extractSubnetworkID(addr *net.UDPAddr, domainName string) (*externalapi.DomainSubnetworkID, bool, error) {
+// selectsNodes returns whether name, which must be within the zone, selects
+// the nodes to answer with: the apex and the n[subnetwork] labels right
+// below it do.
+func (d *DNSServer) selectsNodes(name string) bool {
+	name = strings.ToLower(name)
+	if strings.EqualFold(name, d.hostname) {
+		return true
+	}
+	labels := dns.SplitDomainName(name)
+	if len(labels) != dns.CountLabel(d.hostname)+1 || labels[0][0] != dnsseed.SubnetworkIDPrefixChar {
+		return false
+	}
+	if len(labels[0]) == 1 {
+		return true
+	}
+	_, err := subnetworks.FromString(labels[0][1:])
+	return err == nil
+}
+
+// nodeName returns the name of the SRV target resolving to ip.
+func (d *DNSServer) nodeName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return nodeLabelPrefix + hex.EncodeToString(ip) + "." + d.hostname
+}
+
+// nodeIP returns the IP of the node named name by nodeName, or nil if name
+// doesn't name a node. Only the nodes currently served have names, so that
+// the zone can't be made to resolve names to arbitrary addresses.
+func (d *DNSServer) nodeIP(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	if len(labels) != dns.CountLabel(d.hostname)+1 || !strings.HasPrefix(strings.ToLower(labels[0]), nodeLabelPrefix) {
+		return nil
+	}
+	b, err := hex.DecodeString(labels[0][len(nodeLabelPrefix):])
+	if err != nil {
+		return nil
+	}
+	ip := net.IP(b)
+	// IPv4 addresses are only named in their 4 byte form.
+	if (len(ip) != net.IPv4len && len(ip) != net.IPv6len) || (len(ip) == net.IPv6len && ip.To4() != nil) {
+		return nil
+	}
+	if !d.book.IsServed(ip) {
+		return nil
+	}
+	return ip
+}
+
+// nameserverGlue returns the glue addresses of the nameserver called name,
+// or nil if name isn't a nameserver with glue.
+func (d *DNSServer) nameserverGlue(name string) []net.IP {
+	for _, ns := range d.nameservers {
+		if strings.EqualFold(ns.name, name) {
+			return ns.glue
+		}
+	}
+	return nil
+}
+
+func (d *DNSServer) extractSubnetworkID(addr net.Addr, domainName string) (*externalapi.DomainSubnetworkID, bool, error) {
 	// Domain name may be in following format:
-	//   [n[subnetwork].]hostname
-	// where connmgr.SubnetworkIDPrefixChar is a prefix
+	//   [_seed._tcp.][n[subnetwork].]hostname
+	// where connmgr.SubnetworkIDPrefixChar is a prefix. A bare n label
+	// selects the nodes whose subnetwork is not known.
 	var subnetworkID *externalapi.DomainSubnetworkID
 	includeAllSubnetworks := true
+	domainName = strings.TrimPrefix(domainName, srvLabels)
 	if d.hostname != domainName {
 		labels := dns.SplitDomainName(domainName)
 		if labels[0][0] == dnsseed.SubnetworkIDPrefixChar {
 			includeAllSubnetworks = false
 			if len(labels[0]) > 1 {
-				subnetworkID, err := subnetworks.FromString(labels[0][1:])
+				var err error
+				subnetworkID, err = subnetworks.FromString(labels[0][1:])
 				if err != nil {
 					log.Infof("%s: subnetworkid.NewFromStr: %v", addr, err)
-					return subnetworkID, includeAllSubnetworks, err
+					return nil, includeAllSubnetworks, err
 				}
 			}
 		}
@@ -125,78 +554,206 @@ func (d *DNSServer) extractSubnetworkID(addr *net.UDPAddr, domainName string) (*
 	return subnetworkID, includeAllSubnetworks, nil
 }
 
-func (d *DNSServer) validateDNSRequest(addr *net.UDPAddr, b []byte) (dnsMsg *dns.Msg, domainName string, atype string, err error) {
+// validateDNSRequest unpacks the query b and returns it along with the zone
+// its name is in, which is d's own zone or one of the zones added to it, or
+// nil if its name is in none of them.
+func (d *DNSServer) validateDNSRequest(addr net.Addr, b []byte) (dnsMsg *dns.Msg, zone *DNSServer,
+	domainName string, atype string, err error) {
+
 	dnsMsg = new(dns.Msg)
 	err = dnsMsg.Unpack(b[:])
 	if err != nil {
 		log.Infof("%s: invalid dns message: %v", addr, err)
-		return nil, "", "", err
+		return nil, nil, "", "", err
 	}
 	if len(dnsMsg.Question) != 1 {
 		str := fmt.Sprintf("%s sent more than 1 question: %d", addr, len(dnsMsg.Question))
 		log.Infof("%s", str)
-		return nil, "", "", errors.Errorf("%s", str)
+		return nil, nil, "", "", errors.Errorf("%s", str)
 	}
 	domainName = strings.ToLower(dnsMsg.Question[0].Name)
-	ff := strings.LastIndex(domainName, d.hostname)
-	if ff < 0 {
-		str := fmt.Sprintf("invalid name: %s", dnsMsg.Question[0].Name)
-		log.Infof("%s", str)
-		return nil, "", "", errors.Errorf("%s", str)
+	zone = d.zoneOf(domainName)
+	if zone == nil {
+		log.Infof("%s: query for %s outside of the zones", addr, dnsMsg.Question[0].Name)
+		return dnsMsg, nil, domainName, "", nil
 	}
-	atype, err = translateDNSQuestion(addr, dnsMsg)
-	return dnsMsg, domainName, atype, err
+	return dnsMsg, zone, domainName, translateDNSQuestion(dnsMsg), nil
 }
 
-func translateDNSQuestion(addr *net.UDPAddr, dnsMsg *dns.Msg) (string, error) {
-	var atype string
-	qtype := dnsMsg.Question[0].Qtype
-	switch qtype {
-	case dns.TypeA:
-		atype = "A"
-	case dns.TypeAAAA:
-		atype = "AAAA"
-	case dns.TypeNS:
-		atype = "NS"
-	default:
-		str := fmt.Sprintf("%s: invalid qtype: %d", addr, dnsMsg.Question[0].Qtype)
-		log.Infof("%s", str)
-		return "", errors.Errorf("%s", str)
+// AddZone makes d also answer the queries for the names in the zone of
+// zone, which answers them with its own nameservers, nodes and keys. The
+// zone server itself must not be started, since d listens for it, and zones
+// must be added before d is started.
+func (d *DNSServer) AddZone(zone *DNSServer) {
+	d.zones = append(d.zones, zone)
+}
+
+// zoneOf returns the server of the zone that name is in, or nil if name is
+// in none of the zones served by d. Zones don't overlap, so name is in at most
+// one of them.
+func (d *DNSServer) zoneOf(name string) *DNSServer {
+	if dns.IsSubDomain(d.hostname, name) {
+		return d
 	}
-	return atype, nil
+	for _, zone := range d.zones {
+		if dns.IsSubDomain(zone.hostname, name) {
+			return zone
+		}
+	}
+	return nil
+}
+
+// translateDNSQuestion returns the name of the type dnsMsg asks for. Queries
+// of any type are answered, and those of types the zone has no records of
+// with an empty answer.
+func translateDNSQuestion(dnsMsg *dns.Msg) string {
+	return dns.Type(dnsMsg.Question[0].Qtype).String()
 }
 
-func (d *DNSServer) buildDNSResponse(addr *net.UDPAddr, authority dns.RR, dnsMsg *dns.Msg, includeAllSubnetworks bool,
-	subnetworkID *externalapi.DomainSubnetworkID, atype string) ([]byte, error) {
+// buildDNSResponse returns the packed response to dnsMsg. Unless maxSize is 0,
+// records are left out of responses that would be larger than maxSize bytes,
+// and the TC bit is set on them.
+func (d *DNSServer) buildDNSResponse(addr net.Addr, authority []dns.RR, dnsMsg *dns.Msg, includeAllSubnetworks bool,
+	subnetworkID *externalapi.DomainSubnetworkID, maxSize int) ([]byte, error) {
 
 	respMsg := dnsMsg.Copy()
 	respMsg.Authoritative = true
 	respMsg.Response = true
 
+	// Rather than echoing the query's OPT record, respond with one
+	// advertising the server's own buffer size.
+	respMsg.Extra = nil
+	if opt := dnsMsg.IsEdns0(); opt != nil {
+		respMsg.SetEdns0(ednsUDPSize, opt.Do())
+		if nsid := ActiveConfig().NSID; nsid != "" && hasEDNS0Option(opt, dns.EDNS0NSID) {
+			respOpt := respMsg.IsEdns0()
+			respOpt.Option = append(respOpt.Option, &dns.EDNS0_NSID{
+				Code: dns.EDNS0NSID,
+				Nsid: hex.EncodeToString([]byte(nsid)),
+			})
+		}
+	}
+
+	// The zone has no other names than those of nameExists, so queries
+	// for any other name are answered with NXDOMAIN, along with the zone's
+	// SOA, which tells resolvers how long they may cache that.
+	if !d.nameExists(dnsMsg.Question[0].Name) {
+		respMsg.Rcode = dns.RcodeNameError
+		respMsg.Ns = append(respMsg.Ns, d.soaRR())
+		return d.packResponse(addr, dnsMsg, respMsg, maxSize)
+	}
+
 	qtype := dnsMsg.Question[0].Qtype
-	if qtype != dns.TypeNS {
-		respMsg.Ns = append(respMsg.Ns, authority)
-		addrs := amgr.GoodAddresses(qtype, includeAllSubnetworks, subnetworkID)
+	switch qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		// Zone transfers to allowed clients are handled by zoneTransfer.
+		respMsg.Rcode = dns.RcodeRefused
+	case dns.TypeANY:
+		// Rather than all records of the name, which would make the
+		// seeder an attractive amplifier, send a minimal answer.
+		if ActiveConfig().AnyQueries == anyQueriesRefuse {
+			respMsg.Rcode = dns.RcodeRefused
+			break
+		}
+		respMsg.Answer = append(respMsg.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{Name: dnsMsg.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: hinfoTTL},
+			Cpu: "RFC8482",
+		})
+	case dns.TypeNS:
+		// NS records below the apex would make up a zone cut.
+		if strings.EqualFold(dnsMsg.Question[0].Name, d.hostname) {
+			respMsg.Answer = append(respMsg.Answer, d.nsRRs(d.hostname)...)
+			respMsg.Extra = append(respMsg.Extra, d.glueRRs()...)
+		}
+	case dns.TypeSOA:
+		if strings.EqualFold(dnsMsg.Question[0].Name, d.hostname) {
+			respMsg.Answer = append(respMsg.Answer, d.soaRR())
+		}
+	case dns.TypeTXT:
+		if strings.EqualFold(dnsMsg.Question[0].Name, d.hostname) {
+			respMsg.Answer = append(respMsg.Answer, d.statsRR())
+		}
+	case dns.TypeDNSKEY, dns.TypeDS:
+		// The DS set is served by the parent zone, so only the DNSKEY
+		// set of the apex is ever answered here.
+		if d.signer != nil && qtype == dns.TypeDNSKEY && strings.EqualFold(dnsMsg.Question[0].Name, d.hostname) {
+			respMsg.Answer = append(respMsg.Answer, d.signer.dnskeys()...)
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		if glue := d.nameserverGlue(dnsMsg.Question[0].Name); glue != nil {
+			for _, ip := range glue {
+				if (qtype == dns.TypeA) == (ip.To4() != nil) {
+					respMsg.Answer = append(respMsg.Answer, addressRR(dnsMsg.Question[0].Name, ip, nsTTL))
+				}
+			}
+			break
+		}
+		ttl := uint32(ActiveConfig().AnswerTTL / time.Second)
+		if ip := d.nodeIP(dnsMsg.Question[0].Name); ip != nil {
+			if (qtype == dns.TypeA) == (ip.To4() != nil) {
+				respMsg.Answer = append(respMsg.Answer, addressRR(dnsMsg.Question[0].Name, ip, ttl))
+			}
+			break
+		}
+		if !d.selectsNodes(dnsMsg.Question[0].Name) {
+			break
+		}
+		addrs := d.book.GoodAddresses(qtype, includeAllSubnetworks, subnetworkID, true)
 		log.Infof("%s: Sending %d addresses", addr, len(addrs))
 		for _, a := range addrs {
-			rr := fmt.Sprintf("%s 30 IN %s %s", dnsMsg.Question[0].Name, atype, a.IP.String())
-			newRR, err := dns.NewRR(rr)
-			if err != nil {
-				log.Infof("%s: NewRR: %v", addr, err)
-				return nil, err
+			respMsg.Answer = append(respMsg.Answer, addressRR(dnsMsg.Question[0].Name, a.IP, ttl))
+		}
+	case dns.TypeSRV:
+		// Unlike A and AAAA records, SRV records carry ports, so nodes
+		// listening on any port are answered with, along with the
+		// addresses of their targets.
+		if !strings.HasPrefix(strings.ToLower(dnsMsg.Question[0].Name), srvLabels) {
+			break
+		}
+		ttl := uint32(ActiveConfig().AnswerTTL / time.Second)
+		for _, addrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			addrs := d.book.GoodAddresses(addrType, includeAllSubnetworks, subnetworkID, false)
+			for _, a := range addrs {
+				target := d.nodeName(a.IP)
+				respMsg.Answer = append(respMsg.Answer, &dns.SRV{
+					Hdr:    dns.RR_Header{Name: dnsMsg.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+					Port:   a.Port,
+					Target: target,
+				})
+				respMsg.Extra = append(respMsg.Extra, addressRR(target, a.IP, ttl))
 			}
+		}
+		log.Infof("%s: Sending %d SRV records", addr, len(respMsg.Answer))
+	}
 
-			respMsg.Answer = append(respMsg.Answer, newRR)
+	if respMsg.Rcode == dns.RcodeSuccess {
+		// Without nodes of the queried address family, or for types the
+		// zone has no records of, the answer is empty and carries the
+		// zone's SOA, which tells resolvers how long they may cache that.
+		if len(respMsg.Answer) == 0 {
+			respMsg.Ns = append(respMsg.Ns, d.soaRR())
+		} else if qtype != dns.TypeNS {
+			respMsg.Ns = append(respMsg.Ns, authority...)
 		}
-	} else {
-		rr := fmt.Sprintf("%s 86400 IN NS %s", dnsMsg.Question[0].Name, d.nameserver)
-		newRR, err := dns.NewRR(rr)
+	}
+
+	return d.packResponse(addr, dnsMsg, respMsg, maxSize)
+}
+
+// packResponse signs respMsg, the response to dnsMsg, if DNSSEC records were
+// asked for, truncates it to maxSize unless maxSize is 0 and returns it
+// packed.
+func (d *DNSServer) packResponse(addr net.Addr, dnsMsg *dns.Msg, respMsg *dns.Msg, maxSize int) ([]byte, error) {
+	if d.signer != nil && dnssecRequested(dnsMsg) && respMsg.Rcode != dns.RcodeRefused {
+		err := d.signer.signResponse(respMsg, time.Now())
 		if err != nil {
-			log.Infof("%s: NewRR: %v", addr, err)
+			log.Errorf("%s: failed to sign response: %v", addr, err)
 			return nil, err
 		}
+	}
 
-		respMsg.Answer = append(respMsg.Answer, newRR)
+	if maxSize > 0 {
+		respMsg.Truncate(maxSize)
 	}
 
 	sendBytes, err := respMsg.Pack()
@@ -207,30 +764,242 @@ func (d *DNSServer) buildDNSResponse(addr *net.UDPAddr, authority dns.RR, dnsMsg
 	return sendBytes, nil
 }
 
-func (d *DNSServer) handleDNSRequest(addr *net.UDPAddr, authority dns.RR, udpListen *net.UDPConn, b []byte) {
+// soaRR returns the SOA record of the zone. Its serial is the time the nodes
+// answered with last changed, so it only increases when the zone did.
+func (d *DNSServer) soaRR() dns.RR {
+	cfg := ActiveConfig()
+	mname := d.nameservers[0].name
+	if cfg.SOAMname != "" {
+		mname = dns.Fqdn(cfg.SOAMname)
+	}
+	rname := "hostmaster." + d.hostname
+	if cfg.SOARname != "" {
+		rname = cfg.SOARname
+	}
+	lastUpdate := d.book.LastUpdate()
+	if lastUpdate.IsZero() {
+		lastUpdate = time.Now()
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: d.hostname, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: negativeTTL},
+		Ns:      mname,
+		Mbox:    rname,
+		Serial:  uint32(lastUpdate.Unix()),
+		Refresh: uint32(cfg.SOARefresh / time.Second),
+		Retry:   uint32(cfg.SOARetry / time.Second),
+		Expire:  uint32(cfg.SOAExpire / time.Second),
+		Minttl:  negativeTTL,
+	}
+}
+
+// mboxName returns the domain name form of an email address, as found in SOA
+// records. Names that aren't email addresses are returned as FQDNs.
+func mboxName(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return dns.Fqdn(email)
+	}
+	return dns.Fqdn(strings.ReplaceAll(email[:at], ".", `\.`) + "." + email[at+1:])
+}
+
+// addressRR returns an A or AAAA resource record for ip, depending on its
+// address family.
+func addressRR(name string, ip net.IP, ttl uint32) dns.RR {
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip4}
+	}
+	header.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: header, AAAA: ip.To16()}
+}
+
+func (d *DNSServer) handleDNSRequest(addr *net.UDPAddr, authority []dns.RR, udpListen *net.UDPConn, b []byte) {
 	defer wg.Done()
 
-	dnsMsg, domainName, atype, err := d.validateDNSRequest(addr, b)
-	if err != nil {
+	sendBytes, ok := d.answer(addr, authority, b, true)
+	if !ok {
 		return
 	}
 
-	subnetworkID, includeAllSubnetworks, err := d.extractSubnetworkID(addr, domainName)
+	_, err := udpListen.WriteToUDP(sendBytes, addr)
 	if err != nil {
+		log.Infof("%s: failed to write response: %v", addr, err)
 		return
 	}
+}
 
-	log.Infof("%s: query %d for subnetwork ID %v",
-		addr, dnsMsg.Question[0].Qtype, subnetworkID)
+// statsRR returns the TXT record of the apex, which summarizes the state of
+// the seeder for operators and monitoring.
+func (d *DNSServer) statsRR() dns.RR {
+	lastUpdate := "never"
+	if updated := d.book.LastUpdate(); !updated.IsZero() {
+		lastUpdate = updated.UTC().Format(time.RFC3339)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: d.hostname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: statsTTL},
+		Txt: []string{
+			fmt.Sprintf("good=%d", d.book.GoodAddressCount()),
+			fmt.Sprintf("known=%d", d.book.AddressCount()),
+			"updated=" + lastUpdate,
+			"version=" + version.Version(),
+		},
+	}
+}
+
+// answer returns the packed response to the query b received from addr,
+// truncated to fit in the client's buffer if it was received over UDP, or
+// false if the query isn't answered.
+func (d *DNSServer) answer(addr net.Addr, authority []dns.RR, b []byte, overUDP bool) ([]byte, bool) {
+	received := time.Now()
+	d.tap.log(&dnstapEvent{client: addr, tcp: !overUDP, time: received, query: b})
 
-	sendBytes, err := d.buildDNSResponse(addr, authority, dnsMsg, includeAllSubnetworks, subnetworkID, atype)
+	dnsMsg, zone, domainName, atype, err := d.validateDNSRequest(addr, b)
 	if err != nil {
-		return
+		return nil, false
+	}
+	if dnsMsg.Question[0].Qclass == dns.ClassCHAOS {
+		sendBytes, err := chaosResponse(dnsMsg)
+		if err != nil {
+			log.Infof("%s: failed to pack response: %v", addr, err)
+			return nil, false
+		}
+		d.logResponse(addr, b, dnsMsg, sendBytes, received, overUDP)
+		return sendBytes, true
+	}
+	if zone == nil {
+		sendBytes, err := refusedResponse(dnsMsg)
+		if err != nil {
+			log.Infof("%s: failed to pack response: %v", addr, err)
+			return nil, false
+		}
+		d.logResponse(addr, b, dnsMsg, sendBytes, received, overUDP)
+		return sendBytes, true
+	}
+	if dnsMsg.Question[0].Qtype == dns.TypeANY && ActiveConfig().AnyQueries == anyQueriesDrop {
+		return nil, false
+	}
+	// authority holds the NS records of d's own zone.
+	if zone != d {
+		authority = zone.nsRRs(zone.hostname)
 	}
 
-	_, err = udpListen.WriteToUDP(sendBytes, addr)
+	// Nameservers within the zone and SRV targets are answered with their
+	// own addresses rather than with nodes, and names that don't exist with
+	// NXDOMAIN, so their names aren't parsed for a subnetwork ID.
+	var subnetworkID *externalapi.DomainSubnetworkID
+	includeAllSubnetworks := true
+	if zone.nameserverGlue(domainName) == nil && zone.nodeIP(domainName) == nil && zone.nameExists(domainName) {
+		subnetworkID, includeAllSubnetworks, err = zone.extractSubnetworkID(addr, domainName)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	log.Infof("%s: query %s for subnetwork ID %v",
+		addr, atype, subnetworkID)
+
+	maxSize := 0
+	if overUDP {
+		maxSize = udpResponseSize(dnsMsg)
+	}
+	sendBytes, err := zone.buildDNSResponse(addr, authority, dnsMsg, includeAllSubnetworks, subnetworkID, maxSize)
 	if err != nil {
-		log.Infof("%s: failed to write response: %v", addr, err)
-		return
+		return nil, false
+	}
+
+	d.logResponse(addr, b, dnsMsg, sendBytes, received, overUDP)
+	return sendBytes, true
+}
+
+// logResponse logs the response sendBytes to the query b, unpacked as
+// dnsMsg, received from addr at received.
+func (d *DNSServer) logResponse(addr net.Addr, b []byte, dnsMsg *dns.Msg, sendBytes []byte, received time.Time,
+	overUDP bool) {
+
+	d.queryLog.log(addr, dnsMsg.Question[0], sendBytes, time.Since(received))
+	d.tap.log(&dnstapEvent{isResponse: true, client: addr, tcp: !overUDP, time: time.Now(), query: b, response: sendBytes})
+}
+
+// chaosResponse returns the packed response to dnsMsg, a CHAOS class query.
+// TXT queries for version.bind and hostname.bind, and their RFC 4892
+// equivalents version.server and id.server, are answered with the version and
+// the hostname of the seeder, which fleet inventory tools ask for, unless
+// that is disabled. All other queries are refused.
+func chaosResponse(dnsMsg *dns.Msg) ([]byte, error) {
+	cfg := ActiveConfig()
+	question := dnsMsg.Question[0]
+	var txt string
+	switch strings.ToLower(question.Name) {
+	case "version.bind.", "version.server.":
+		txt = cfg.ChaosVersion
+		if txt == "" {
+			txt = "dnsseeder " + version.Version()
+		}
+	case "hostname.bind.", "id.server.":
+		txt = cfg.ChaosHostname
+		if txt == "" {
+			var err error
+			txt, err = os.Hostname()
+			if err != nil {
+				log.Warnf("Failed to get the hostname to answer %s: %v", question.Name, err)
+			}
+		}
+	}
+	if cfg.NoChaos || txt == "" || question.Qtype != dns.TypeTXT {
+		return refusedResponse(dnsMsg)
+	}
+
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(dnsMsg)
+	respMsg.Authoritative = true
+	respMsg.Answer = append(respMsg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	})
+	if dnsMsg.IsEdns0() != nil {
+		respMsg.SetEdns0(ednsUDPSize, false)
+	}
+	return respMsg.Pack()
+}
+
+// refusedResponse returns the packed REFUSED response to dnsMsg, which the
+// seeder isn't authoritative for, so that resolvers don't wait for an answer
+// that never comes.
+func refusedResponse(dnsMsg *dns.Msg) ([]byte, error) {
+	respMsg := new(dns.Msg)
+	respMsg.SetRcode(dnsMsg, dns.RcodeRefused)
+	if dnsMsg.IsEdns0() != nil {
+		respMsg.SetEdns0(ednsUDPSize, false)
+	}
+	return respMsg.Pack()
+}
+
+// hasEDNS0Option returns whether opt carries an option of code.
+func hasEDNS0Option(opt *dns.OPT, code uint16) bool {
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// udpResponseSize returns the largest response to dnsMsg that may be sent
+// over UDP: the buffer size the client advertised with EDNS0, capped at
+// ednsUDPSize, or 512 bytes without EDNS0.
+func udpResponseSize(dnsMsg *dns.Msg) int {
+	opt := dnsMsg.IsEdns0()
+	if opt == nil {
+		return maxUDPResponseSize
+	}
+	size := int(opt.UDPSize())
+	if size < maxUDPResponseSize {
+		return maxUDPResponseSize
+	}
+	if size > ednsUDPSize {
+		return ednsUDPSize
 	}
+	return size
 }
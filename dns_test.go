@@ -0,0 +1,1079 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/dnsseeder/version"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/miekg/dns"
+)
+
+// fakeAddressBook serves a fixed list of good addresses. Calling any other
+// AddressBook method panics.
+type fakeAddressBook struct {
+	AddressBook
+	good       []*appmessage.NetAddress
+	lastUpdate time.Time
+}
+
+func (b *fakeAddressBook) LastUpdate() time.Time {
+	return b.lastUpdate
+}
+
+func (b *fakeAddressBook) AddressCount() int {
+	return len(b.good)
+}
+
+func (b *fakeAddressBook) GoodAddressCount() int {
+	return len(b.good)
+}
+
+func (b *fakeAddressBook) IsServed(ip net.IP) bool {
+	for _, addr := range b.good {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeAddressBook) GoodAddresses(qtype uint16, includeAllSubnetworks bool,
+	subnetworkID *externalapi.DomainSubnetworkID, defaultPortOnly bool) []*appmessage.NetAddress {
+
+	var addrs []*appmessage.NetAddress
+	for _, addr := range b.good {
+		if (qtype == dns.TypeA) == (addr.IP.To4() != nil) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// testNameservers are the nameservers of the zone served in tests.
+var testNameservers = []nameserver{{name: "ns.example.com."}}
+
+// newTestDNSServer returns a server for seed.example.com answering from book,
+// with the default configuration.
+func newTestDNSServer(t *testing.T, book AddressBook) *DNSServer {
+	useDefaultConfig(t)
+	return NewDNSServer("seed.example.com", testNameservers, nil, book, nil)
+}
+
+// queryDNS returns the response of server to a query of qtype for name.
+func queryDNS(t *testing.T, server *DNSServer, name string, qtype uint16) *dns.Msg {
+	return queryDNSMsg(t, server, name, qtype, false)
+}
+
+// queryDNSMsg returns the response of server to a query of qtype for name,
+// which asks for DNSSEC records if dnssecOK is set.
+func queryDNSMsg(t *testing.T, server *DNSServer, name string, qtype uint16, dnssecOK bool) *dns.Msg {
+	authority := server.nsRRs(server.hostname)
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	if dnssecOK {
+		query.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	b, err := server.buildDNSResponse(&net.UDPAddr{}, authority, query, true, nil, 0)
+	if err != nil {
+		t.Fatalf("buildDNSResponse: %v", err)
+	}
+	response := new(dns.Msg)
+	err = response.Unpack(b)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	return response
+}
+
+// addressOf returns the address of rr, an A or AAAA record, or nil if it
+// isn't one.
+func addressOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+func TestBuildDNSResponse(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::1"), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+
+	response := queryDNS(t, server, "seed.example.com.", dns.TypeA)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected 1 A answer but got %d", len(response.Answer))
+	}
+	if a, ok := response.Answer[0].(*dns.A); !ok || !a.A.Equal(book.good[0].IP) {
+		t.Errorf("expected an A record of %s but got %s", book.good[0].IP, response.Answer[0])
+	}
+	if ttl := response.Answer[0].Header().Ttl; ttl != uint32(defaultAnswerTTL/time.Second) {
+		t.Errorf("expected a TTL of %s but got %ds", defaultAnswerTTL, ttl)
+	}
+
+	activeConfig.AnswerTTL = 5 * time.Minute
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeA)
+	if ttl := response.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("expected a TTL of 300s but got %ds", ttl)
+	}
+
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeAAAA)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected 1 AAAA answer but got %d", len(response.Answer))
+	}
+	if aaaa, ok := response.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(book.good[1].IP) {
+		t.Errorf("expected an AAAA record of %s but got %s", book.good[1].IP, response.Answer[0])
+	}
+
+	// Without IPv6 nodes, AAAA queries get an empty answer with the SOA.
+	book.good = book.good[:1]
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeAAAA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Fatalf("expected an empty answer but got %d records with rcode %d", len(response.Answer), response.Rcode)
+	}
+	if len(response.Ns) != 1 || response.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected the SOA in the authority section but got %v", response.Ns)
+	}
+}
+
+func TestSOA(t *testing.T) {
+	book := &fakeAddressBook{lastUpdate: time.Unix(1600000000, 0)}
+	server := newTestDNSServer(t, book)
+
+	response := queryDNS(t, server, "seed.example.com.", dns.TypeSOA)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected 1 SOA answer but got %d", len(response.Answer))
+	}
+	soa, ok := response.Answer[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("expected an SOA record but got %s", response.Answer[0])
+	}
+	if soa.Serial != 1600000000 || soa.Ns != "ns.example.com." || soa.Mbox != "hostmaster.seed.example.com." ||
+		soa.Refresh != uint32(defaultSOARefresh/time.Second) || soa.Expire != uint32(defaultSOAExpire/time.Second) {
+
+		t.Errorf("unexpected SOA record %s", soa)
+	}
+
+	activeConfig.SOAMname = "ns1.example.com"
+	activeConfig.SOARname = mboxName("dns.admin@example.com")
+	book.lastUpdate = book.lastUpdate.Add(time.Minute)
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeSOA)
+	soa = response.Answer[0].(*dns.SOA)
+	if soa.Serial != 1600000060 || soa.Ns != "ns1.example.com." || soa.Mbox != `dns\.admin.example.com.` {
+		t.Errorf("unexpected SOA record %s", soa)
+	}
+
+	// Below the apex, SOA queries get an empty answer.
+	response = queryDNS(t, server, "n.seed.example.com.", dns.TypeSOA)
+	if len(response.Answer) != 0 {
+		t.Errorf("expected an empty answer but got %v", response.Answer)
+	}
+}
+
+func TestZones(t *testing.T) {
+	useDefaultConfig(t)
+	mainnet := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+	}}
+	testnet := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(5, 6, 7, 8).To4(), 16211),
+	}}
+	server := NewDNSServer("seed.example.com", testNameservers, nil, mainnet, nil)
+	server.AddZone(NewDNSServer("testnet-seed.example.com", testNameservers, nil, testnet, nil))
+
+	// Each zone only serves the glue of the nameservers within it.
+	nameservers := []nameserver{{name: "ns.seed.example.com.", glue: []net.IP{net.IPv4(192, 0, 2, 1)}}}
+	if rrs := NewDNSServer("seed.example.com", nameservers, nil, mainnet, nil).glueRRs(); len(rrs) != 1 {
+		t.Errorf("expected the glue of the nameserver within the zone but got %v", rrs)
+	}
+	if rrs := NewDNSServer("testnet-seed.example.com", nameservers, nil, testnet, nil).glueRRs(); len(rrs) != 0 {
+		t.Errorf("expected no glue for the nameserver outside the zone but got %v", rrs)
+	}
+
+	tests := []struct {
+		name     string
+		expected net.IP
+	}{
+		{"seed.example.com.", net.IPv4(1, 2, 3, 4)},
+		{"n.seed.example.com.", net.IPv4(1, 2, 3, 4)},
+		{"Testnet-Seed.example.com.", net.IPv4(5, 6, 7, 8)},
+		{"n.testnet-seed.example.com.", net.IPv4(5, 6, 7, 8)},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, dns.TypeA)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+		sendBytes, ok := server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+		if !ok {
+			t.Fatalf("%s: expected the query to be answered", test.name)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(sendBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if len(response.Answer) != 1 || !response.Answer[0].(*dns.A).A.Equal(test.expected) {
+			t.Errorf("%s: expected %s but got %v", test.name, test.expected, response.Answer)
+		}
+		if len(response.Ns) != 1 || !dns.IsSubDomain(response.Ns[0].Header().Name, strings.ToLower(test.name)) {
+			t.Errorf("%s: expected the NS records of the zone but got %v", test.name, response.Ns)
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("other.example.com.", dns.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	sendBytes, ok := server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+	if !ok {
+		t.Fatalf("expected a query outside of the zones to be answered")
+	}
+	response := new(dns.Msg)
+	err = response.Unpack(sendBytes)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if response.Rcode != dns.RcodeRefused {
+		t.Errorf("expected a query outside of the zones to be refused but got %s", response)
+	}
+}
+
+func TestNegativeResponses(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+
+	for _, name := range []string{"www.seed.example.com.", "nzz.seed.example.com.", "a.n.seed.example.com."} {
+		response := queryDNS(t, server, name, dns.TypeA)
+		if response.Rcode != dns.RcodeNameError || !response.Authoritative || len(response.Answer) != 0 {
+			t.Errorf("%s: expected an authoritative NXDOMAIN response but got %s", name, response)
+		}
+		if len(response.Ns) != 1 || response.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s: expected the SOA record in the authority section but got %v", name, response.Ns)
+		}
+	}
+
+	// Existing names without records of the queried type get an empty
+	// NOERROR answer.
+	response := queryDNS(t, server, "n.seed.example.com.", dns.TypeAAAA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 || len(response.Ns) != 1 {
+		t.Errorf("expected an empty NOERROR answer with the SOA record but got %s", response)
+	}
+
+	// Queries of types the zone has no records of at all are answered too,
+	// rather than left to time out.
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeCNAME, dns.TypePTR, dns.TypeCAA, 65} {
+		query := new(dns.Msg)
+		query.SetQuestion("seed.example.com.", qtype)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+		sendBytes, ok := server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+		if !ok {
+			t.Fatalf("type %d: expected the query to be answered", qtype)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(sendBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 || len(response.Ns) != 1 ||
+			response.Ns[0].Header().Rrtype != dns.TypeSOA {
+
+			t.Errorf("type %d: expected an empty NOERROR answer with the SOA record but got %s", qtype, response)
+		}
+
+		response = queryDNS(t, server, "www.seed.example.com.", qtype)
+		if response.Rcode != dns.RcodeNameError {
+			t.Errorf("type %d: expected NXDOMAIN but got %s", qtype, response)
+		}
+	}
+
+	for _, name := range []string{"example.com.", "seed.example.org.", "xseed.example.com."} {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+		sendBytes, ok := server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+		if !ok {
+			t.Fatalf("%s: expected the query to be answered", name)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(sendBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if response.Rcode != dns.RcodeRefused || response.Authoritative || len(response.Answer) != 0 ||
+			len(response.Ns) != 0 || response.IsEdns0() == nil {
+
+			t.Errorf("%s: expected an empty REFUSED response with an OPT record but got %s", name, response)
+		}
+	}
+}
+
+func TestAnyQueries(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+
+	response := queryDNS(t, server, "seed.example.com.", dns.TypeANY)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected a single answer but got %v", response.Answer)
+	}
+	hinfo, ok := response.Answer[0].(*dns.HINFO)
+	if !ok || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+		t.Errorf("expected an RFC 8482 HINFO record but got %s", response.Answer[0])
+	}
+
+	activeConfig.AnyQueries = anyQueriesRefuse
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeANY)
+	if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 || len(response.Ns) != 0 {
+		t.Errorf("expected an empty REFUSED response but got %s", response)
+	}
+
+	activeConfig.AnyQueries = anyQueriesDrop
+	query := new(dns.Msg)
+	query.SetQuestion("seed.example.com.", dns.TypeANY)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	_, ok = server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+	if ok {
+		t.Errorf("expected the ANY query to be dropped")
+	}
+}
+
+func TestStatsTXT(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::1"), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+
+	response := queryDNS(t, server, "seed.example.com.", dns.TypeTXT)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected 1 TXT answer but got %v", response.Answer)
+	}
+	txt, ok := response.Answer[0].(*dns.TXT)
+	if !ok {
+		t.Fatalf("expected a TXT record but got %s", response.Answer[0])
+	}
+	expected := []string{"good=2", "known=2", "updated=never", "version=" + version.Version()}
+	if !reflect.DeepEqual(txt.Txt, expected) {
+		t.Errorf("expected %v but got %v", expected, txt.Txt)
+	}
+
+	book.lastUpdate = time.Unix(1600000000, 0)
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeTXT)
+	if txt := response.Answer[0].(*dns.TXT); txt.Txt[2] != "updated=2020-09-13T12:26:40Z" {
+		t.Errorf("unexpected last update %s", txt.Txt[2])
+	}
+
+	// Below the apex, TXT queries get an empty answer.
+	response = queryDNS(t, server, "n.seed.example.com.", dns.TypeTXT)
+	if len(response.Answer) != 0 {
+		t.Errorf("expected an empty answer but got %v", response.Answer)
+	}
+}
+
+func TestSRV(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16222),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::1"), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+
+	for _, name := range []string{"_seed._tcp.seed.example.com.", "_seed._tcp.n.seed.example.com."} {
+		response := queryDNS(t, server, name, dns.TypeSRV)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 2 || len(response.Extra) != 2 {
+			t.Fatalf("%s: expected two SRV records with the addresses of their targets but got %s", name, response)
+		}
+		for i, expected := range []struct {
+			target string
+			port   uint16
+			ip     string
+		}{
+			{"node-01020304.seed.example.com.", 16222, "1.2.3.4"},
+			{"node-20010db8000000000000000000000001.seed.example.com.", 16111, "2001:db8::1"},
+		} {
+			srv, ok := response.Answer[i].(*dns.SRV)
+			if !ok || srv.Target != expected.target || srv.Port != expected.port {
+				t.Errorf("%s: expected SRV record %s:%d but got %s", name, expected.target, expected.port,
+					response.Answer[i])
+			}
+			if response.Extra[i].Header().Name != expected.target || !addressOf(response.Extra[i]).Equal(net.ParseIP(expected.ip)) {
+				t.Errorf("%s: expected the address %s of %s but got %s", name, expected.ip, expected.target,
+					response.Extra[i])
+			}
+		}
+	}
+
+	// The targets resolve to the addresses they hold.
+	response := queryDNS(t, server, "node-01020304.seed.example.com.", dns.TypeA)
+	if len(response.Answer) != 1 || !addressOf(response.Answer[0]).Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("expected the address of the target but got %s", response)
+	}
+	response = queryDNS(t, server, "node-01020304.seed.example.com.", dns.TypeAAAA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Errorf("expected an empty answer but got %s", response)
+	}
+	// Only the nodes served have names.
+	for _, name := range []string{"node-010203.seed.example.com.", "node-01020304.n.seed.example.com.",
+		"_seed._tcp.node-01020304.seed.example.com.", "node-05060708.seed.example.com.",
+		"node-00000000000000000000ffff01020304.seed.example.com."} {
+
+		response := queryDNS(t, server, name, dns.TypeA)
+		if response.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN but got %s", name, response)
+		}
+	}
+
+	// SRV names have no addresses, and names selecting nodes no SRV
+	// records.
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"_seed._tcp.seed.example.com.", dns.TypeA},
+		{"_tcp.seed.example.com.", dns.TypeSRV},
+		{"seed.example.com.", dns.TypeSRV},
+	} {
+		response := queryDNS(t, server, test.name, test.qtype)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+			t.Errorf("%s: expected an empty answer but got %s", test.name, response)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	server := newTestDNSServer(t, &fakeAddressBook{})
+	activeConfig.ChaosHostname = "seeder1"
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		query.Question[0].Qclass = dns.ClassCHAOS
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+		sendBytes, ok := server.answer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, server.nsRRs(server.hostname), b, true)
+		if !ok {
+			t.Fatalf("%s: expected the query to be answered", name)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(sendBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		return response
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"version.bind.", "dnsseeder " + version.Version()},
+		{"VERSION.SERVER.", "dnsseeder " + version.Version()},
+		{"hostname.bind.", "seeder1"},
+		{"id.server.", "seeder1"},
+	}
+	for _, test := range tests {
+		response := query(test.name, dns.TypeTXT)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+			t.Fatalf("%s: expected a single answer but got %s", test.name, response)
+		}
+		txt, ok := response.Answer[0].(*dns.TXT)
+		if !ok || txt.Hdr.Class != dns.ClassCHAOS || !reflect.DeepEqual(txt.Txt, []string{test.expected}) {
+			t.Errorf("%s: expected CH TXT %q but got %s", test.name, test.expected, response.Answer[0])
+		}
+	}
+
+	for _, name := range []string{"authors.bind.", "seed.example.com."} {
+		response := query(name, dns.TypeTXT)
+		if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+			t.Errorf("%s: expected a REFUSED response but got %s", name, response)
+		}
+	}
+	response := query("version.bind.", dns.TypeA)
+	if response.Rcode != dns.RcodeRefused {
+		t.Errorf("expected a non-TXT query to be refused but got %s", response)
+	}
+
+	activeConfig.ChaosVersion = "private"
+	response = query("version.bind.", dns.TypeTXT)
+	if len(response.Answer) != 1 || !reflect.DeepEqual(response.Answer[0].(*dns.TXT).Txt, []string{"private"}) {
+		t.Errorf("expected the configured version but got %s", response)
+	}
+
+	activeConfig.NoChaos = true
+	response = query("version.bind.", dns.TypeTXT)
+	if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+		t.Errorf("expected CHAOS queries to be refused when disabled but got %s", response)
+	}
+}
+
+func TestNameservers(t *testing.T) {
+	useDefaultConfig(t)
+	var nameservers []nameserver
+	for _, s := range []string{"ns1.seed.example.com=1.2.3.4,2001:db8::53", "ns2.example.org"} {
+		ns, err := parseNameserver(s)
+		if err != nil {
+			t.Fatalf("parseNameserver: %v", err)
+		}
+		nameservers = append(nameservers, ns)
+	}
+	_, err := parseNameserver("ns1.seed.example.com=1.2.3")
+	if err == nil {
+		t.Errorf("expected an invalid glue address to fail")
+	}
+
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(5, 6, 7, 8).To4(), 16111),
+	}}
+	server := NewDNSServer("seed.example.com", nameservers, nil, book, nil)
+
+	response := queryDNS(t, server, "seed.example.com.", dns.TypeNS)
+	if len(response.Answer) != 2 {
+		t.Fatalf("expected 2 NS records but got %v", response.Answer)
+	}
+	for i, rr := range response.Answer {
+		if ns, ok := rr.(*dns.NS); !ok || ns.Ns != nameservers[i].name {
+			t.Errorf("expected an NS record of %s but got %s", nameservers[i].name, rr)
+		}
+	}
+	if len(response.Extra) != 2 {
+		t.Errorf("expected 2 glue records but got %v", response.Extra)
+	}
+
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeA)
+	if len(response.Ns) != 2 {
+		t.Errorf("expected both NS records in the authority section but got %v", response.Ns)
+	}
+
+	// Nameservers within the zone are answered with their glue.
+	response = queryDNS(t, server, "ns1.seed.example.com.", dns.TypeA)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected 1 A answer but got %v", response.Answer)
+	}
+	if a, ok := response.Answer[0].(*dns.A); !ok || !a.A.Equal(nameservers[0].glue[0]) {
+		t.Errorf("expected the glue of ns1 but got %s", response.Answer[0])
+	}
+
+	// There are no NS records below the apex.
+	for _, name := range []string{"n.seed.example.com.", "ns1.seed.example.com.", "_seed._tcp.seed.example.com."} {
+		response := queryDNS(t, server, name, dns.TypeNS)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 || len(response.Extra) != 0 ||
+			len(response.Ns) != 1 || response.Ns[0].Header().Rrtype != dns.TypeSOA {
+
+			t.Errorf("%s: expected an empty answer with the SOA record but got %s", name, response)
+		}
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::1"), 16111),
+	}}
+	server := newTestDNSServer(t, book)
+	var err error
+	server.axfrAllow, err = newIPRangeList([]string{"192.0.2.0/24"}, "")
+	if err != nil {
+		t.Fatalf("newIPRangeList: %v", err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("seed.example.com.", dns.TypeAXFR)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	messages, ok := server.zoneTransfer(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 53)}, b)
+	if !ok {
+		t.Fatalf("expected the zone to be transferred to an allowed client")
+	}
+	var rrs []dns.RR
+	for _, message := range messages {
+		response := new(dns.Msg)
+		err := response.Unpack(message)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if response.Id != query.Id || response.Rcode != dns.RcodeSuccess {
+			t.Errorf("unexpected response header %s", response)
+		}
+		rrs = append(rrs, response.Answer...)
+	}
+	if len(rrs) != 5 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("expected the NS and address records between two SOA records but got %v", rrs)
+	}
+	for i, rrtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeAAAA} {
+		if rrs[i+1].Header().Rrtype != rrtype {
+			t.Errorf("expected a record of type %s but got %s", dns.TypeToString[rrtype], rrs[i+1])
+		}
+	}
+
+	// Other clients, and allowed ones over UDP, are refused.
+	for _, addr := range []net.Addr{&net.TCPAddr{IP: net.IPv4(198, 51, 100, 53)}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53)}} {
+		if _, ok := server.zoneTransfer(addr, b); ok {
+			t.Errorf("%s: expected the zone not to be transferred", addr)
+		}
+		sendBytes, ok := server.answer(addr, server.nsRRs(server.hostname), b, false)
+		if !ok {
+			t.Fatalf("%s: expected the AXFR query to be answered", addr)
+		}
+		response := new(dns.Msg)
+		err := response.Unpack(sendBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+			t.Errorf("%s: expected an empty REFUSED response but got %s", addr, response)
+		}
+	}
+
+	// Signed zones are transferred to no one.
+	server.signer = &dnssecSigner{zone: "seed.example.com."}
+	if _, ok := server.zoneTransfer(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 53)}, b); ok {
+		t.Errorf("expected the signed zone not to be transferred")
+	}
+}
+
+func TestQueryLimiter(t *testing.T) {
+	exempt, err := newIPRangeList([]string{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatalf("newIPRangeList: %v", err)
+	}
+	limiter := newQueryLimiter(2, 5, exempt)
+	now := time.Unix(1700000000, 0)
+	client := net.IPv4(1, 2, 3, 4)
+
+	for i := 0; i < 5; i++ {
+		if !limiter.allow(client, now) {
+			t.Fatalf("expected query %d of the burst to be allowed", i)
+		}
+	}
+	if limiter.allow(client, now) {
+		t.Errorf("expected the query after the burst to be limited")
+	}
+	if !limiter.allow(net.IPv4(1, 2, 3, 5), now) {
+		t.Errorf("expected other clients not to be limited")
+	}
+	if !limiter.allow(client, now.Add(500*time.Millisecond)) || limiter.allow(client, now.Add(500*time.Millisecond)) {
+		t.Errorf("expected a single query to be allowed after half a second")
+	}
+
+	// IPv6 clients share the bucket of their /64.
+	for i := 0; i < 5; i++ {
+		limiter.allow(net.ParseIP("2001:db8::1"), now)
+	}
+	if limiter.allow(net.ParseIP("2001:db8::2"), now) {
+		t.Errorf("expected clients in the same /64 to share a bucket")
+	}
+
+	for i := 0; i < 10; i++ {
+		if !limiter.allow(net.IPv4(10, 1, 2, 3), now) {
+			t.Fatalf("expected exempt clients never to be limited")
+		}
+	}
+
+	if newQueryLimiter(0, 5, exempt) != nil {
+		t.Errorf("expected a rate of 0 to disable the limiter")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	limiter := newConnLimiter(3, 2)
+	client := net.IPv4(1, 2, 3, 4)
+
+	if !limiter.acquire(client) || !limiter.acquire(client) {
+		t.Fatalf("expected the first connections of the client to be allowed")
+	}
+	if limiter.acquire(client) {
+		t.Errorf("expected connections beyond the per client maximum to be refused")
+	}
+	if !limiter.acquire(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected the connection of another client to be allowed")
+	}
+	if limiter.acquire(net.ParseIP("2001:db8:1::1")) {
+		t.Errorf("expected connections beyond the maximum to be refused")
+	}
+
+	limiter.release(client)
+	if !limiter.acquire(client) {
+		t.Errorf("expected a released connection to make room for another")
+	}
+	limiter.release(client)
+	limiter.release(client)
+	limiter.release(net.ParseIP("2001:db8::1"))
+	if limiter.total != 0 || len(limiter.clients) != 0 {
+		t.Errorf("expected no connections to be counted once all are released")
+	}
+}
+
+func TestDnstapWriter(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	writer := newDnstapWriter(socketPath, "seeder", "dnsseeder test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		writer.run(ctx)
+		close(done)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	controlType, err := readControlFrame(conn)
+	if err != nil || controlType != fstrmControlReady {
+		t.Fatalf("expected a ready frame but got %d: %v", controlType, err)
+	}
+	err = writeControlFrame(conn, fstrmControlAccept, dnstapContentType)
+	if err != nil {
+		t.Fatalf("writeControlFrame: %v", err)
+	}
+	controlType, err = readControlFrame(conn)
+	if err != nil || controlType != fstrmControlStart {
+		t.Fatalf("expected a start frame but got %d: %v", controlType, err)
+	}
+
+	query := []byte("query message")
+	writer.log(&dnstapEvent{client: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5353}, time: time.Now(), query: query})
+	var length [4]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err = io.ReadFull(conn, frame)
+	if err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.HasPrefix(frame, append([]byte{0x0a, 6}, "seeder"...)) {
+		t.Errorf("expected the frame to start with the identity but got %x", frame)
+	}
+	if !bytes.Contains(frame, query) || !bytes.Contains(frame, []byte{1, 2, 3, 4}) {
+		t.Errorf("expected the frame to hold the query and the client's address but got %x", frame)
+	}
+	if !bytes.HasSuffix(frame, []byte{15 << 3, dnstapTypeMessage}) {
+		t.Errorf("expected the frame to end with the message type but got %x", frame)
+	}
+
+	cancel()
+	controlType, err = readControlFrame(conn)
+	if err != nil || controlType != fstrmControlStop {
+		t.Fatalf("expected a stop frame but got %d: %v", controlType, err)
+	}
+	err = writeControlFrame(conn, fstrmControlFinish, "")
+	if err != nil {
+		t.Fatalf("writeControlFrame: %v", err)
+	}
+	<-done
+}
+
+func TestTruncation(t *testing.T) {
+	book := &fakeAddressBook{}
+	for i := 0; i < 100; i++ {
+		book.good = append(book.good, appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, byte(i)).To4(), 16111))
+	}
+	server := newTestDNSServer(t, book)
+	authority := server.nsRRs(server.hostname)
+	query := new(dns.Msg)
+	query.SetQuestion("seed.example.com.", dns.TypeA)
+
+	b, err := server.buildDNSResponse(&net.UDPAddr{}, authority, query, true, nil, maxUDPResponseSize)
+	if err != nil {
+		t.Fatalf("buildDNSResponse: %v", err)
+	}
+	if len(b) > maxUDPResponseSize {
+		t.Errorf("expected at most %d bytes but got %d", maxUDPResponseSize, len(b))
+	}
+	response := new(dns.Msg)
+	err = response.Unpack(b)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !response.Truncated {
+		t.Errorf("expected the TC bit to be set")
+	}
+
+	// Without a size limit, as over TCP, all addresses are sent.
+	response = queryDNS(t, server, "seed.example.com.", dns.TypeA)
+	if response.Truncated || len(response.Answer) != len(book.good) {
+		t.Errorf("expected %d records but got %d (truncated: %t)",
+			len(book.good), len(response.Answer), response.Truncated)
+	}
+}
+
+func TestEDNS0(t *testing.T) {
+	book := &fakeAddressBook{}
+	for i := 0; i < 100; i++ {
+		book.good = append(book.good, appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, byte(i)).To4(), 16111))
+	}
+	server := newTestDNSServer(t, book)
+	authority := server.nsRRs(server.hostname)
+
+	tests := []struct {
+		udpSize      uint16
+		expectedSize int
+	}{
+		{0, maxUDPResponseSize},
+		{256, maxUDPResponseSize},
+		{1024, 1024},
+		{4096, ednsUDPSize},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion("seed.example.com.", dns.TypeA)
+		if test.udpSize != 0 {
+			query.SetEdns0(test.udpSize, false)
+		}
+		size := udpResponseSize(query)
+		if size != test.expectedSize {
+			t.Errorf("%d: expected a response size of %d but got %d", test.udpSize, test.expectedSize, size)
+		}
+
+		b, err := server.buildDNSResponse(&net.UDPAddr{}, authority, query, true, nil, size)
+		if err != nil {
+			t.Fatalf("buildDNSResponse: %v", err)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(b)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if len(b) > size || len(b) < size-100 {
+			t.Errorf("%d: expected a response of about %d bytes but got %d", test.udpSize, size, len(b))
+		}
+
+		opt := response.IsEdns0()
+		if test.udpSize == 0 {
+			if opt != nil {
+				t.Errorf("expected no OPT record in the response to a query without one")
+			}
+		} else if opt == nil || opt.UDPSize() != ednsUDPSize {
+			t.Errorf("%d: expected an OPT record advertising %d bytes but got %v", test.udpSize, ednsUDPSize, opt)
+		}
+	}
+}
+
+func TestNSID(t *testing.T) {
+	server := newTestDNSServer(t, &fakeAddressBook{})
+	authority := server.nsRRs(server.hostname)
+
+	nsidOf := func(withNSID bool) (string, bool) {
+		query := new(dns.Msg)
+		query.SetQuestion("seed.example.com.", dns.TypeA)
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		if withNSID {
+			opt := query.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		b, err := server.buildDNSResponse(&net.UDPAddr{}, authority, query, true, nil, 0)
+		if err != nil {
+			t.Fatalf("buildDNSResponse: %v", err)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(b)
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		for _, option := range response.IsEdns0().Option {
+			if nsid, ok := option.(*dns.EDNS0_NSID); ok {
+				return nsid.Nsid, true
+			}
+		}
+		return "", false
+	}
+
+	if _, ok := nsidOf(true); ok {
+		t.Errorf("expected no NSID without a configured identifier")
+	}
+
+	activeConfig.NSID = "seeder-1"
+	nsid, ok := nsidOf(true)
+	if !ok || nsid != hex.EncodeToString([]byte("seeder-1")) {
+		t.Errorf("expected the NSID of seeder-1 but got %q", nsid)
+	}
+	if _, ok := nsidOf(false); ok {
+		t.Errorf("expected no NSID in the response to a query that didn't ask for it")
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	useDefaultConfig(t)
+	zsk := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "seed.example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyTTL},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := zsk.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	signer := &dnssecSigner{zone: "seed.example.com."}
+	signer.zsks = []dnssecKey{{dnskey: zsk, signer: privateKey.(crypto.Signer)}}
+	signer.ksks = signer.zsks
+
+	book := &fakeAddressBook{good: []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+	}}
+	server := NewDNSServer("seed.example.com", testNameservers, nil, book, signer)
+
+	// verifySets checks that every set of section is signed by zsk.
+	verifySets := func(section []dns.RR) {
+		sets := make(map[uint16][]dns.RR)
+		var sigs []*dns.RRSIG
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs = append(sigs, sig)
+				continue
+			}
+			sets[rr.Header().Rrtype] = append(sets[rr.Header().Rrtype], rr)
+		}
+		if len(sigs) != len(sets) {
+			t.Fatalf("expected %d signatures but got %d", len(sets), len(sigs))
+		}
+		for _, sig := range sigs {
+			err := sig.Verify(zsk, sets[sig.TypeCovered])
+			if err != nil {
+				t.Errorf("signature of the %s set doesn't verify: %v", dns.TypeToString[sig.TypeCovered], err)
+			}
+			if !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("signature of the %s set isn't currently valid", dns.TypeToString[sig.TypeCovered])
+			}
+		}
+	}
+
+	// Queries that don't ask for DNSSEC records aren't signed.
+	response := queryDNSMsg(t, server, "seed.example.com.", dns.TypeA, false)
+	if len(response.Answer) != 1 {
+		t.Fatalf("expected an unsigned answer but got %v", response.Answer)
+	}
+
+	response = queryDNSMsg(t, server, "seed.example.com.", dns.TypeA, true)
+	if len(response.Answer) != 2 {
+		t.Fatalf("expected a signed A record but got %v", response.Answer)
+	}
+	verifySets(response.Answer)
+	verifySets(response.Ns)
+
+	response = queryDNSMsg(t, server, "seed.example.com.", dns.TypeDNSKEY, true)
+	if len(response.Answer) != 2 || response.Answer[0].Header().Rrtype != dns.TypeDNSKEY {
+		t.Fatalf("expected a signed DNSKEY record but got %v", response.Answer)
+	}
+	verifySets(response.Answer)
+
+	// Empty answers are proven by a signed NSEC record that doesn't
+	// list the queried type.
+	response = queryDNSMsg(t, server, "seed.example.com.", dns.TypeAAAA, true)
+	if len(response.Answer) != 0 {
+		t.Fatalf("expected an empty answer but got %v", response.Answer)
+	}
+	verifySets(response.Ns)
+	var nsec *dns.NSEC
+	for _, rr := range response.Ns {
+		if rr, ok := rr.(*dns.NSEC); ok {
+			nsec = rr
+		}
+	}
+	if nsec == nil {
+		t.Fatalf("expected an NSEC record in the authority section but got %v", response.Ns)
+	}
+	for _, rtype := range nsec.TypeBitMap {
+		if rtype == dns.TypeAAAA {
+			t.Errorf("expected the NSEC record not to list AAAA but got %s", nsec)
+		}
+	}
+
+	// Names that don't exist are answered as if they only had an NSEC
+	// record.
+	response = queryDNSMsg(t, server, "www.seed.example.com.", dns.TypeA, true)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Fatalf("expected an empty NOERROR response but got %s", response)
+	}
+	verifySets(response.Ns)
+	nsec = nil
+	for _, rr := range response.Ns {
+		if rr, ok := rr.(*dns.NSEC); ok {
+			nsec = rr
+		}
+	}
+	if nsec == nil || !reflect.DeepEqual(nsec.TypeBitMap, []uint16{dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Errorf("expected an NSEC record listing only RRSIG and NSEC but got %v", response.Ns)
+	}
+}
+
+func TestExtractSubnetworkID(t *testing.T) {
+	server := newTestDNSServer(t, &fakeAddressBook{})
+	expected := &externalapi.DomainSubnetworkID{1, 2, 3}
+
+	tests := []struct {
+		name               string
+		expectedID         *externalapi.DomainSubnetworkID
+		expectedIncludeAll bool
+	}{
+		{"seed.example.com.", nil, true},
+		{"n.seed.example.com.", nil, false},
+		{"n" + expected.String() + ".seed.example.com.", expected, false},
+	}
+	for _, test := range tests {
+		subnetworkID, includeAll, err := server.extractSubnetworkID(&net.UDPAddr{}, test.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if includeAll != test.expectedIncludeAll || !subnetworkID.Equal(test.expectedID) {
+			t.Errorf("%s: expected subnetwork %v (all: %t) but got %v (all: %t)",
+				test.name, test.expectedID, test.expectedIncludeAll, subnetworkID, includeAll)
+		}
+	}
+
+	_, _, err := server.extractSubnetworkID(&net.UDPAddr{}, "nzz.seed.example.com.")
+	if err == nil {
+		t.Errorf("expected an invalid subnetwork ID to fail")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dnssecSignatureValidity is how long signatures are valid for. Since
+	// answers are signed when they are sent, it only needs to cover the
+	// time resolvers cache them for.
+	dnssecSignatureValidity = 48 * time.Hour
+
+	// dnssecInceptionSkew backdates the inception of signatures, so that
+	// resolvers whose clocks are behind accept them.
+	dnssecInceptionSkew = time.Hour
+
+	// dnskeyTTL is the TTL of the DNSKEY records.
+	dnskeyTTL = 3600
+)
+
+// dnssecKey is a DNSKEY along with its private key.
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// dnssecSigner signs the answers of the seeder's zone online. Key signing
+// keys sign the DNSKEY set and zone signing keys all other sets. If keys of
+// only one kind are loaded, they sign everything.
+type dnssecSigner struct {
+	zone string
+	ksks []dnssecKey
+	zsks []dnssecKey
+}
+
+// loadDNSSECKeys loads the key pairs whose file names, without the .key and
+// .private extensions written by dnssec-keygen, are given by prefixes, and
+// returns the signers of zones using them, keyed by zone. Zones without keys
+// have no signer.
+func loadDNSSECKeys(prefixes []string, zones []string) (map[string]*dnssecSigner, error) {
+	signers := make(map[string]*dnssecSigner)
+	for _, prefix := range prefixes {
+		key, err := loadDNSSECKey(prefix)
+		if err != nil {
+			return nil, err
+		}
+		var zone string
+		for _, z := range zones {
+			if strings.EqualFold(key.dnskey.Hdr.Name, dns.Fqdn(z)) {
+				zone = z
+				break
+			}
+		}
+		if zone == "" {
+			return nil, errors.Errorf("DNSSEC key %s is for %s rather than for any of %s",
+				prefix, key.dnskey.Hdr.Name, strings.Join(zones, ", "))
+		}
+		s, ok := signers[zone]
+		if !ok {
+			s = &dnssecSigner{zone: dns.Fqdn(strings.ToLower(zone))}
+			signers[zone] = s
+		}
+		if key.dnskey.Flags&dns.SEP != 0 {
+			s.ksks = append(s.ksks, key)
+			log.Infof("DS record to publish in the parent zone: %s", key.dnskey.ToDS(dns.SHA256))
+		} else {
+			s.zsks = append(s.zsks, key)
+		}
+	}
+	for _, s := range signers {
+		if len(s.ksks) == 0 {
+			s.ksks = s.zsks
+		}
+		if len(s.zsks) == 0 {
+			s.zsks = s.ksks
+		}
+	}
+	return signers, nil
+}
+
+func loadDNSSECKey(prefix string) (dnssecKey, error) {
+	publicPath, privatePath := prefix+".key", prefix+".private"
+	public, err := os.Open(publicPath)
+	if err != nil {
+		return dnssecKey{}, errors.Errorf("%s error opening file: %v", publicPath, err)
+	}
+	defer public.Close()
+	rr, err := dns.ReadRR(public, publicPath)
+	if err != nil {
+		return dnssecKey{}, errors.Errorf("error reading %s: %v", publicPath, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return dnssecKey{}, errors.Errorf("%s holds no DNSKEY record", publicPath)
+	}
+	dnskey.Hdr.Ttl = dnskeyTTL
+
+	private, err := os.Open(privatePath)
+	if err != nil {
+		return dnssecKey{}, errors.Errorf("%s error opening file: %v", privatePath, err)
+	}
+	defer private.Close()
+	privateKey, err := dnskey.ReadPrivateKey(private, privatePath)
+	if err != nil {
+		return dnssecKey{}, errors.Errorf("error reading %s: %v", privatePath, err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return dnssecKey{}, errors.Errorf("the key in %s cannot sign", privatePath)
+	}
+	return dnssecKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// dnskeys returns the DNSKEY set of the zone.
+func (s *dnssecSigner) dnskeys() []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[uint16]bool)
+	for _, key := range append(append([]dnssecKey(nil), s.ksks...), s.zsks...) {
+		if !seen[key.dnskey.KeyTag()] {
+			seen[key.dnskey.KeyTag()] = true
+			rrs = append(rrs, key.dnskey)
+		}
+	}
+	return rrs
+}
+
+// sign returns the signatures of rrset made at now.
+func (s *dnssecSigner) sign(rrset []dns.RR, now time.Time) ([]dns.RR, error) {
+	keys := s.zsks
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = s.ksks
+	}
+
+	sigs := make([]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		sig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   rrset[0].Header().Name,
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+				Ttl:    rrset[0].Header().Ttl,
+			},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: s.zone,
+			Algorithm:  key.dnskey.Algorithm,
+			Inception:  uint32(now.Add(-dnssecInceptionSkew).Unix()),
+			Expiration: uint32(now.Add(dnssecSignatureValidity).Unix()),
+		}
+		err := sig.Sign(key.signer, rrset)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// signSection returns section with the signatures of each of its sets
+// appended.
+func (s *dnssecSigner) signSection(section []dns.RR, now time.Time) ([]dns.RR, error) {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []setKey
+	sets := make(map[setKey][]dns.RR)
+	for _, rr := range section {
+		key := setKey{name: strings.ToLower(rr.Header().Name), rtype: rr.Header().Rrtype}
+		if _, exists := sets[key]; !exists {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	signed := section
+	for _, key := range order {
+		sigs, err := s.sign(sets[key], now)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, sigs...)
+	}
+	return signed, nil
+}
+
+// nsec returns an NSEC record proving that name has no record of qtype. The
+// next name is the immediate successor of name, so that it proves nothing
+// about any other name.
+func (s *dnssecSigner) nsec(name string, qtype uint16) dns.RR {
+	types := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}
+	switch lowerName := strings.ToLower(name); {
+	case lowerName == s.zone:
+		types = append(types, dns.TypeNS, dns.TypeSOA, dns.TypeTXT, dns.TypeDNSKEY)
+	case strings.HasPrefix(lowerName, srvLabels):
+		types = []uint16{dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}
+	case strings.HasPrefix(lowerName, "_tcp."):
+		types = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	}
+	bitmap := make([]uint16, 0, len(types))
+	for _, t := range types {
+		if t != qtype {
+			bitmap = append(bitmap, t)
+		}
+	}
+	return newNSEC(name, bitmap)
+}
+
+// newNSEC returns the NSEC record of name holding types, whose next name is
+// the immediate successor of name.
+func newNSEC(name string, types []uint16) dns.RR {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: negativeTTL},
+		NextDomain: `\000.` + name,
+		TypeBitMap: types,
+	}
+}
+
+// signResponse adds the NSEC record proving an empty answer, if the answer
+// is empty, and the signatures of all sets in the answer and authority
+// sections of msg. Names that don't exist are answered as names without any
+// records but their NSEC record, since proving that they don't exist would
+// take NSEC records of the names around them.
+func (s *dnssecSigner) signResponse(msg *dns.Msg, now time.Time) error {
+	if msg.Rcode == dns.RcodeNameError {
+		msg.Rcode = dns.RcodeSuccess
+		msg.Ns = append(msg.Ns, newNSEC(msg.Question[0].Name, []uint16{dns.TypeRRSIG, dns.TypeNSEC}))
+	} else if len(msg.Answer) == 0 {
+		question := msg.Question[0]
+		msg.Ns = append(msg.Ns, s.nsec(question.Name, question.Qtype))
+	}
+
+	var err error
+	msg.Answer, err = s.signSection(msg.Answer, now)
+	if err != nil {
+		return err
+	}
+	msg.Ns, err = s.signSection(msg.Ns, now)
+	return err
+}
+
+// dnssecRequested returns whether the query asks for DNSSEC records.
+func dnssecRequested(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	return opt != nil && opt.Do()
+}
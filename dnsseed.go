@@ -5,23 +5,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/kaspanet/kaspad/app/protocol/common"
 	"github.com/kaspanet/kaspad/infrastructure/config"
 	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/standalone"
 
 	"github.com/pkg/errors"
 
 	"github.com/kaspanet/dnsseeder/version"
-	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
 	"github.com/kaspanet/kaspad/util/panics"
 	"github.com/kaspanet/kaspad/util/profiling"
 
@@ -35,8 +36,11 @@ var (
 	amgr             *Manager
 	wg               sync.WaitGroup
 	peersDefaultPort int
-	systemShutdown   int32
 	defaultSeeder    *appmessage.NetAddress
+
+	// eventBus receives the results of crawling for any subsystem
+	// interested in them.
+	eventBus = NewEventBus()
 )
 
 // hostLookup returns the correct DNS lookup function to use depending on the
@@ -50,120 +54,304 @@ func hostLookup(host string) ([]net.IP, error) {
 	return net.LookupIP(host)
 }
 
-func creep() {
+// creep crawls network, or the active network if network is nil, for book
+// until ctx is canceled. The known peers are only added for the active
+// network.
+func creep(ctx context.Context, book AddressBook, network *seederNetwork) {
 	defer wg.Done()
 
-	netAdapter, err := standalone.NewMinimalNetAdapter(&config.Config{Flags: &config.Flags{NetworkFlags: ActiveConfig().NetworkFlags}})
+	netAdapter, err := standalone.NewMinimalNetAdapter(&config.Config{Flags: &config.Flags{NetworkFlags: network.networkFlags()}})
 	if err != nil {
 		panic(errors.Wrap(err, "Could not start net adapter"))
 	}
 
 	var knownPeers []*appmessage.NetAddress
 
-	if len(ActiveConfig().KnownPeers) != 0 {
+	if network == nil && len(ActiveConfig().KnownPeers) != 0 {
 
 		for _, p := range strings.Split(ActiveConfig().KnownPeers, ",") {
-			addressStr := strings.Split(p, ":")
-			if len(addressStr) != 2 {
-				log.Errorf("Invalid peer address: %s; addresses should be in format \"IP\":\"port\"", p)
+			host, portStr, err := net.SplitHostPort(p)
+			if err != nil {
+				log.Errorf("Invalid peer address: %s; addresses should be in format \"IP\":\"port\" "+
+					"or \"[IPv6]\":\"port\"", p)
 				return
 			}
 
-			ip := net.ParseIP(addressStr[0])
+			ip := net.ParseIP(host)
 			if ip == nil {
-				log.Errorf("Invalid peer IP address: %s", addressStr[0])
+				log.Errorf("Invalid peer IP address: %s", host)
 				return
 			}
-			port, err := strconv.Atoi(addressStr[1])
+			port, err := strconv.Atoi(portStr)
 			if err != nil {
-				log.Errorf("Invalid peer port: %s", addressStr[1])
+				log.Errorf("Invalid peer port: %s", portStr)
 				return
 			}
 
 			knownPeers = append(knownPeers, appmessage.NewNetAddressIPPort(ip, uint16(port)))
 		}
 
-		amgr.AddAddresses(knownPeers)
+		book.AddAddresses(knownPeers)
 		for _, peer := range knownPeers {
-			amgr.Good(peer.IP, nil)
-			amgr.Attempt(peer.IP)
+			book.Attempt(peer)
+			book.Good(peer, nil)
 		}
 	}
 
+	// Addresses are fed to a fixed number of workers so the number of
+	// concurrent dials stays bounded no matter how many addresses are known.
+	sessionCfg := sessionConfig{
+		dialTimeout:      ActiveConfig().DialTimeout,
+		handshakeTimeout: ActiveConfig().HandshakeTimeout,
+		getAddrTimeout:   ActiveConfig().GetAddrTimeout,
+		getAddrRounds:    ActiveConfig().GetAddrRounds,
+		getAddrInterval:  ActiveConfig().GetAddrInterval,
+		livenessProbe:    ActiveConfig().LivenessProbe,
+		halfOpen:         newHalfOpenLimiter(ActiveConfig().MaxHalfOpen),
+	}
+	limiter := newNetGroupLimiter(ActiveConfig().NetGroupDialInterval)
 	var wgCreep sync.WaitGroup
+	addrChan := make(chan *appmessage.NetAddress)
+	defer close(addrChan)
+	for i := 0; i < ActiveConfig().Threads; i++ {
+		spawn("creep-crawlWorker", func() {
+			crawlWorker(ctx, book, netAdapter, sessionCfg, limiter, addrChan, &wgCreep)
+		})
+	}
+
+	budget := newAttemptBudget(ActiveConfig().AttemptsPerMinute)
 	for {
-		peers := amgr.Addresses()
-		if len(peers) == 0 && amgr.AddressCount() == 0 {
-			// Add peers discovered through DNS to the address manager.
-			dnsseed.SeedFromDNS(ActiveConfig().NetParams(), "", true,
-				nil, hostLookup, func(addrs []*appmessage.NetAddress) {
-					amgr.AddAddresses(addrs)
-				})
-			peers = amgr.Addresses()
+		// When the number of good nodes collapses, e.g. after a network
+		// split or long downtime, re-seed and re-crawl recently good nodes
+		// quickly instead of waiting for the regular intervals.
+		recovering := book.GoodAddressCount() < ActiveConfig().BootstrapThreshold
+		crawlInterval := ActiveConfig().CrawlInterval
+		if recovering {
+			crawlInterval = recoveryRetryInterval
+		}
+
+		// Add peers discovered through DNS to the address manager. While
+		// recovering, don't query the seeds more than once per crawl
+		// interval, even across restarts.
+		if book.AddressCount() == 0 ||
+			(recovering && time.Since(book.LastBootstrap()) >= crawlInterval) {
+
+			bootstrap(book, network)
+			book.SetLastBootstrap(time.Now())
 		}
+
+		peers := book.Addresses(recovering)
 		if len(peers) == 0 {
-			log.Infof("No stale addresses -- sleeping for 10 minutes")
-			for i := 0; i < 600; i++ {
-				time.Sleep(time.Second)
-				if atomic.LoadInt32(&systemShutdown) != 0 {
+			log.Infof("No stale addresses -- sleeping for %s", crawlInterval)
+			select {
+			case <-time.After(crawlInterval):
+			case <-book.RetestRequested():
+			case <-ctx.Done():
+				log.Infof("Creep thread shutdown")
+				return
+			}
+			continue
+		}
+
+		// Addresses beyond the attempt budget are left for later cycles.
+		if allowed := budget.take(len(peers)); allowed < len(peers) {
+			log.Debugf("Attempt budget exhausted, deferring %d addresses", len(peers)-allowed)
+			peers = peers[:allowed]
+			if len(peers) == 0 {
+				select {
+				case <-time.After(budget.refillInterval()):
+				case <-ctx.Done():
 					log.Infof("Creep thread shutdown")
 					return
 				}
+				continue
 			}
-			continue
 		}
 
-		for _, addr := range peers {
-			if atomic.LoadInt32(&systemShutdown) != 0 {
-				log.Infof("Waiting creep threads to terminate")
-				wgCreep.Wait()
+		// Spread the dials over the jitter window instead of dialing all
+		// addresses in a burst.
+		offsets := crawlOffsets(len(peers), ActiveConfig().CrawlJitter)
+		if !feedAddresses(ctx, peers, offsets, addrChan, &wgCreep) {
+			log.Infof("Waiting creep threads to terminate")
+			wgCreep.Wait()
+			log.Infof("Creep thread shutdown")
+			return
+		}
+		wgCreep.Wait()
+
+		// When sampling, the stale addresses that were not picked are
+		// left for later cycles rather than crawled right away.
+		if ActiveConfig().CrawlSample > 0 {
+			select {
+			case <-time.After(crawlInterval):
+			case <-book.RetestRequested():
+			case <-ctx.Done():
 				log.Infof("Creep thread shutdown")
 				return
 			}
-			wgCreep.Add(1)
-			go func(addr *appmessage.NetAddress) {
-				defer wgCreep.Done()
-
-				err := pollPeer(netAdapter, addr)
-				if err != nil {
-					log.Warnf(err.Error())
-					if defaultSeeder != nil && addr == defaultSeeder {
-						panics.Exit(log, "failed to poll default seeder")
-					}
-				}
-			}(addr)
 		}
-		wgCreep.Wait()
 	}
 }
 
-func pollPeer(netAdapter *standalone.MinimalNetAdapter, addr *appmessage.NetAddress) error {
-	peerAddress := net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+// crawlOffsets returns count random offsets within [0, jitter), in ascending
+// order. All offsets are zero if jitter is zero.
+func crawlOffsets(count int, jitter time.Duration) []time.Duration {
+	offsets := make([]time.Duration, count)
+	if jitter <= 0 {
+		return offsets
+	}
+	for i := range offsets {
+		offsets[i] = time.Duration(rand.Int63n(int64(jitter)))
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// feedAddresses hands addrs to the crawl workers, each one no earlier than
+// its offset from now, and adds them to wgCreep. It returns false if ctx was
+// canceled before all addresses were handed over.
+func feedAddresses(ctx context.Context, addrs []*appmessage.NetAddress, offsets []time.Duration,
+	addrChan chan<- *appmessage.NetAddress, wgCreep *sync.WaitGroup) bool {
+
+	start := time.Now()
+	for i, addr := range addrs {
+		select {
+		case <-time.After(time.Until(start.Add(offsets[i]))):
+		case <-ctx.Done():
+			return false
+		}
 
-	routes, err := netAdapter.Connect(peerAddress)
-	if err != nil {
-		return errors.Wrapf(err, "could not connect to %s", peerAddress)
+		wgCreep.Add(1)
+		select {
+		case addrChan <- addr:
+		case <-ctx.Done():
+			wgCreep.Done()
+			return false
+		}
 	}
-	defer routes.Disconnect()
+	return true
+}
 
-	msgRequestAddresses := appmessage.NewMsgRequestAddresses(true, nil)
-	err = routes.OutgoingRoute.Enqueue(msgRequestAddresses)
-	if err != nil {
-		return errors.Wrapf(err, "failed to request addresses from %s", peerAddress)
+// crawlWorker polls every address received on addrChan until the channel is
+// closed. It marks each address as done on wgCreep once it has been polled.
+func crawlWorker(ctx context.Context, book AddressBook, netAdapter *standalone.MinimalNetAdapter,
+	sessionCfg sessionConfig, limiter *netGroupLimiter, addrChan <-chan *appmessage.NetAddress,
+	wgCreep *sync.WaitGroup) {
+
+	for addr := range addrChan {
+		if !limiter.wait(ctx, addr.IP) {
+			wgCreep.Done()
+			continue
+		}
+		err := pollPeer(ctx, book, netAdapter, sessionCfg, addr)
+		if err != nil && ctx.Err() == nil {
+			log.Warnf(err.Error())
+			if defaultSeeder != nil && nodeKey(addr) == nodeKey(defaultSeeder) {
+				panics.Exit(log, "failed to poll default seeder")
+			}
+		}
+		wgCreep.Done()
 	}
+}
+
+func pollPeer(ctx context.Context, book AddressBook, netAdapter *standalone.MinimalNetAdapter,
+	sessionCfg sessionConfig, addr *appmessage.NetAddress) error {
+
+	session := newPeerSession(addr, sessionCfg)
+	defer session.close()
 
-	message, err := routes.WaitForMessageOfType(appmessage.CmdAddresses, common.DefaultTimeout)
+	book.Attempt(addr)
+	err := session.connect(ctx, netAdapter)
+	if session.dialed {
+		detail := ""
+		if err != nil {
+			detail = err.Error()
+		}
+		eventBus.Publish(EventHandshake, addr, detail)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to receive addresses from %s", peerAddress)
+		// Failures caused by shutting down say nothing about the peer.
+		if ctx.Err() != nil {
+			return err
+		}
+		if session.dialed {
+			book.BadHandshake(addr, session.failure)
+		} else {
+			book.Bad(addr, session.failure)
+		}
+		eventBus.Publish(EventNodeBad, addr, err.Error())
+		return err
+	}
+
+	// Peers only return a random subset of their known addresses per
+	// request, so several rounds may be needed to learn most of them.
+	var received, added int
+	for round := 0; round < sessionCfg.getAddrRounds; round++ {
+		if round > 0 {
+			select {
+			case <-time.After(sessionCfg.getAddrInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		addresses, err := session.requestAddresses()
+		if err != nil {
+			if round == 0 {
+				if ctx.Err() == nil {
+					book.Bad(addr, session.failure)
+					eventBus.Publish(EventNodeBad, addr, err.Error())
+				}
+				return err
+			}
+			// The peer already answered at least once, so it is still
+			// considered good.
+			log.Debugf("%s", err)
+			break
+		}
+
+		if len(addresses) > appmessage.MaxAddressesPerMsg {
+			book.Ban(addr.IP, "sent too many addresses")
+			err := errors.Errorf("peer %s sent %d addresses, more than the allowed %d",
+				session.peerAddress, len(addresses), appmessage.MaxAddressesPerMsg)
+			eventBus.Publish(EventNodeBad, addr, err.Error())
+			return err
+		}
+
+		newAddresses := book.AddAddressesFromPeer(addr, addresses)
+		for _, newAddress := range newAddresses {
+			eventBus.Publish(EventNodeDiscovered, newAddress, session.peerAddress)
+		}
+		if book.IsBanned(addr.IP) {
+			err := errors.Errorf("peer %s advertised mostly unusable addresses", session.peerAddress)
+			eventBus.Publish(EventNodeBad, addr, err.Error())
+			return err
+		}
+		received += len(addresses)
+		added += len(newAddresses)
 	}
-	msgAddresses := message.(*appmessage.MsgAddresses)
 
-	added := amgr.AddAddresses(msgAddresses.AddressList)
 	log.Infof("Peer %s sent %d addresses, %d new",
-		peerAddress, len(msgAddresses.AddressList), added)
+		session.peerAddress, received, added)
+
+	// Some hosts complete the handshake but do not process any further
+	// messages, so optionally make sure the peer is actually responsive.
+	var pingLatency time.Duration
+	if sessionCfg.livenessProbe {
+		pingLatency, err = session.ping()
+		if err != nil {
+			if ctx.Err() == nil {
+				book.Bad(addr, session.failure)
+				eventBus.Publish(EventNodeBad, addr, err.Error())
+			}
+			return err
+		}
+		log.Debugf("Peer %s answered ping in %s", session.peerAddress, pingLatency)
+	}
 
-	amgr.Attempt(addr.IP)
-	amgr.Good(addr.IP, nil)
+	book.Good(addr, nil)
+	book.RecordLatency(addr, session.dialLatency, session.handshakeLatency, pingLatency)
+	eventBus.Publish(EventNodeGood, addr, "")
 
 	return nil
 }
@@ -186,18 +374,74 @@ func main() {
 		profiling.Start(cfg.Profile, log)
 	}
 
-	amgr, err = NewManager(defaultHomeDir)
+	// ctx is canceled when the seeder shuts down, which stops the crawler,
+	// the DNS server and the address manager.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	zoneNames := []string{cfg.Host}
+	for _, zone := range cfg.zones {
+		zoneNames = append(zoneNames, zone.hostname)
+	}
+	signers, err := loadDNSSECKeys(cfg.DNSSECKeys, zoneNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the DNSSEC keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	amgr, err = NewManager(ctx, defaultHomeDir, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "NewManager: %v\n", err)
 		os.Exit(1)
 	}
 
+	// The networks of the other zones are crawled by address managers of
+	// their own, which keep their state apart from the active network's.
+	zoneManagers := make([]*Manager, len(cfg.zones))
+	for i, zone := range cfg.zones {
+		dataDir := filepath.Join(defaultHomeDir, zone.network.name())
+		if !cfg.Ephemeral {
+			err = os.MkdirAll(dataDir, 0700)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create the data directory of %s: %v\n", zone.hostname, err)
+				os.Exit(1)
+			}
+		}
+		zoneManagers[i], err = NewManager(ctx, dataDir, zone.network)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NewManager of %s: %v\n", zone.hostname, err)
+			os.Exit(1)
+		}
+	}
+
+	// Shut down gracefully on every return from here on. The address
+	// managers save their state as soon as ctx is canceled, without
+	// waiting for crawls in progress.
+	defer func() {
+		log.Infof("Gracefully shutting down the seeder...")
+		cancel()
+		wg.Wait()
+		amgr.wg.Wait()
+		for _, zoneManager := range zoneManagers {
+			zoneManager.wg.Wait()
+		}
+		log.Infof("Seeder shutdown complete")
+	}()
+
 	peersDefaultPort, err = strconv.Atoi(ActiveConfig().NetParams().DefaultPort)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid peers default port %s: %v\n", ActiveConfig().NetParams().DefaultPort, err)
 		os.Exit(1)
 	}
 
+	if cfg.ImportDump != "" {
+		err = importSeederDump(cfg.ImportDump)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import the seeder dump: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if len(cfg.Seeder) != 0 {
 		ip := net.ParseIP(cfg.Seeder)
 		if ip == nil {
@@ -217,12 +461,21 @@ func main() {
 		}
 	}
 
+	startSignalListener(ctx)
+
 	wg.Add(1)
-	spawn("main-creep", creep)
+	spawn("main-creep", func() { creep(ctx, amgr, nil) })
+
+	dnsServer := NewDNSServer(cfg.Host, cfg.nameservers, cfg.listenEndpoints, amgr, signers[cfg.Host])
+	for i, zone := range cfg.zones {
+		zone, zoneManager := zone, zoneManagers[i]
+		wg.Add(1)
+		spawn("main-creep", func() { creep(ctx, zoneManager, zone.network) })
 
-	dnsServer := NewDNSServer(cfg.Host, cfg.Nameserver, cfg.Listen)
+		dnsServer.AddZone(NewDNSServer(zone.hostname, cfg.nameservers, nil, zoneManager, signers[zone.hostname]))
+	}
 	wg.Add(1)
-	spawn("main-DNSServer.Start", dnsServer.Start)
+	spawn("main-DNSServer.Start", func() { dnsServer.Start(ctx) })
 
 	grpcServer := NewGRPCServer(amgr)
 	err = grpcServer.Start(cfg.GRPCListen)
@@ -231,15 +484,6 @@ func main() {
 		return
 	}
 
-	defer func() {
-		log.Infof("Gracefully shutting down the seeder...")
-		atomic.StoreInt32(&systemShutdown, 1)
-		close(amgr.quit)
-		wg.Wait()
-		amgr.wg.Wait()
-		log.Infof("Seeder shutdown complete")
-	}()
-
 	// Wait until the interrupt signal is received from an OS signal or
 	// shutdown is requested through one of the subsystems such as the RPC
 	// server.
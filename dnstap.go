@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dnstapContentType is the Frame Streams content type of dnstap data frames.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types, and the content type control field.
+const (
+	fstrmControlAccept = 1
+	fstrmControlStart  = 2
+	fstrmControlStop   = 3
+	fstrmControlReady  = 4
+	fstrmControlFinish = 5
+
+	fstrmFieldContentType = 1
+
+	// fstrmMaxControlFrameSize bounds the control frames accepted from
+	// the reader.
+	fstrmMaxControlFrameSize = 512
+)
+
+// Values of the enums of dnstap.proto used by the seeder.
+const (
+	dnstapTypeMessage = 1
+
+	dnstapMessageAuthQuery    = 1
+	dnstapMessageAuthResponse = 2
+
+	dnstapSocketFamilyInet  = 1
+	dnstapSocketFamilyInet6 = 2
+
+	dnstapSocketProtocolUDP = 1
+	dnstapSocketProtocolTCP = 2
+)
+
+const (
+	// dnstapQueueSize is the number of frames buffered for the dnstap
+	// reader. Frames are dropped when it is full, so that a slow reader
+	// never delays answers.
+	dnstapQueueSize = 1024
+
+	// dnstapReconnectInterval is how long to wait before connecting to
+	// the dnstap socket again after failing to.
+	dnstapReconnectInterval = 5 * time.Second
+
+	// dnstapTimeout bounds the handshake and every write to the socket.
+	dnstapTimeout = 5 * time.Second
+)
+
+// protoBuffer encodes protocol buffer messages field by field, which is all
+// dnstap needs.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	*b = append(*b, buf[:n]...)
+}
+
+func (b *protoBuffer) key(field, wireType uint64) {
+	b.varint(field<<3 | wireType)
+}
+
+func (b *protoBuffer) uint(field, v uint64) {
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytes(field uint64, v []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) fixed32(field uint64, v uint32) {
+	b.key(field, 5)
+	*b = append(*b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// dnstapEvent is a query or a response to log to dnstap.
+type dnstapEvent struct {
+	isResponse bool
+	client     net.Addr
+	tcp        bool
+	time       time.Time
+
+	// query is the query message, and response the response message if
+	// the event is a response.
+	query    []byte
+	response []byte
+}
+
+// encodeDnstap returns the Dnstap protocol buffer of event, with identity and
+// version identifying the server.
+func encodeDnstap(event *dnstapEvent, identity, version string) []byte {
+	var message protoBuffer
+	messageType := uint64(dnstapMessageAuthQuery)
+	if event.isResponse {
+		messageType = dnstapMessageAuthResponse
+	}
+	message.uint(1, messageType)
+
+	var ip net.IP
+	var port int
+	switch addr := event.client.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		message.uint(2, dnstapSocketFamilyInet)
+		ip = ip4
+	} else if ip != nil {
+		message.uint(2, dnstapSocketFamilyInet6)
+	}
+	protocol := uint64(dnstapSocketProtocolUDP)
+	if event.tcp {
+		protocol = dnstapSocketProtocolTCP
+	}
+	message.uint(3, protocol)
+	if ip != nil {
+		message.bytes(4, ip)
+		message.uint(6, uint64(port))
+	}
+
+	if event.isResponse {
+		message.bytes(10, event.query)
+		message.uint(12, uint64(event.time.Unix()))
+		message.fixed32(13, uint32(event.time.Nanosecond()))
+		message.bytes(14, event.response)
+	} else {
+		message.uint(8, uint64(event.time.Unix()))
+		message.fixed32(9, uint32(event.time.Nanosecond()))
+		message.bytes(10, event.query)
+	}
+
+	var frame protoBuffer
+	frame.bytes(1, []byte(identity))
+	frame.bytes(2, []byte(version))
+	frame.bytes(14, message)
+	frame.uint(15, dnstapTypeMessage)
+	return frame
+}
+
+// appendUint32 appends the big-endian encoding of v to b.
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// writeControlFrame writes a Frame Streams control frame of controlType,
+// with a content type field unless it is empty.
+func writeControlFrame(w io.Writer, controlType uint32, contentType string) error {
+	payload := appendUint32(nil, controlType)
+	if contentType != "" {
+		payload = appendUint32(payload, fstrmFieldContentType)
+		payload = appendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	frame := appendUint32(nil, 0)
+	frame = appendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readControlFrame reads a Frame Streams control frame and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errors.New("expected a control frame but got a data frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > fstrmMaxControlFrameSize {
+		return 0, errors.Errorf("invalid control frame length %d", length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// dnstapWriter sends dnstap frames to the Frame Streams reader listening on
+// a Unix socket, such as the dnstap command, reconnecting whenever the
+// connection is lost. Frames that can't be sent right away are dropped.
+type dnstapWriter struct {
+	socketPath string
+	identity   string
+	version    string
+	frames     chan []byte
+}
+
+func newDnstapWriter(socketPath, identity, version string) *dnstapWriter {
+	return &dnstapWriter{
+		socketPath: socketPath,
+		identity:   identity,
+		version:    version,
+		frames:     make(chan []byte, dnstapQueueSize),
+	}
+}
+
+// log queues event to be sent, unless the queue is full. It is a no-op on a
+// nil writer.
+func (w *dnstapWriter) log(event *dnstapEvent) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.frames <- encodeDnstap(event, w.identity, w.version):
+	default:
+	}
+}
+
+// run sends the queued frames until ctx is canceled.
+func (w *dnstapWriter) run(ctx context.Context) {
+	defer wg.Done()
+
+	for ctx.Err() == nil {
+		err := w.session(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warnf("dnstap: %v", err)
+		}
+		select {
+		case <-time.After(dnstapReconnectInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// session connects to the socket, performs the Frame Streams handshake and
+// writes frames until the connection fails or ctx is canceled, in which case
+// it ends the stream.
+func (w *dnstapWriter) session(ctx context.Context) error {
+	conn, err := net.DialTimeout("unix", w.socketPath, dnstapTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(dnstapTimeout))
+	if err != nil {
+		return err
+	}
+	err = writeControlFrame(conn, fstrmControlReady, dnstapContentType)
+	if err != nil {
+		return err
+	}
+	controlType, err := readControlFrame(conn)
+	if err != nil {
+		return err
+	}
+	if controlType != fstrmControlAccept {
+		return errors.Errorf("expected an accept frame but got control frame %d", controlType)
+	}
+	err = writeControlFrame(conn, fstrmControlStart, dnstapContentType)
+	if err != nil {
+		return err
+	}
+	log.Infof("dnstap: connected to %s", w.socketPath)
+
+	bw := bufio.NewWriter(conn)
+	for {
+		select {
+		case frame := <-w.frames:
+			err := conn.SetDeadline(time.Now().Add(dnstapTimeout))
+			if err != nil {
+				return err
+			}
+			_, err = bw.Write(appendUint32(nil, uint32(len(frame))))
+			if err != nil {
+				return err
+			}
+			_, err = bw.Write(frame)
+			if err != nil {
+				return err
+			}
+			// Write out the frames as soon as no more are waiting.
+			if len(w.frames) == 0 {
+				err = bw.Flush()
+				if err != nil {
+					return err
+				}
+			}
+		case <-ctx.Done():
+			err := conn.SetDeadline(time.Now().Add(dnstapTimeout))
+			if err != nil {
+				return err
+			}
+			err = bw.Flush()
+			if err != nil {
+				return err
+			}
+			err = writeControlFrame(conn, fstrmControlStop, "")
+			if err != nil {
+				return err
+			}
+			controlType, err := readControlFrame(conn)
+			if err != nil {
+				return err
+			}
+			if controlType != fstrmControlFinish {
+				return errors.Errorf("expected a finish frame but got control frame %d", controlType)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// EventType identifies the kind of a crawl Event
+type EventType int
+
+const (
+	// EventNodeDiscovered is published when a previously unknown address
+	// is learned from a peer.
+	EventNodeDiscovered EventType = iota
+
+	// EventHandshake is published after every handshake attempt. Its
+	// Detail holds the error if the handshake failed.
+	EventHandshake
+
+	// EventNodeGood is published when a node was successfully crawled.
+	EventNodeGood
+
+	// EventNodeBad is published when crawling a node failed. Its Detail
+	// holds the reason.
+	EventNodeBad
+)
+
+var eventTypeStrings = map[EventType]string{
+	EventNodeDiscovered: "NodeDiscovered",
+	EventHandshake:      "Handshake",
+	EventNodeGood:       "NodeGood",
+	EventNodeBad:        "NodeBad",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventTypeStrings[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Event describes something that happened to a node while crawling
+type Event struct {
+	Type   EventType
+	Addr   *appmessage.NetAddress
+	Time   time.Time
+	Detail string
+}
+
+// EventBus distributes crawl events to any number of subscribers
+type EventBus struct {
+	mtx         sync.RWMutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventBus returns a new EventBus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel on which all events published from now on are
+// delivered, and a function that cancels the subscription. Events are dropped
+// for subscribers that let more than bufferSize events pile up, so a slow
+// subscriber can never block the crawler.
+func (b *EventBus) Subscribe(bufferSize int) (<-chan Event, func()) {
+	ch := make(chan Event, bufferSize)
+
+	b.mtx.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mtx.Unlock()
+
+	unsubscribe := func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// Publish delivers an event of the given type to all subscribers
+func (b *EventBus) Publish(eventType EventType, addr *appmessage.NetAddress, detail string) {
+	event := Event{
+		Type:   eventType,
+		Addr:   addr,
+		Time:   time.Now(),
+		Detail: detail,
+	}
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Debugf("Dropped %s event for %s: subscriber is full", eventType, addr.IP)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// exportFormatCSV and exportFormatJSON are the supported formats of
+	// node exports.
+	exportFormatCSV  = "csv"
+	exportFormatJSON = "json"
+)
+
+// Node states as reported by exports.
+const (
+	nodeStateGood     = "good"
+	nodeStateFailing  = "failing"
+	nodeStateUntested = "untested"
+	nodeStateTested   = "tested"
+)
+
+// NodeExport is the state of a single node as written by exports.
+type NodeExport struct {
+	Address          string
+	Port             uint16
+	State            string
+	Tried            bool
+	SubnetworkID     string
+	ASN              uint32
+	ASOrg            string
+	Country          string
+	Continent        string
+	LastSeen         time.Time
+	LastAttempt      time.Time
+	LastSuccess      time.Time
+	Failures         int
+	LastFailure      FailureReason
+	Quality          float64
+	Reliability2H    float64
+	Reliability8H    float64
+	Reliability1D    float64
+	Reliability1W    float64
+	DialLatency      time.Duration
+	HandshakeLatency time.Duration
+	PingLatency      time.Duration
+}
+
+// exportCSVHeader is the header row of CSV exports, in the order of the
+// fields of NodeExport.
+var exportCSVHeader = []string{
+	"address", "port", "state", "tried", "subnetwork_id", "asn", "as_org", "country", "continent",
+	"last_seen", "last_attempt", "last_success", "failures", "last_failure", "quality",
+	"reliability_2h", "reliability_8h", "reliability_1d", "reliability_1w",
+	"dial_latency_ms", "handshake_latency_ms", "ping_latency_ms",
+}
+
+// state returns the state of the node as reported by exports.
+func (n *Node) state(criteria servingCriteria) string {
+	switch {
+	case n.isServable(criteria):
+		return nodeStateGood
+	case n.LastAttempt.IsZero():
+		return nodeStateUntested
+	case n.LastAttempt.After(n.LastSuccess):
+		return nodeStateFailing
+	default:
+		return nodeStateTested
+	}
+}
+
+// ExportNodes returns the state of all known nodes, ordered by address.
+func (m *Manager) ExportNodes() []NodeExport {
+	criteria := m.activeServingCriteria()
+
+	m.mtx.RLock()
+	exports := make([]NodeExport, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		export := NodeExport{
+			Address:          node.Addr.IP.String(),
+			Port:             node.Addr.Port,
+			State:            node.state(criteria),
+			Tried:            node.tried,
+			SubnetworkID:     subnetworkKey(node.SubnetworkID),
+			ASN:              node.ASN,
+			ASOrg:            node.ASOrg,
+			Country:          node.Country,
+			Continent:        node.Continent,
+			LastSeen:         node.LastSeen,
+			LastAttempt:      node.LastAttempt,
+			LastSuccess:      node.LastSuccess,
+			Failures:         node.Failures,
+			LastFailure:      node.LastFailure,
+			Quality:          node.Quality,
+			Reliability2H:    node.Reliability.Stat2H.Reliability,
+			Reliability8H:    node.Reliability.Stat8H.Reliability,
+			Reliability1D:    node.Reliability.Stat1D.Reliability,
+			Reliability1W:    node.Reliability.Stat1W.Reliability,
+			DialLatency:      node.DialLatency,
+			HandshakeLatency: node.HandshakeLatency,
+			PingLatency:      node.PingLatency,
+		}
+		exports = append(exports, export)
+	}
+	m.mtx.RUnlock()
+
+	sort.Slice(exports, func(i, j int) bool {
+		if exports[i].Address != exports[j].Address {
+			return exports[i].Address < exports[j].Address
+		}
+		return exports[i].Port < exports[j].Port
+	})
+	return exports
+}
+
+// writeNodeExports writes exports to w in the given format.
+func writeNodeExports(w io.Writer, exports []NodeExport, format string) error {
+	switch format {
+	case exportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exports)
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(exportCSVHeader)
+		if err != nil {
+			return err
+		}
+		for _, e := range exports {
+			err := cw.Write([]string{
+				e.Address, strconv.Itoa(int(e.Port)), e.State, strconv.FormatBool(e.Tried), e.SubnetworkID,
+				strconv.FormatUint(uint64(e.ASN), 10), e.ASOrg, e.Country, e.Continent,
+				formatExportTime(e.LastSeen), formatExportTime(e.LastAttempt), formatExportTime(e.LastSuccess),
+				strconv.Itoa(e.Failures), string(e.LastFailure), formatExportFloat(e.Quality),
+				formatExportFloat(e.Reliability2H), formatExportFloat(e.Reliability8H),
+				formatExportFloat(e.Reliability1D), formatExportFloat(e.Reliability1W),
+				strconv.FormatInt(e.DialLatency.Milliseconds(), 10),
+				strconv.FormatInt(e.HandshakeLatency.Milliseconds(), 10),
+				strconv.FormatInt(e.PingLatency.Milliseconds(), 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return errors.Errorf("unknown export format %s", format)
+	}
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatExportFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// exportNodesToFile writes all known nodes to the configured export file,
+// replacing it atomically.
+func exportNodesToFile() {
+	format := ActiveConfig().ExportFormat
+	filePath := ActiveConfig().ExportFile
+	if filePath == "" {
+		var ok bool
+		filePath, ok = homeDirFile("export." + format)
+		if !ok {
+			return
+		}
+	}
+
+	exports := amgr.ExportNodes()
+	err := writeFileAtomically(filePath, func(w io.Writer) error {
+		return writeNodeExports(w, exports, format)
+	})
+	if err != nil {
+		log.Errorf("Failed to export nodes to %s: %v", filePath, err)
+		return
+	}
+	log.Infof("Exported %d nodes to %s", len(exports), filePath)
+}
+
+// homeDirFile returns the path of the file called name in the home directory,
+// or false if the seeder is ephemeral and writes nothing there.
+func homeDirFile(name string) (string, bool) {
+	if ActiveConfig().Ephemeral {
+		log.Infof("Not writing %s to the home directory of an ephemeral seeder", name)
+		return "", false
+	}
+	return filepath.Join(defaultHomeDir, name), true
+}
+
+// writeFileAtomically calls write with a temporary file, and replaces the file
+// at filePath with it once write succeeded.
+func writeFileAtomically(filePath string, write func(w io.Writer) error) error {
+	tmpfile := filePath + ".new"
+	w, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	err = write(w)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return os.Rename(tmpfile, filePath)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/router"
+	"github.com/pkg/errors"
+)
+
+// FailureReason categorizes why a connection attempt to a node failed
+type FailureReason string
+
+const (
+	// FailureRefused means the node actively refused the TCP connection.
+	FailureRefused FailureReason = "refused"
+
+	// FailureUnreachable means the TCP connection could not be established
+	// for any other reason than it being refused or timing out.
+	FailureUnreachable FailureReason = "unreachable"
+
+	// FailureTimeout means the node did not respond in time, either to the
+	// TCP connection, the handshake or a request.
+	FailureTimeout FailureReason = "timeout"
+
+	// FailureHandshake means the node accepted the TCP connection but the
+	// handshake with it failed.
+	FailureHandshake FailureReason = "handshake-failed"
+
+	// FailureProtocol means the node completed the handshake but then did
+	// not respond to requests as expected.
+	FailureProtocol FailureReason = "protocol-mismatch"
+)
+
+// dialFailureReason returns the FailureReason of a failed TCP dial.
+func dialFailureReason(err error) FailureReason {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return FailureRefused
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+	return FailureUnreachable
+}
+
+// requestFailureReason returns the FailureReason of a failed request sent to
+// a node after the handshake.
+func requestFailureReason(err error) FailureReason {
+	if errors.Is(err, router.ErrTimeout) {
+		return FailureTimeout
+	}
+	return FailureProtocol
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// managerGauges are counters of the state of the address book that are
+// updated atomically, so that they can be read without the manager lock.
+type managerGauges struct {
+	known    int64
+	good     int64
+	banned   int64
+	inFlight int64
+}
+
+// Gauges is a point in time reading of the manager's gauges.
+type Gauges struct {
+	// Known is the number of nodes in the address book.
+	Known int64
+
+	// Good is the number of nodes good enough to be served, as of the
+	// latest snapshot of the address book or the latest pruning, whichever
+	// is more recent.
+	Good int64
+
+	// Banned is the number of banned IP addresses, including expired bans
+	// that were not lifted yet.
+	Banned int64
+
+	// InFlight is the number of connection attempts in progress.
+	InFlight int64
+}
+
+// Gauges returns the current values of the manager's gauges. It does not
+// take the manager lock, so it is cheap enough to be scraped often.
+func (m *Manager) Gauges() Gauges {
+	return Gauges{
+		Known:    atomic.LoadInt64(&m.gauges.known),
+		Good:     atomic.LoadInt64(&m.gauges.good),
+		Banned:   atomic.LoadInt64(&m.gauges.banned),
+		InFlight: atomic.LoadInt64(&m.gauges.inFlight),
+	}
+}
+
+// updateSizeGauges sets the known and banned gauges. It must be called with
+// the manager lock held for writes after nodes or bans are added or removed.
+func (m *Manager) updateSizeGauges() {
+	atomic.StoreInt64(&m.gauges.known, int64(len(m.nodes)))
+	atomic.StoreInt64(&m.gauges.banned, int64(len(m.bans)))
+}
+
+// setGoodGauge sets the good gauge.
+func (m *Manager) setGoodGauge(good int) {
+	atomic.StoreInt64(&m.gauges.good, int64(good))
+}
+
+// setAttempting marks whether a connection attempt to the node is in
+// progress, and updates the in-flight gauge accordingly. It must be called
+// with the manager lock held for writes.
+func (m *Manager) setAttempting(node *Node, attempting bool) {
+	if node.attempting == attempting {
+		return
+	}
+	node.attempting = attempting
+	if attempting {
+		atomic.AddInt64(&m.gauges.inFlight, 1)
+	} else {
+		atomic.AddInt64(&m.gauges.inFlight, -1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+// tagGeo records the country and continent of the node, if a GeoIP database
+// is loaded and the node was not tagged yet.
+func (m *Manager) tagGeo(node *Node) {
+	if m.geoDB == nil || node.Country != "" {
+		return
+	}
+	record, ok, err := m.geoDB.lookup(node.Addr.IP)
+	if err != nil {
+		log.Debugf("Failed to look up the location of %s: %v", node.Addr.IP, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	// The registered country is the best guess for addresses whose actual
+	// country is not known.
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if isoCode, ok := country["iso_code"].(string); ok {
+			node.Country = isoCode
+			break
+		}
+	}
+	continent, _ := fields["continent"].(map[string]interface{})
+	if code, ok := continent["code"].(string); ok {
+		node.Continent = code
+	}
+}
+
+// CountryCounts returns the number of good nodes per ISO 3166-1 country
+// code. Nodes in an unknown country are counted under the empty string.
+func (m *Manager) CountryCounts() map[string]int {
+	return m.countGoodNodes(func(node *Node) string { return node.Country })
+}
+
+// ContinentCounts returns the number of good nodes per continent code. Nodes
+// on an unknown continent are counted under the empty string.
+func (m *Manager) ContinentCounts() map[string]int {
+	return m.countGoodNodes(func(node *Node) string { return node.Continent })
+}
@@ -7,6 +7,7 @@ require (
 	github.com/kaspanet/kaspad v0.10.4
 	github.com/miekg/dns v1.1.25
 	github.com/pkg/errors v0.9.1
+	github.com/syndtr/goleveldb v1.0.1-0.20190923125748-758128399b1d
 	google.golang.org/grpc v1.33.1
 )
 
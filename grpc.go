@@ -65,8 +65,10 @@ func (s *grpcServer) GetPeersList(ctx context.Context, req *pb.GetPeersListReque
 	}
 
 	// mb, we should move DNS-related logic out of manager?
-	ipv4Addresses := s.amgr.GoodAddresses(dns.TypeA, req.IncludeAllSubnetworks, subnetworkID)
-	ipv6Addresses := s.amgr.GoodAddresses(dns.TypeAAAA, req.IncludeAllSubnetworks, subnetworkID)
+	// Unlike DNS answers, gRPC responses carry ports, so nodes on
+	// non-default ports can be served as well.
+	ipv4Addresses := s.amgr.GoodAddresses(dns.TypeA, req.IncludeAllSubnetworks, subnetworkID, false)
+	ipv6Addresses := s.amgr.GoodAddresses(dns.TypeAAAA, req.IncludeAllSubnetworks, subnetworkID, false)
 
 	addresses := ToProtobufAddresses(append(ipv4Addresses, ipv6Addresses...))
 	log.Errorf("ADDRESSES: %+v", addresses)
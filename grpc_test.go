@@ -16,9 +16,8 @@ import (
 )
 
 func TestGetPeers(t *testing.T) {
-	activeConfig = &ConfigFlags{
-		NetworkFlags: config.NetworkFlags{Devnet: true},
-	}
+	useDefaultConfig(t)
+	activeConfig.NetworkFlags = config.NetworkFlags{Devnet: true}
 
 	err := activeConfig.NetworkFlags.ResolveNetwork(nil)
 	if err != nil {
@@ -27,7 +26,7 @@ func TestGetPeers(t *testing.T) {
 
 	peersDefaultPort = 1313
 
-	amgr, err = NewManager(defaultHomeDir)
+	amgr, err = NewManager(context.Background(), defaultHomeDir, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "NewManager: %v\n", err)
 		os.Exit(1)
@@ -36,7 +35,7 @@ func TestGetPeers(t *testing.T) {
 	ip := net.IP([]byte{203, 105, 20, 21})
 	netAddress := appmessage.NewNetAddressIPPort(ip, uint16(peersDefaultPort))
 	amgr.AddAddresses([]*appmessage.NetAddress{netAddress})
-	amgr.Good(ip, nil)
+	amgr.Good(netAddress, nil)
 
 	host := "localhost:3737"
 	grpcServer := NewGRPCServer(amgr)
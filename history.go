@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// historyDirname is the name of the directory of the LevelDB network
+	// size history.
+	historyDirname = "history.db"
+
+	// historySamplePrefix prefixes the keys samples are stored under. It
+	// is followed by the big-endian Unix time of the sample, so samples
+	// are iterated in chronological order.
+	historySamplePrefix = "sample/"
+
+	// historyAllSubnetworks is written in the subnetwork column of CSV
+	// history exports for the counts of all subnetworks together.
+	historyAllSubnetworks = "*"
+)
+
+// historyCSVHeader is the header row of CSV history exports.
+var historyCSVHeader = []string{"time", "subnetwork", "known", "good"}
+
+// SubnetworkSize is the number of known and good nodes of a subnetwork.
+type SubnetworkSize struct {
+	Known int
+	Good  int
+}
+
+// SizeSample is the size of the network at a point in time.
+type SizeSample struct {
+	Time time.Time
+
+	// Known is the number of nodes in the address book, and Good the
+	// number of them that were good enough to be served.
+	Known int
+	Good  int
+
+	// Subnetworks holds the sizes per subnetwork ID. Nodes of an unknown
+	// subnetwork are counted under the empty string.
+	Subnetworks map[string]SubnetworkSize
+}
+
+// sizeHistory keeps SizeSamples in a LevelDB database.
+type sizeHistory struct {
+	db *leveldb.DB
+}
+
+// openSizeHistory opens, and creates if needed, the network size history at
+// path.
+func openSizeHistory(path string) (*sizeHistory, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errors.Errorf("error opening %s: %v", path, err)
+	}
+	return &sizeHistory{db: db}, nil
+}
+
+// historyKey returns the key of the sample taken at t.
+func historyKey(t time.Time) []byte {
+	key := make([]byte, len(historySamplePrefix)+8)
+	copy(key, historySamplePrefix)
+	binary.BigEndian.PutUint64(key[len(historySamplePrefix):], uint64(t.Unix()))
+	return key
+}
+
+// record stores sample and removes the samples taken before notBefore.
+func (h *sizeHistory) record(sample *SizeSample, notBefore time.Time) error {
+	value, err := json.Marshal(sample)
+	if err != nil {
+		return errors.Errorf("failed to encode the size sample: %v", err)
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(historyKey(sample.Time), value)
+	it := h.db.NewIterator(&util.Range{
+		Start: []byte(historySamplePrefix),
+		Limit: historyKey(notBefore),
+	}, nil)
+	for it.Next() {
+		batch.Delete(append([]byte(nil), it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return errors.Errorf("error reading the size history: %v", err)
+	}
+
+	err = h.db.Write(batch, nil)
+	if err != nil {
+		return errors.Errorf("error writing the size history: %v", err)
+	}
+	return nil
+}
+
+// samples returns the samples taken from from, inclusive, to to, exclusive,
+// oldest first.
+func (h *sizeHistory) samples(from, to time.Time) ([]*SizeSample, error) {
+	var samples []*SizeSample
+	it := h.db.NewIterator(&util.Range{
+		Start: historyKey(from),
+		Limit: historyKey(to),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		sample := &SizeSample{}
+		err := json.Unmarshal(it.Value(), sample)
+		if err != nil {
+			return nil, errors.Errorf("error decoding the size sample %x: %v", it.Key(), err)
+		}
+		samples = append(samples, sample)
+	}
+	if err := it.Error(); err != nil {
+		return nil, errors.Errorf("error reading the size history: %v", err)
+	}
+	return samples, nil
+}
+
+func (h *sizeHistory) close() error {
+	return h.db.Close()
+}
+
+// sizeSample returns the current size of the network.
+func (m *Manager) sizeSample() *SizeSample {
+	criteria := m.activeServingCriteria()
+	sample := &SizeSample{
+		Time:        criteria.now,
+		Subnetworks: make(map[string]SubnetworkSize),
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	sample.Known = len(m.nodes)
+	for subnetwork, nodes := range m.subnetworks {
+		size := SubnetworkSize{Known: len(nodes)}
+		for _, node := range nodes {
+			if node.state(criteria) == nodeStateGood {
+				size.Good++
+			}
+		}
+		sample.Good += size.Good
+		sample.Subnetworks[subnetwork] = size
+	}
+	return sample
+}
+
+// recordSizeSample adds the current size of the network to the history.
+func (m *Manager) recordSizeSample() {
+	sample := m.sizeSample()
+	err := m.history.record(sample, sample.Time.Add(-ActiveConfig().HistoryRetention))
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// SizeHistory returns the network sizes recorded from from, inclusive, to to,
+// exclusive, oldest first. It returns an error if no history is kept.
+func (m *Manager) SizeHistory(from, to time.Time) ([]*SizeSample, error) {
+	if m.history == nil {
+		return nil, errors.New("no network size history is kept")
+	}
+	return m.history.samples(from, to)
+}
+
+// writeSizeHistory writes samples to w in the given export format. CSV
+// exports have a row per sample and subnetwork, preceded by a row with the
+// counts of all subnetworks together.
+func writeSizeHistory(w io.Writer, samples []*SizeSample, format string) error {
+	switch format {
+	case exportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(samples)
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(historyCSVHeader)
+		if err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			t := formatExportTime(sample.Time)
+			err := cw.Write([]string{t, historyAllSubnetworks, strconv.Itoa(sample.Known), strconv.Itoa(sample.Good)})
+			if err != nil {
+				return err
+			}
+
+			subnetworks := make([]string, 0, len(sample.Subnetworks))
+			for subnetwork := range sample.Subnetworks {
+				subnetworks = append(subnetworks, subnetwork)
+			}
+			sort.Strings(subnetworks)
+			for _, subnetwork := range subnetworks {
+				size := sample.Subnetworks[subnetwork]
+				err := cw.Write([]string{t, subnetwork, strconv.Itoa(size.Known), strconv.Itoa(size.Good)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return errors.Errorf("unknown export format %s", format)
+	}
+}
+
+// exportHistoryToFile writes the whole network size history to
+// history.<format> in the home directory, in the configured export format.
+func exportHistoryToFile() {
+	if amgr.history == nil {
+		return
+	}
+	format := ActiveConfig().ExportFormat
+	filePath, ok := homeDirFile("history." + format)
+	if !ok {
+		return
+	}
+
+	samples, err := amgr.SizeHistory(time.Unix(0, 0), amgr.clock.Now().Add(time.Second))
+	if err != nil {
+		log.Errorf("Failed to read the network size history: %v", err)
+		return
+	}
+	err = writeFileAtomically(filePath, func(w io.Writer) error {
+		return writeSizeHistory(w, samples, format)
+	})
+	if err != nil {
+		log.Errorf("Failed to write the network size history to %s: %v", filePath, err)
+		return
+	}
+	log.Infof("Wrote %d network size samples to %s", len(samples), filePath)
+}
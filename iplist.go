@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ipRangeList is a list of IP ranges, such as the ranges that are excluded
+// from crawling and serving. Ranges come from the command line and,
+// optionally, from a file that is reloaded whenever it changes.
+type ipRangeList struct {
+	mtx      sync.RWMutex
+	static   []*net.IPNet
+	fromFile []*net.IPNet
+
+	filePath    string
+	fileModTime time.Time
+}
+
+// newIPRangeList returns a list of the passed ranges and of the ranges listed
+// in the file at filePath, if it is not empty.
+func newIPRangeList(ranges []string, filePath string) (*ipRangeList, error) {
+	static, err := parseIPRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	b := &ipRangeList{
+		static:   static,
+		filePath: filePath,
+	}
+	_, err = b.reload()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseIPRanges parses ranges in CIDR notation. Plain IP addresses are
+// treated as ranges holding that address only.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP range %s", r)
+			}
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = net.IPv4len * 8
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, errors.Errorf("invalid IP range %s: %v", r, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// reload reads the list file again if it changed since it was last
+// read, and returns whether it did. Empty lines and lines starting with #
+// are ignored.
+func (b *ipRangeList) reload() (bool, error) {
+	if b.filePath == "" {
+		return false, nil
+	}
+	info, err := os.Stat(b.filePath)
+	if err != nil {
+		return false, errors.Errorf("error reading %s: %v", b.filePath, err)
+	}
+	if info.ModTime().Equal(b.fileModTime) {
+		return false, nil
+	}
+
+	f, err := os.Open(b.filePath)
+	if err != nil {
+		return false, errors.Errorf("%s error opening file: %v", b.filePath, err)
+	}
+	defer f.Close()
+
+	var ranges []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ranges = append(ranges, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, errors.Errorf("error reading %s: %v", b.filePath, err)
+	}
+	fromFile, err := parseIPRanges(ranges)
+	if err != nil {
+		return false, errors.Errorf("error reading %s: %v", b.filePath, err)
+	}
+
+	b.mtx.Lock()
+	b.fromFile = fromFile
+	b.fileModTime = info.ModTime()
+	b.mtx.Unlock()
+
+	log.Infof("Loaded %d IP ranges from %s", len(fromFile), b.filePath)
+	return true, nil
+}
+
+// isEmpty returns whether the list holds no ranges.
+func (b *ipRangeList) isEmpty() bool {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return len(b.static) == 0 && len(b.fromFile) == 0 && b.filePath == ""
+}
+
+// contains returns whether ip is in one of the ranges of the list.
+func (b *ipRangeList) contains(ip net.IP) bool {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	for _, n := range b.static {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range b.fromFile {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadIPLists reloads the blacklist and whitelist files if they changed,
+// and removes the nodes the blacklist now covers.
+func (m *Manager) reloadIPLists() {
+	_, err := m.whitelist.reload()
+	if err != nil {
+		log.Errorf("Failed to reload the IP whitelist: %v", err)
+	}
+
+	changed, err := m.blacklist.reload()
+	if err != nil {
+		log.Errorf("Failed to reload the IP blacklist: %v", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	var count int
+	m.mtx.Lock()
+	for key, node := range m.nodes {
+		if m.blacklist.contains(node.Addr.IP) {
+			m.removeNode(key)
+			count++
+		}
+	}
+	m.mtx.Unlock()
+
+	if count > 0 {
+		log.Infof("Removed %d blacklisted addresses", count)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// levelDBNodePrefix prefixes the keys nodes are stored under.
+	levelDBNodePrefix = "node/"
+
+	// levelDBDirname is the name of the directory of the LevelDB address
+	// book.
+	levelDBDirname = "nodes.db"
+)
+
+// levelDBVersionKey is the key the format version is stored under.
+var levelDBVersionKey = []byte("version")
+
+// levelDBPeerStore keeps every node in its own LevelDB record. Only nodes
+// that changed since they were last saved are written, so saving does not
+// rewrite the whole address book.
+type levelDBPeerStore struct {
+	db *leveldb.DB
+
+	// importPath is the path of the JSON address book whose nodes are
+	// imported if the LevelDB address book is new, or empty.
+	importPath string
+
+	// saved holds a hash of the last saved encoding of every node, keyed
+	// by node key.
+	saved map[string]uint64
+}
+
+// newLevelDBPeerStore opens, and creates if needed, the LevelDB address
+// book at path. If it is new, the nodes of the JSON address book at
+// importPath, if any, are loaded instead, so that switching the storage
+// backend keeps the known nodes.
+func newLevelDBPeerStore(path string, importPath string) (*levelDBPeerStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errors.Errorf("error opening %s: %v", path, err)
+	}
+	return &levelDBPeerStore{
+		db:         db,
+		importPath: importPath,
+		saved:      make(map[string]uint64),
+	}, nil
+}
+
+func (s *levelDBPeerStore) load() (map[string]*Node, error) {
+	version, err := s.db.Get(levelDBVersionKey, nil)
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return nil, errors.Errorf("error reading the address book version: %v", err)
+	}
+	// A new address book holds no version, and no nodes to migrate. The
+	// imported nodes are written by the first save, which also writes the
+	// version, so they are imported only once.
+	if errors.Is(err, leveldb.ErrNotFound) && s.importPath != "" {
+		nodes, err := (&jsonPeerStore{filePath: s.importPath}).load()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodes) > 0 {
+			log.Infof("Importing %d nodes from %s", len(nodes), s.importPath)
+			return nodes, nil
+		}
+	}
+	nodeVersion := addressBookVersion
+	if err == nil {
+		nodeVersion, err = strconv.Atoi(string(version))
+		if err != nil || nodeVersion > addressBookVersion {
+			return nil, errors.Errorf("unsupported address book version %s, the latest "+
+				"supported version is %d", version, addressBookVersion)
+		}
+	}
+
+	nodes := make(map[string]*Node)
+	it := s.db.NewIterator(util.BytesPrefix([]byte(levelDBNodePrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		node, err := decodeNode(it.Value(), nodeVersion)
+		if err != nil {
+			return nil, errors.Errorf("error decoding node %s: %v", it.Key(), err)
+		}
+		key := strings.TrimPrefix(string(it.Key()), levelDBNodePrefix)
+		nodes[key] = node
+		s.saved[key] = hashBytes(it.Value())
+	}
+	if err := it.Error(); err != nil {
+		return nil, errors.Errorf("error reading the address book: %v", err)
+	}
+	return nodes, nil
+}
+
+func (s *levelDBPeerStore) save(nodes map[string]*Node) error {
+	batch := new(leveldb.Batch)
+	batch.Put(levelDBVersionKey, []byte(strconv.Itoa(addressBookVersion)))
+
+	saved := make(map[string]uint64, len(nodes))
+	for key, node := range nodes {
+		value, err := json.Marshal(node)
+		if err != nil {
+			return errors.Errorf("Failed to encode node %s: %v", key, err)
+		}
+		hash := hashBytes(value)
+		saved[key] = hash
+		if previous, ok := s.saved[key]; ok && previous == hash {
+			continue
+		}
+		batch.Put([]byte(levelDBNodePrefix+key), value)
+	}
+	for key := range s.saved {
+		if _, ok := nodes[key]; !ok {
+			batch.Delete([]byte(levelDBNodePrefix + key))
+		}
+	}
+
+	// Sync the write, so that a crash loses at most the changes since the
+	// previous save.
+	err := s.db.Write(batch, &opt.WriteOptions{Sync: true})
+	if err != nil {
+		return errors.Errorf("Error writing the address book: %v", err)
+	}
+	s.saved = saved
+	return nil
+}
+
+func (s *levelDBPeerStore) close() error {
+	return s.db.Close()
+}
+
+// hashBytes returns a 64-bit FNV-1a hash of data.
+func hashBytes(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
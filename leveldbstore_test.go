@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// openTestLevelDBPeerStore opens the LevelDB address book in dir, closing it
+// when the test ends.
+func openTestLevelDBPeerStore(t *testing.T, dir string) *levelDBPeerStore {
+	s, err := newLevelDBPeerStore(filepath.Join(dir, levelDBDirname), filepath.Join(dir, peersFilename))
+	if err != nil {
+		t.Fatalf("newLevelDBPeerStore: %v", err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func TestLevelDBPeerStore(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	s := openTestLevelDBPeerStore(t, dir)
+
+	nodes := make(map[string]*Node)
+	for _, port := range []uint16{16111, 16112} {
+		addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), port)
+		nodes[nodeKey(addr)] = &Node{Addr: addr, Quality: initialQuality}
+	}
+	loaded, err := s.load()
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("expected a new address book to be empty but got %v, %v", loaded, err)
+	}
+	err = s.save(nodes)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// Overwrite the record of a node behind the store's back: saving the
+	// node unchanged must not rewrite it.
+	var unchangedKey string
+	for key := range nodes {
+		unchangedKey = key
+	}
+	marker := []byte(`{"Addr": {"IP": "1.2.3.4", "Port": 1}, "Quality": 0.5}`)
+	err = s.db.Put([]byte(levelDBNodePrefix+unchangedKey), marker, nil)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	err = s.save(nodes)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	value, err := s.db.Get([]byte(levelDBNodePrefix+unchangedKey), nil)
+	if err != nil || string(value) != string(marker) {
+		t.Errorf("expected the unchanged node not to be rewritten but got %s, %v", value, err)
+	}
+	// Forgetting the saved hash makes the store rewrite the node.
+	delete(s.saved, unchangedKey)
+	err = s.save(nodes)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// Removing a node deletes its record.
+	var removedKey string
+	for key := range nodes {
+		if key != unchangedKey {
+			removedKey = key
+		}
+	}
+	delete(nodes, removedKey)
+	err = s.save(nodes)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	has, err := s.db.Has([]byte(levelDBNodePrefix+removedKey), nil)
+	if err != nil || has {
+		t.Errorf("expected the removed node to be deleted but got %t, %v", has, err)
+	}
+	s.close()
+
+	s = openTestLevelDBPeerStore(t, dir)
+	loaded, err = s.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(loaded) != 1 || loaded[unchangedKey] == nil || loaded[unchangedKey].Addr.Port != nodes[unchangedKey].Addr.Port {
+		t.Errorf("expected the reopened address book to hold %s only but got %v", unchangedKey, loaded)
+	}
+}
+
+func TestLevelDBPeerStoreMigration(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	s := openTestLevelDBPeerStore(t, dir)
+
+	err := s.db.Put(levelDBVersionKey, []byte(strconv.Itoa(1)), nil)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	err = s.db.Put([]byte(levelDBNodePrefix+"1.2.3.4:16111"), []byte(`{"Addr": {"IP": "1.2.3.4", "Port": 16111}}`), nil)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	nodes, err := s.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	node := nodes["1.2.3.4:16111"]
+	if node == nil || node.Quality != initialQuality {
+		t.Errorf("expected a version 1 node to be migrated to quality %f but got %+v", initialQuality, node)
+	}
+}
+
+func TestLevelDBPeerStoreImport(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	err := newJSONPeerStore(filepath.Join(dir, peersFilename)).save(map[string]*Node{
+		key: {Addr: addr, Quality: 0.5},
+	})
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s := openTestLevelDBPeerStore(t, dir)
+	nodes, err := s.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(nodes) != 1 || nodes[key] == nil || nodes[key].Quality != 0.5 {
+		t.Fatalf("expected the nodes of the JSON address book to be imported but got %v", nodes)
+	}
+	err = s.save(nodes)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s.close()
+
+	// Once saved, the LevelDB address book is no longer new, so nodes
+	// removed from it are not imported again.
+	s = openTestLevelDBPeerStore(t, dir)
+	_, err = s.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	err = s.save(map[string]*Node{})
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s.close()
+
+	s = openTestLevelDBPeerStore(t, dir)
+	nodes, err = s.load()
+	if err != nil || len(nodes) != 0 {
+		t.Errorf("expected the JSON address book to be imported only once but got %v, %v", nodes, err)
+	}
+}
@@ -12,6 +12,9 @@ var (
 	backendLog = logger.NewBackend()
 	log        = backendLog.Logger("SEED")
 	spawn      = panics.GoroutineWrapperFunc(log)
+
+	// qlog logs the sampled DNS queries.
+	qlog = backendLog.Logger("QLOG")
 )
 
 func initLog(logFile, errLogFile string) {
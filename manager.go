@@ -5,15 +5,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/util/mstime"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
@@ -21,10 +30,76 @@ import (
 // Node repesents a node in the Kaspa network
 type Node struct {
 	Addr         *appmessage.NetAddress
-	LastAttempt  time.Time
-	LastSuccess  time.Time
-	LastSeen     time.Time
 	SubnetworkID *externalapi.DomainSubnetworkID
+
+	// LastSeen is the last time the node was advertised to the seeder,
+	// LastAttempt the last time the seeder started connecting to it, and
+	// LastSuccess the last time the seeder completed a handshake and an
+	// address exchange with it. A LastAttempt after LastSuccess means that
+	// the last attempt failed or is still in progress.
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+
+	// Failures is the number of consecutive failed connection attempts,
+	// and NextAttempt is the earliest time the node should be retried.
+	Failures    int
+	NextAttempt time.Time
+
+	// Successes is the number of consecutive successful connection
+	// attempts, and StreakStart the time of the first of them.
+	Successes   int
+	StreakStart time.Time
+
+	// HandshakeFailures is the number of consecutive connection attempts
+	// where the node accepted the connection but failed the handshake.
+	HandshakeFailures int
+
+	// LastFailure is the reason of the last failed connection attempt, if
+	// the node has not been good since, and FailureCounts holds the number
+	// of failed connection attempts per reason.
+	LastFailure   FailureReason
+	FailureCounts map[FailureReason]int
+
+	// Quality is a score between 0 and initialQuality that decays with
+	// each failed connection attempt and recovers with successful ones, so
+	// that intermittently failing nodes are demoted and eventually pruned
+	// more gracefully than by counting consecutive failures.
+	Quality float64
+
+	Reliability Reliability
+
+	// DialLatency and HandshakeLatency are moving averages of the time it
+	// took to connect to the node and to complete the handshake with it.
+	// PingLatency is the moving average of the round trip of the liveness
+	// probe, and zero if the node was never probed.
+	DialLatency      time.Duration
+	HandshakeLatency time.Duration
+	PingLatency      time.Duration
+
+	// ASN and ASOrg identify the autonomous system the node is in. An ASN
+	// of 0 means it is unknown.
+	ASN   uint32
+	ASOrg string
+
+	// Country and Continent are the ISO 3166-1 country code and the
+	// continent code of the node's location, if known.
+	Country   string
+	Continent string
+
+	// SourceGroup is the network group of the peer that first advertised
+	// the node, which selects its bucket in the new table, and Source the
+	// IP address of that peer.
+	SourceGroup string
+	Source      string
+
+	// tried is set if the node is in the tried table rather than the new
+	// table.
+	tried bool
+
+	// attempting is set while a connection attempt to the node is in
+	// progress.
+	attempting bool
 }
 
 // Manager is dnsseeder's main worker-type, storing all information required
@@ -32,34 +107,135 @@ type Node struct {
 type Manager struct {
 	mtx sync.RWMutex
 
-	nodes     map[string]*Node
-	wg        sync.WaitGroup
-	quit      chan struct{}
-	peersFile string
+	nodes map[string]*Node
+	bans  map[string]*Ban
+
+	// clock tells the time, which all timestamps and timeouts of nodes,
+	// bans and sources are based on.
+	clock clock
+
+	// network is the network whose nodes the manager holds, or nil for the
+	// active network.
+	network *seederNetwork
+
+	// rng makes all random choices of the manager: bucket placement, crawl
+	// sampling and the order of answers.
+	rng *lockedRand
+
+	// subnetworks indexes nodes by subnetworkKey, so that the size history
+	// counts the nodes of each subnetwork without grouping all nodes.
+	subnetworks map[string]map[string]*Node
+
+	gauges managerGauges
+
+	// gossip holds the gossip record of every peer that was the first to
+	// advertise a node, keyed by IP address.
+	gossip map[string]*gossipRecord
+
+	// deadAddrs remembers the nodes that expired, so that they are not
+	// added again when they are still gossiped.
+	deadAddrs *deadAddressFilter
+
+	// ips indexes nodes by IP address, to apply the multi-port policy.
+	ips map[string]map[string]*Node
+
+	// netGroupCounts and asnCounts hold the number of nodes per network
+	// group and per autonomous system, so that evictions can favor
+	// diversity.
+	netGroupCounts map[string]int
+	asnCounts      map[string]int
+
+	// newTable and triedTable partition nodes, see bucket. bucketKey
+	// randomizes bucket selection so it cannot be predicted by peers.
+	newTable   [newBucketCount]bucket
+	triedTable [triedBucketCount]bucket
+	bucketKey  []byte
+
+	// blacklist holds the ranges that are neither crawled nor served, and
+	// whitelist, unless empty, the only ranges that are served.
+	blacklist *ipRangeList
+	whitelist *ipRangeList
+
+	// asnDB and geoDB, if set, are used to tag nodes with their autonomous
+	// system and location.
+	asnDB *mmdbReader
+	geoDB *mmdbReader
+
+	sources  map[string]*addrSource
+	wg       sync.WaitGroup
+	store    peerStore
+	bansFile string
+
+	// history records the size of the network over time. It is nil if
+	// no history is kept.
+	history *sizeHistory
+
+	crawlState     crawlState
+	crawlStateFile string
+
+	// ephemeral is set if the manager neither loads nor saves any state.
+	ephemeral bool
+
+	observers []ManagerObserver
+
+	// churn counts the daily churn of the address book.
+	churn *churnTracker
+
+	// answers caches the answer sets of GoodAddresses. Without it, they
+	// are computed on every call.
+	answers *answerCache
+
+	// retests holds the keys of the nodes scheduled with Retest, and
+	// retestRequested is signaled when nodes are scheduled.
+	retests         map[string]struct{}
+	retestRequested chan struct{}
+
+	// currentSnapshot holds the latest *nodeSnapshot, and snapshotMtx
+	// serializes taking new ones. nodesVersion is incremented whenever a
+	// node is added, replaced or removed, so that snapshots are only taken
+	// again when it changed.
+	currentSnapshot atomic.Value
+	snapshotMtx     sync.Mutex
+	nodesVersion    uint64
 }
 
 const (
 	// defaultMaxAddresses is the maximum number of addresses to return.
 	defaultMaxAddresses = 16
 
-	// defaultStaleTimeout is the time in which a host is considered
-	// stale.
-	defaultStaleTimeout = time.Hour
-
-	// dumpAddressInterval is the interval used to dump the address
-	// cache to disk for future use.
-	dumpAddressInterval = time.Second * 30
-
-	// peersFilename is the name of the file.
-	peersFilename = "nodes.json"
+	// bansFilename is the name of the file banned addresses are
+	// persisted to.
+	bansFilename = "bans.json"
 
 	// pruneAddressInterval is the interval used to run the address
 	// pruner.
 	pruneAddressInterval = time.Minute * 1
 
-	// pruneExpireTimeout is the expire time in which a node is
-	// considered dead.
-	pruneExpireTimeout = time.Hour * 8
+	// maxRetryBackoff is the maximum time to wait before retrying a
+	// failing node.
+	maxRetryBackoff = time.Hour * 24
+
+	// recoveryRetryInterval is the time to wait before retrying a recently
+	// good node, and between crawl cycles, while the number of good nodes
+	// is below the bootstrap threshold.
+	recoveryRetryInterval = time.Minute
+
+	// maxAddressTimestampSkew is how far in the future the timestamp of an
+	// advertised address may be before it is clamped to the current time.
+	maxAddressTimestampSkew = time.Minute * 10
+
+	// maxAddressAge is the maximum age of the timestamp of an advertised
+	// address. Older addresses are rejected.
+	maxAddressAge = time.Hour * 24 * 30
+
+	// sampleExpiryWeight is the extra weight a node that is about to be
+	// pruned gets, when sampling stale nodes to crawl, over a node that was
+	// just found to be good.
+	sampleExpiryWeight = 4
+
+	// latencySampleWeight is the weight of a new sample in the moving
+	// averages of node latencies.
+	latencySampleWeight = 0.2
 )
 
 var (
@@ -71,6 +247,14 @@ var (
 		ipNet("192.168.0.0", 16, 32),
 	}
 
+	// rfc3849Net specifies the IPv6 documentation address block as defined
+	// by RFC3849 (2001:DB8::/32).
+	rfc3849Net = ipNet("2001:DB8::", 32, 128)
+
+	// rfc3927Net specifies the IPv4 auto configuration address block as
+	// defined by RFC3927 (169.254.0.0/16).
+	rfc3927Net = ipNet("169.254.0.0", 16, 32)
+
 	// rfc3964Net specifies the IPv6 to IPv4 encapsulation address block as
 	// defined by RFC3964 (2002::/16).
 	rfc3964Net = ipNet("2002::", 16, 128)
@@ -90,6 +274,18 @@ var (
 	// rfc4193Net specifies the IPv6 unique local address block as defined
 	// by RFC4193 (FC00::/7).
 	rfc4193Net = ipNet("FC00::", 7, 128)
+
+	// rfc5737Nets specifies the IPv4 documentation address blocks as defined
+	// by RFC5737 (192.0.2.0/24, 198.51.100.0/24, 203.0.113.0/24).
+	rfc5737Nets = []net.IPNet{
+		ipNet("192.0.2.0", 24, 32),
+		ipNet("198.51.100.0", 24, 32),
+		ipNet("203.0.113.0", 24, 32),
+	}
+
+	// zero4Net specifies the IPv4 "this network" address block as defined
+	// by RFC1122 (0.0.0.0/8).
+	zero4Net = ipNet("0.0.0.0", 8, 32)
 )
 
 // ipNet returns a net.IPNet struct given the passed IP address string, number
@@ -99,273 +295,878 @@ func ipNet(ip string, ones, bits int) net.IPNet {
 	return net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(ones, bits)}
 }
 
-func isRoutable(addr net.IP) bool {
-	if ActiveConfig().NetParams().AcceptUnroutable {
+func (m *Manager) isRoutable(addr net.IP) bool {
+	if m.network.params().AcceptUnroutable {
 		return true
 	}
+	return isPublicIP(addr, ActiveConfig().AllowPrivate)
+}
+
+// isPublicIP returns whether addr may be reached over the public internet.
+// If allowPrivate is set, addresses in private and loopback ranges are
+// accepted as well.
+func isPublicIP(addr net.IP, allowPrivate bool) bool {
+	if addr.IsUnspecified() || addr.IsMulticast() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || zero4Net.Contains(addr) {
+		return false
+	}
 
+	isPrivate := addr.IsLoopback() || rfc4193Net.Contains(addr)
 	for _, n := range rfc1918Nets {
+		if n.Contains(addr) {
+			isPrivate = true
+		}
+	}
+	if isPrivate {
+		return allowPrivate
+	}
+
+	for _, n := range rfc5737Nets {
 		if n.Contains(addr) {
 			return false
 		}
 	}
-	if rfc3964Net.Contains(addr) ||
+	if rfc3849Net.Contains(addr) ||
+		rfc3927Net.Contains(addr) ||
+		rfc3964Net.Contains(addr) ||
 		rfc4380Net.Contains(addr) ||
 		rfc4843Net.Contains(addr) ||
-		rfc4862Net.Contains(addr) ||
-		rfc4193Net.Contains(addr) {
+		rfc4862Net.Contains(addr) {
 		return false
 	}
 
 	return true
 }
 
-// NewManager constructs and returns a new dnsseeder manager, with the provided dataDir
-func NewManager(dataDir string) (*Manager, error) {
+// nodeKey returns the key under which the node with the given address is
+// stored. Nodes are keyed by both IP and port, so that peers sharing an IP
+// but listening on different ports are tracked separately.
+func nodeKey(addr *appmessage.NetAddress) string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+}
+
+// NewManager constructs and returns a new dnsseeder manager, with the provided dataDir,
+// for the nodes of network, or of the active network if network is nil.
+// The manager saves its state and stops once ctx is canceled.
+func NewManager(ctx context.Context, dataDir string, network *seederNetwork) (*Manager, error) {
 	amgr := Manager{
-		nodes:     make(map[string]*Node),
-		peersFile: filepath.Join(dataDir, peersFilename),
-		quit:      make(chan struct{}),
+		nodes:       make(map[string]*Node),
+		subnetworks: make(map[string]map[string]*Node),
+		bans:        make(map[string]*Ban),
+		sources:     make(map[string]*addrSource),
+		bansFile:    filepath.Join(dataDir, bansFilename),
+		clock:       systemClock{},
+		network:     network,
+		ephemeral:   ActiveConfig().Ephemeral,
+
+		retests:         make(map[string]struct{}),
+		retestRequested: make(chan struct{}, 1),
+
+		crawlStateFile: filepath.Join(dataDir, crawlStateFilename),
+	}
+
+	seed := ActiveConfig().RandSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Infof("Random seed: %d", seed)
+	amgr.rng = newLockedRand(seed)
+
+	// The seed only makes sampling and ordering reproducible. The keys
+	// placing addresses are secret, so that peers cannot target buckets,
+	// and differ between the managers of several networks.
+	var err error
+	amgr.bucketKey, err = newSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	deadAddrsKey, err := newSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	amgr.deadAddrs = newDeadAddressFilter(deadAddrsKey, amgr.clock.Now())
+	amgr.churn = newChurnTracker(amgr.clock)
+	amgr.answers = newAnswerCache()
+	amgr.observers = append(amgr.observers, amgr.churn, amgr.answers)
+
+	amgr.blacklist, err = newIPRangeList(ActiveConfig().BanIP, ActiveConfig().BanIPFile)
+	if err != nil {
+		return nil, err
+	}
+	amgr.whitelist, err = newIPRangeList(ActiveConfig().ServeWhitelist, ActiveConfig().ServeWhitelistFile)
+	if err != nil {
+		return nil, err
 	}
 
-	err := amgr.deserializePeers()
+	if ActiveConfig().ASNDB != "" {
+		amgr.asnDB, err = openMMDB(ActiveConfig().ASNDB)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ActiveConfig().GeoDB != "" {
+		amgr.geoDB, err = openMMDB(ActiveConfig().GeoDB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var store peerStore = memoryPeerStore{}
+	if !amgr.ephemeral {
+		store, err = newPeerStore(ActiveConfig().Storage, dataDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	amgr.store = store
+
+	// Bans are loaded first, so that the nodes of banned addresses are
+	// left out of the address book.
+	if !amgr.ephemeral {
+		err = amgr.deserializeBans()
+		if err != nil {
+			log.Warnf("Failed to parse file %s: %v", amgr.bansFile, err)
+		}
+	}
+
+	// Refuse to start rather than overwrite an address book that could not
+	// be read, so that it can still be recovered.
+	err = amgr.deserializePeers()
 	if err != nil {
-		log.Warnf("Failed to parse file %s: %v", amgr.peersFile, err)
-		// if it is invalid we nuke the old one unconditionally.
-		err = os.Remove(amgr.peersFile)
+		store.close()
+		return nil, errors.Wrap(err, "failed to load the address book, move "+
+			"it away to start with an empty one")
+	}
+
+	if !amgr.ephemeral && ActiveConfig().HistoryInterval != 0 {
+		amgr.history, err = openSizeHistory(filepath.Join(dataDir, historyDirname))
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+
+	if !amgr.ephemeral {
+		err = amgr.deserializeCrawlState()
 		if err != nil {
-			log.Warnf("Failed to remove corrupt peers file %s: %v",
-				amgr.peersFile, err)
+			log.Warnf("Failed to parse file %s: %v", amgr.crawlStateFile, err)
 		}
 	}
 
 	amgr.wg.Add(1)
-	spawn("NewManager-Manager.addressHandler", amgr.addressHandler)
+	spawn("NewManager-Manager.addressHandler", func() { amgr.addressHandler(ctx) })
 
 	return &amgr, nil
 }
 
-// AddAddresses adds an address to this dnsseeder manager, and returns the number of
-// address currently held
-func (m *Manager) AddAddresses(addrs []*appmessage.NetAddress) int {
-	var count int
-
+// AddAddresses adds addresses to this dnsseeder manager, and returns the ones
+// that were not known before
+func (m *Manager) AddAddresses(addrs []*appmessage.NetAddress) []*appmessage.NetAddress {
 	m.mtx.Lock()
+	added, _ := m.addAddresses(addrs, "")
+	m.mtx.Unlock()
+
+	return added
+}
+
+// addAddresses is the lock-free implementation of AddAddresses. New nodes are
+// put in the new table, bucketed by sourceGroup. Besides the addresses that
+// were not known before, it returns the number of addresses that were
+// accepted, whether known or not. Addresses of nodes that expired recently
+// are accepted but not added again. It must be called with the manager lock
+// held for writes.
+func (m *Manager) addAddresses(addrs []*appmessage.NetAddress, sourceGroup string) (
+	added []*appmessage.NetAddress, accepted int) {
+
+	now := m.clock.Now()
+	maxNodes := ActiveConfig().MaxNodes
 	for _, addr := range addrs {
-		if !isRoutable(addr.IP) {
+		if !m.isRoutable(addr.IP) || m.isBanned(addr.IP) || m.blacklist.contains(addr.IP) {
+			continue
+		}
+		timestamp, ok := sanitizeTimestamp(addr.Timestamp, now)
+		if !ok {
 			continue
 		}
-		addrStr := addr.IP.String()
+		accepted++
+		// Store IPv4 addresses in their 4-byte form so that both
+		// families are handled consistently regardless of how the
+		// address was encoded by the peer that advertised it.
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if len(ip) != len(addr.IP) || timestamp != addr.Timestamp {
+			addr = &appmessage.NetAddress{Timestamp: timestamp, IP: ip, Port: addr.Port}
+		}
+		key := nodeKey(addr)
 
-		_, exists := m.nodes[addrStr]
+		node, exists := m.nodes[key]
+		if !exists && m.deadAddrs.contains(key) {
+			continue
+		}
 		if exists {
-			m.nodes[addrStr].LastSeen = time.Now()
+			node = m.updateNode(key)
+			node.LastSeen = now
+			if addr.Timestamp.After(node.Addr.Timestamp) {
+				node.Addr = &appmessage.NetAddress{Timestamp: addr.Timestamp, IP: node.Addr.IP, Port: node.Addr.Port}
+			}
 			continue
 		}
-		node := Node{
-			Addr:     addr,
-			LastSeen: time.Now(),
+		if !m.admitsPort(addr) || !m.makeRoom(maxNodes) {
+			continue
+		}
+		node = &Node{
+			Addr:        addr,
+			LastSeen:    now,
+			Quality:     initialQuality,
+			SourceGroup: sourceGroup,
+		}
+		m.tagNode(node)
+		m.insertNew(key, node)
+		m.notifyObservers(func(observer ManagerObserver) { observer.NodeAdded(addr) })
+		added = append(added, addr)
+		if ActiveConfig().MultiPort == multiPortDefault && addr.Port == m.network.defaultPort() {
+			m.dropOtherPorts(key, node)
 		}
-		m.nodes[addrStr] = &node
-		count++
 	}
-	m.mtx.Unlock()
 
-	return count
+	return added, accepted
 }
 
-// Addresses returns IPs that need to be tested again.
-func (m *Manager) Addresses() []*appmessage.NetAddress {
-	addrs := make([]*appmessage.NetAddress, 0, defaultMaxAddresses*8)
-	now := time.Now()
-	i := defaultMaxAddresses
+// tagNode records the autonomous system and location of the node, as far as
+// the loaded databases tell. It must be called with the manager lock held for
+// writes.
+func (m *Manager) tagNode(node *Node) {
+	m.tagASN(node)
+	m.tagGeo(node)
+}
+
+// countGoodNodes returns the number of good nodes per the key that keyOf
+// returns for them.
+func (m *Manager) countGoodNodes(keyOf func(node *Node) string) map[string]int {
+	criteria := m.activeServingCriteria()
+	counts := make(map[string]int)
 
 	m.mtx.RLock()
 	for _, node := range m.nodes {
-		if i == 0 {
+		if node.isServable(criteria) {
+			counts[keyOf(node)]++
+		}
+	}
+	m.mtx.RUnlock()
+
+	return counts
+}
+
+// sanitizeTimestamp returns the timestamp to record for an address advertised
+// with the given timestamp. Timestamps in the future are clamped to now, and
+// false is returned for timestamps older than maxAddressAge.
+func sanitizeTimestamp(timestamp mstime.Time, now time.Time) (mstime.Time, bool) {
+	nativeTimestamp := timestamp.ToNativeTime()
+	if nativeTimestamp.After(now.Add(maxAddressTimestampSkew)) {
+		return mstime.ToMSTime(now), true
+	}
+	if now.Sub(nativeTimestamp) > maxAddressAge {
+		return timestamp, false
+	}
+	return timestamp, true
+}
+
+// Addresses returns IPs that need to be tested again. If accelerate is set,
+// nodes that were good within the configured good node expiry are returned
+// regardless of their retry backoff, as long as they were not attempted
+// within the last recoveryRetryInterval. If crawl sampling is enabled, a
+// random sample of all such IPs is returned instead of the first ones found
+// in each table.
+func (m *Manager) Addresses(accelerate bool) []*appmessage.NetAddress {
+	now := m.clock.Now()
+	staleGood := ActiveConfig().StaleGood
+	staleBad := ActiveConfig().StaleBad
+	skipNonDefaultPorts := ActiveConfig().SkipNonDefaultPorts
+	crawlSample := ActiveConfig().CrawlSample
+	expireGood := ActiveConfig().ExpireGood
+
+	// Nodes scheduled with Retest go first, whatever their state.
+	retests := m.takeRetests()
+
+	// The snapshot must reflect the attempts of the previous crawl cycle,
+	// so a snapshot of the current nodes is used rather than a recent one.
+	snapshot := m.snapshot(now)
+
+	// Unless sampling, pick nodes from the tried and new tables evenly, so
+	// that neither verifying known nodes nor exploring new addresses is
+	// starved by the other.
+	half := defaultMaxAddresses / 2
+	var tried, untried []*Node
+	for _, node := range snapshot.nodes {
+		if crawlSample == 0 && len(tried) >= half && len(untried) >= half {
 			break
 		}
-		if now.Sub(node.LastSuccess) < defaultStaleTimeout ||
-			now.Sub(node.LastAttempt) < defaultStaleTimeout {
+		if skipNonDefaultPorts && node.Addr.Port != m.network.defaultPort() {
 			continue
 		}
-		addrs = append(addrs, node.Addr)
-		i--
+		if _, ok := retests[nodeKey(node.Addr)]; ok {
+			continue
+		}
+		if !node.needsCrawl(now, accelerate, staleGood, staleBad, expireGood) {
+			continue
+		}
+		if node.tried {
+			tried = append(tried, node)
+		} else {
+			untried = append(untried, node)
+		}
 	}
-	m.mtx.RUnlock()
 
+	var stale []*Node
+	if crawlSample > 0 {
+		stale = sampleNodes(append(tried, untried...), crawlSample, now, expireGood, m.rng)
+	} else {
+		stale = balanceTables(tried, untried, defaultMaxAddresses)
+	}
+
+	addrs := make([]*appmessage.NetAddress, 0, len(retests)+len(stale))
+	for _, addr := range retests {
+		addrs = append(addrs, addr)
+	}
+	for _, node := range stale {
+		addrs = append(addrs, node.Addr)
+	}
 	return addrs
 }
 
+// needsCrawl returns whether the node should be tested again. See Addresses
+// for the meaning of accelerate.
+func (n *Node) needsCrawl(now time.Time, accelerate bool, staleGood, staleBad, expireGood time.Duration) bool {
+	lastAttemptFailed := n.LastAttempt.After(n.LastSuccess)
+	if accelerate && lastAttemptFailed && !n.LastSuccess.IsZero() &&
+		now.Sub(n.LastSuccess) < expireGood {
+
+		return now.Sub(n.LastAttempt) >= recoveryRetryInterval
+	}
+	if (!lastAttemptFailed && now.Sub(n.LastSuccess) < staleGood) ||
+		(lastAttemptFailed && now.Sub(n.LastAttempt) < staleBad) ||
+		now.Before(n.NextAttempt) {
+		return false
+	}
+	return true
+}
+
+// sampleNodes returns a random sample of ratio of the passed nodes. Nodes
+// that were last good long ago, and are thus close to expiring after
+// expireGood, are more likely to be picked.
+func sampleNodes(nodes []*Node, ratio float64, now time.Time, expireGood time.Duration,
+	rng *lockedRand) []*Node {
+
+	count := int(math.Ceil(float64(len(nodes)) * ratio))
+	if count >= len(nodes) {
+		return nodes
+	}
+
+	// Weighted sampling without replacement: every node gets a random key
+	// of u^(1/weight), and the nodes with the highest keys are picked.
+	keys := make(map[*Node]float64, len(nodes))
+	for _, node := range nodes {
+		weight := 1.0
+		if !node.LastSuccess.IsZero() {
+			expiry := float64(now.Sub(node.LastSuccess)) / float64(expireGood)
+			weight += sampleExpiryWeight * math.Min(expiry, 1)
+		}
+		keys[node] = math.Pow(rng.Float64(), 1/weight)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return keys[nodes[i]] > keys[nodes[j]]
+	})
+	return nodes[:count]
+}
+
 // AddressCount returns number of known nodes.
 func (m *Manager) AddressCount() int {
 	return len(m.nodes)
 }
 
+// GoodAddressCount returns the number of known nodes that are good enough
+// to be served. Nodes beyond the configured maximum per network group are
+// not counted, so that a single provider cannot make the network look
+// healthy.
+func (m *Manager) GoodAddressCount() int {
+	criteria := m.activeServingCriteria()
+	groups := newGroupCap(ActiveConfig().MaxPerNetGroup)
+	count := 0
+
+	m.mtx.RLock()
+	for _, node := range m.nodes {
+		if !node.isServable(criteria) {
+			continue
+		}
+		group := netGroup(node.Addr.IP)
+		if groups.allows(group) {
+			groups.add(group)
+			count++
+		}
+	}
+	m.mtx.RUnlock()
+
+	return count
+}
+
 // GoodAddresses returns good working IPs that match both the
-// passed DNS query type and have the requested services.
+// passed DNS query type and have the requested services. If
+// defaultPortOnly is set, only nodes listening on the network's default port
+// are returned, since plain A and AAAA records cannot carry a port. Answers
+// are picked from the precomputed answer sets, see answerCache, so the
+// returned slice is shared and must not be modified.
 func (m *Manager) GoodAddresses(qtype uint16, includeAllSubnetworks bool, subnetworkID *externalapi.DomainSubnetworkID,
-) []*appmessage.NetAddress {
-	addrs := make([]*appmessage.NetAddress, 0, defaultMaxAddresses)
-	i := defaultMaxAddresses
+	defaultPortOnly bool) []*appmessage.NetAddress {
 
 	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	key := answerPoolKey{qtype: qtype, defaultPortOnly: defaultPortOnly, allSubnetworks: includeAllSubnetworks}
+	if !includeAllSubnetworks && subnetworkID != nil {
+		key.hasSubnetwork = true
+		key.subnetwork = *subnetworkID
+	}
+	sets := m.answerPools().sets[key]
+	if len(sets) == 0 {
+		return nil
+	}
+	return sets[m.rng.Intn(len(sets))]
+}
+
+// IsServed returns whether ip is the address of a node in the answer pools,
+// which GoodAddresses picks its answers from.
+func (m *Manager) IsServed(ip net.IP) bool {
+	_, ok := m.answerPools().ips[ip.String()]
+	return ok
+}
+
+// pickAnswer returns up to defaultMaxAddresses addresses of candidates,
+// limiting the number of nodes from any single network group and autonomous
+// system. Unless preferLowLatency is set, in which case candidates must be
+// sorted by latency, the nodes are picked at random, weighted by
+// their answerWeight if weighted is set. It may reorder candidates.
+func (m *Manager) pickAnswer(candidates []*Node, preferLowLatency, weighted bool) []*appmessage.NetAddress {
+	addrs := make([]*appmessage.NetAddress, 0, defaultMaxAddresses)
+	if len(candidates) == 0 {
 		return addrs
 	}
 
-	now := time.Now()
-	m.mtx.RLock()
-	for _, node := range m.nodes {
-		if i == 0 {
-			break
+	// Limit the number of nodes from any single network group and
+	// autonomous system, so no single provider dominates the answer.
+	netGroups := newGroupCap(ActiveConfig().MaxPerNetGroup)
+	asns := newGroupCap(ActiveConfig().MaxPerASN)
+	diverse := func(node *Node) bool {
+		group, asn := netGroup(node.Addr.IP), node.asnGroup()
+		if !netGroups.allows(group) || !asns.allows(asn) {
+			return false
 		}
+		netGroups.add(group)
+		asns.add(asn)
+		return true
+	}
 
-		if node.Addr.Port != uint16(peersDefaultPort) {
-			continue
+	// Start at a random node so that the answer sets differ, unless the
+	// order of candidates is already random or must be kept.
+	start := 0
+	if weighted && !preferLowLatency {
+		m.weightedShuffle(candidates)
+	} else if !preferLowLatency {
+		start = m.rng.Intn(len(candidates))
+	}
+	for i := range candidates {
+		if len(addrs) == defaultMaxAddresses {
+			break
 		}
-
-		if !includeAllSubnetworks && !node.SubnetworkID.Equal(subnetworkID) {
-			continue
+		node := candidates[(start+i)%len(candidates)]
+		if diverse(node) {
+			addrs = append(addrs, node.Addr)
 		}
+	}
+	// Answers are shared, so appending to one must not write to its
+	// backing array.
+	return addrs[:len(addrs):len(addrs)]
+}
 
-		if qtype == dns.TypeA && node.Addr.IP.To4() == nil {
-			continue
-		} else if qtype == dns.TypeAAAA && node.Addr.IP.To4() != nil {
-			continue
-		}
+// weightedShuffle orders nodes at random, each node being the more likely to
+// come first the higher its answerWeight, so that taking a prefix of them is
+// weighted sampling without replacement.
+func (m *Manager) weightedShuffle(nodes []*Node) {
+	keys := make(map[*Node]float64, len(nodes))
+	for _, node := range nodes {
+		keys[node] = math.Pow(m.rng.Float64(), 1/node.answerWeight())
+	}
+	sort.Slice(nodes, func(i, j int) bool { return keys[nodes[i]] > keys[nodes[j]] })
+}
 
-		if node.LastSuccess.IsZero() ||
-			now.Sub(node.LastSuccess) > defaultStaleTimeout {
-			continue
+// Attempt updates the last connection attempt for the specified address to
+// now. It must be called before connecting to the address, and followed by
+// either Good, Bad or BadHandshake once the attempt is over.
+func (m *Manager) Attempt(addr *appmessage.NetAddress) {
+	m.mtx.Lock()
+	key := nodeKey(addr)
+	if _, exists := m.nodes[key]; exists {
+		node := m.updateNode(key)
+		node.LastAttempt = m.clock.Now()
+		m.setAttempting(node, true)
+	}
+	m.mtx.Unlock()
+}
+
+// Good updates the last successful connection attempt for the specified address to now
+func (m *Manager) Good(addr *appmessage.NetAddress, subnetworkid *externalapi.DomainSubnetworkID) {
+	m.mtx.Lock()
+	key := nodeKey(addr)
+	if _, exists := m.nodes[key]; exists {
+		node := m.updateNode(key)
+		now := m.clock.Now()
+		m.setAttempting(node, false)
+		m.makeTried(key, node)
+		m.setSubnetwork(key, node, subnetworkid)
+		if node.LastSuccess.IsZero() {
+			m.creditSource(node, true)
+		}
+		node.LastSuccess = now
+		node.Reliability.update(true, now)
+		if node.Successes == 0 {
+			node.StreakStart = now
 		}
+		node.Successes++
+		node.Failures = 0
+		node.NextAttempt = time.Time{}
+		node.HandshakeFailures = 0
+		node.LastFailure = ""
+		node.boostQuality()
+		m.notifyObservers(func(observer ManagerObserver) { observer.NodeGood(node.Addr) })
+		if ActiveConfig().MultiPort == multiPortVerified {
+			m.dropOtherPorts(key, node)
+		}
+	}
+	m.mtx.Unlock()
+}
 
-		addrs = append(addrs, node.Addr)
-		i--
+// RecordLatency adds dial, handshake and ping latency samples of a successful
+// connection to the specified address to the node's moving averages. A zero
+// pingLatency means the node was not probed.
+func (m *Manager) RecordLatency(addr *appmessage.NetAddress, dialLatency, handshakeLatency, pingLatency time.Duration) {
+	m.mtx.Lock()
+	key := nodeKey(addr)
+	if _, exists := m.nodes[key]; exists {
+		node := m.updateNode(key)
+		node.DialLatency = movingAverage(node.DialLatency, dialLatency)
+		node.HandshakeLatency = movingAverage(node.HandshakeLatency, handshakeLatency)
+		if pingLatency > 0 {
+			node.PingLatency = movingAverage(node.PingLatency, pingLatency)
+		}
 	}
-	m.mtx.RUnlock()
+	m.mtx.Unlock()
+}
 
-	return addrs
+// movingAverage returns average updated with sample. A zero average means
+// no samples were taken yet.
+func movingAverage(average, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(float64(average)*(1-latencySampleWeight) + float64(sample)*latencySampleWeight)
 }
 
-// Attempt updates the last connection attempt for the specified ip address to now
-func (m *Manager) Attempt(ip net.IP) {
+// Bad records a failed connection attempt to the specified address and
+// schedules its next attempt with exponential backoff
+func (m *Manager) Bad(addr *appmessage.NetAddress, reason FailureReason) {
 	m.mtx.Lock()
-	node, exists := m.nodes[ip.String()]
-	if exists {
-		node.LastAttempt = time.Now()
+	key := nodeKey(addr)
+	if _, exists := m.nodes[key]; exists {
+		node := m.updateNode(key)
+		m.setAttempting(node, false)
+		node.recordFailure(reason, m.clock.Now())
+		m.demoteIfPoor(key, node)
+		m.notifyObservers(func(observer ManagerObserver) { observer.NodeBad(node.Addr, reason) })
 	}
 	m.mtx.Unlock()
 }
 
-// Good updates the last successful connection attempt for the specified ip address to now
-func (m *Manager) Good(ip net.IP, subnetworkid *externalapi.DomainSubnetworkID) {
+// BadHandshake records a failed handshake with the specified address.
+// Nodes that repeatedly fail the handshake are banned.
+func (m *Manager) BadHandshake(addr *appmessage.NetAddress, reason FailureReason) {
 	m.mtx.Lock()
-	node, exists := m.nodes[ip.String()]
-	if exists {
-		node.LastSuccess = time.Now()
-		node.SubnetworkID = subnetworkid
+	key := nodeKey(addr)
+	if _, exists := m.nodes[key]; exists {
+		node := m.updateNode(key)
+		m.setAttempting(node, false)
+		node.recordFailure(reason, m.clock.Now())
+		m.demoteIfPoor(key, node)
+		m.notifyObservers(func(observer ManagerObserver) { observer.NodeBad(node.Addr, reason) })
+		node.HandshakeFailures++
+		if node.HandshakeFailures >= banHandshakeFailures {
+			m.ban(addr.IP, "repeatedly failed handshakes")
+		}
 	}
 	m.mtx.Unlock()
 }
 
+// recordFailure marks a connection attempt to the node that failed at now
+// for the given reason and schedules its next attempt with exponential
+// backoff.
+func (n *Node) recordFailure(reason FailureReason, now time.Time) {
+	n.Failures++
+	n.Successes = 0
+	n.StreakStart = time.Time{}
+	n.LastFailure = reason
+	if n.FailureCounts == nil {
+		n.FailureCounts = make(map[FailureReason]int)
+	}
+	n.FailureCounts[reason]++
+	n.NextAttempt = now.Add(retryBackoff(n.Failures, ActiveConfig().StaleBad))
+	n.Reliability.update(false, now)
+	n.decayQuality()
+}
+
+// retryBackoff returns how long to wait before retrying a node that failed
+// the given number of consecutive connection attempts. The wait starts at
+// minBackoff and doubles with each consecutive failure up to maxRetryBackoff.
+func retryBackoff(failures int, minBackoff time.Duration) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
 // addressHandler is the main handler for the address manager. It must be run
 // as a goroutine.
-func (m *Manager) addressHandler() {
+func (m *Manager) addressHandler(ctx context.Context) {
 	defer m.wg.Done()
 	pruneAddressTicker := time.NewTicker(pruneAddressInterval)
 	defer pruneAddressTicker.Stop()
-	dumpAddressTicker := time.NewTicker(dumpAddressInterval)
+	dumpAddressTicker := time.NewTicker(ActiveConfig().DumpInterval)
 	defer dumpAddressTicker.Stop()
+	answerCacheTicker := time.NewTicker(answerCacheRefreshInterval)
+	defer answerCacheTicker.Stop()
+	// A nil channel never fires, so no samples are taken if no history is
+	// kept.
+	var historyTickerC <-chan time.Time
+	if m.history != nil {
+		historyTicker := time.NewTicker(ActiveConfig().HistoryInterval)
+		defer historyTicker.Stop()
+		historyTickerC = historyTicker.C
+	}
 out:
 	for {
 		select {
 		case <-dumpAddressTicker.C:
-			m.savePeers()
+			m.saveState()
 		case <-pruneAddressTicker.C:
 			m.prunePeers()
-		case <-m.quit:
+			m.pruneBans()
+			m.pruneSources()
+			m.reloadIPLists()
+		case <-historyTickerC:
+			m.recordSizeSample()
+		case <-answerCacheTicker.C:
+			m.refreshAnswerPools()
+		case <-ctx.Done():
 			break out
 		}
 	}
 	log.Infof("Address manager: saving peers")
-	m.savePeers()
+	m.saveState()
+	err := m.store.close()
+	if err != nil {
+		log.Errorf("Failed to close the address book: %v", err)
+	}
+	if m.history != nil {
+		err = m.history.close()
+		if err != nil {
+			log.Errorf("Failed to close the network size history: %v", err)
+		}
+	}
 	log.Infof("Address manager shoutdown")
 }
 
+// expireNode removes the node with the given key, which expired, from the
+// address book and remembers it as dead. If it was never reached despite
+// attempts, the peer that advertised it is debited. It must be called with
+// the manager lock held for writes.
+func (m *Manager) expireNode(key string, node *Node) {
+	if node.LastSuccess.IsZero() && !node.LastAttempt.IsZero() {
+		m.creditSource(node, false)
+	}
+	m.deadAddrs.add(key)
+	m.removeNode(key)
+}
+
 func (m *Manager) prunePeers() {
 	var count int
-	now := time.Now()
+	now := m.clock.Now()
+	expireNew := ActiveConfig().ExpireNew
+	expireGood := ActiveConfig().ExpireGood
+	maxFailures := ActiveConfig().MaxFailures
+	minQuality := ActiveConfig().MinQuality
+	criteria := m.activeServingCriteria()
 	m.mtx.Lock()
+	m.deadAddrs.rotate(now)
 	for k, node := range m.nodes {
-		if now.Sub(node.LastSeen) > pruneExpireTimeout {
-			delete(m.nodes, k)
+		if node.expired(now, expireNew, expireGood, maxFailures, minQuality) {
+			m.expireNode(k, node)
 			count++
-			continue
 		}
-		if !node.LastSuccess.IsZero() &&
-			now.Sub(node.LastSuccess) > pruneExpireTimeout {
-			delete(m.nodes, k)
-			count++
-			continue
+	}
+	m.pruneGossip()
+	// The address book can exceed the limit if it was lowered since the
+	// address book was saved.
+	maxNodes := ActiveConfig().MaxNodes
+	for maxNodes != 0 && len(m.nodes) > maxNodes && m.makeRoom(maxNodes) {
+		count++
+	}
+	good := 0
+	for _, node := range m.nodes {
+		if node.isServable(criteria) {
+			good++
 		}
 	}
+	m.setGoodGauge(good)
 	l := len(m.nodes)
 	m.mtx.Unlock()
 
 	log.Infof("Pruned %d addresses: %d remaining", count, l)
 }
 
-func (m *Manager) deserializePeers() error {
-	filePath := m.peersFile
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return nil
+// expired returns whether the node should be removed from the address book.
+// Nodes that were never good expire expireNew after they were last
+// advertised, and nodes that were good expire expireGood after they were last
+// good. If maxFailures is not zero, nodes also expire after that many
+// consecutive failed connection attempts, and nodes whose quality fell below
+// minQuality expire as well.
+func (n *Node) expired(now time.Time, expireNew, expireGood time.Duration, maxFailures int,
+	minQuality float64) bool {
+
+	if maxFailures != 0 && n.Failures >= maxFailures {
+		return true
 	}
-	r, err := os.Open(filePath)
-	if err != nil {
-		return errors.Errorf("%s error opening file: %v", filePath, err)
+	if n.Quality < minQuality {
+		return true
 	}
-	defer r.Close()
+	if n.LastSuccess.IsZero() {
+		return now.Sub(n.LastSeen) > expireNew
+	}
+	return now.Sub(n.LastSuccess) > expireGood
+}
 
-	var nodes map[string]*Node
-	dec := json.NewDecoder(r)
-	err = dec.Decode(&nodes)
+func (m *Manager) deserializePeers() error {
+	nodes, err := m.store.load()
 	if err != nil {
-		return errors.Errorf("error reading %s: %v", filePath, err)
+		return err
 	}
 
-	l := len(nodes)
-
+	// Re-key the loaded nodes, since older peers files keyed them by IP
+	// only, and rebuild the tables. Nodes that were ever good go to the
+	// tried table, unless they were demoted since.
 	m.mtx.Lock()
-	m.nodes = nodes
+	for _, node := range nodes {
+		if node == nil || node.Addr == nil {
+			continue
+		}
+		key := nodeKey(node.Addr)
+		if _, exists := m.nodes[key]; exists || m.blacklist.contains(node.Addr.IP) || m.isBanned(node.Addr.IP) {
+			continue
+		}
+		m.tagNode(node)
+		m.insertNew(key, node)
+		if !node.LastSuccess.IsZero() && node.Quality >= qualityDemoteThreshold {
+			m.makeTried(key, node)
+		}
+	}
+	l := len(m.nodes)
 	m.mtx.Unlock()
 
 	log.Infof("%d nodes loaded", l)
 	return nil
 }
 
+// saveState saves the address book, the bans and the crawl state, unless the
+// manager is ephemeral.
+func (m *Manager) saveState() {
+	if m.ephemeral {
+		return
+	}
+	m.savePeers()
+	m.saveBans()
+	m.saveCrawlState()
+}
+
 func (m *Manager) savePeers() {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	// Write temporary peers file and then move it into place.
-	tmpfile := m.peersFile + ".new"
+	err := m.store.save(m.nodes)
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// writeJSONFile encodes v as JSON into a temporary file and then moves it
+// into place at filePath, so that a crash never leaves a partially written
+// file behind. Both the file and the rename are synced to disk before it
+// returns.
+func writeJSONFile(filePath string, v interface{}, compress bool) error {
+	tmpfile := filePath + ".new"
 	w, err := os.Create(tmpfile)
 	if err != nil {
-		log.Errorf("Error opening file %s: %v", tmpfile, err)
-		return
+		return errors.Errorf("Error opening file %s: %v", tmpfile, err)
 	}
-	enc := json.NewEncoder(w)
-	if err := enc.Encode(&m.nodes); err != nil {
-		log.Errorf("Failed to encode file %s: %v", tmpfile, err)
-		return
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(v); err != nil {
+		w.Close()
+		return errors.Errorf("Failed to encode file %s: %v", tmpfile, err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			w.Close()
+			return errors.Errorf("Failed to compress file %s: %v", tmpfile, err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return errors.Errorf("Failed to sync file %s: %v", tmpfile, err)
 	}
 	if err := w.Close(); err != nil {
-		log.Errorf("Error closing file %s: %v", tmpfile, err)
-		return
+		return errors.Errorf("Error closing file %s: %v", tmpfile, err)
 	}
-	if err := os.Rename(tmpfile, m.peersFile); err != nil {
-		log.Errorf("Error writing file %s: %v", m.peersFile, err)
-		return
+	if err := os.Rename(tmpfile, filePath); err != nil {
+		return errors.Errorf("Error writing file %s: %v", filePath, err)
+	}
+	if err := syncDir(filepath.Dir(filePath)); err != nil {
+		return errors.Errorf("Failed to sync directory of file %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// syncDir flushes the entries of the directory at path to disk, so that
+// files renamed into it survive a crash. Directories cannot be synced on
+// Windows, where it does nothing.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
 	}
+	return err
 }
@@ -0,0 +1,995 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/config"
+	"github.com/kaspanet/kaspad/util/mstime"
+	"github.com/miekg/dns"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	const minBackoff = time.Hour
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: minBackoff},
+		{failures: 2, expected: 2 * minBackoff},
+		{failures: 3, expected: 4 * minBackoff},
+		{failures: 100, expected: maxRetryBackoff},
+	}
+
+	for _, test := range tests {
+		backoff := retryBackoff(test.failures, minBackoff)
+		if backoff != test.expected {
+			t.Errorf("retryBackoff(%d): expected %s but got %s", test.failures, test.expected, backoff)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip           string
+		allowPrivate bool
+		expected     bool
+	}{
+		{ip: "8.8.8.8", expected: true},
+		{ip: "2a01:4f8::1", expected: true},
+		{ip: "0.0.0.0", expected: false},
+		{ip: "224.0.0.1", expected: false},
+		{ip: "169.254.1.1", expected: false},
+		{ip: "192.0.2.1", expected: false},
+		{ip: "198.51.100.1", expected: false},
+		{ip: "203.0.113.1", expected: false},
+		{ip: "2001:db8::1", expected: false},
+		{ip: "fe80::1", expected: false},
+		{ip: "ff02::1", expected: false},
+		{ip: "10.0.0.1", expected: false},
+		{ip: "10.0.0.1", allowPrivate: true, expected: true},
+		{ip: "192.168.1.1", allowPrivate: true, expected: true},
+		{ip: "127.0.0.1", expected: false},
+		{ip: "127.0.0.1", allowPrivate: true, expected: true},
+		{ip: "fd00::1", allowPrivate: true, expected: true},
+		{ip: "192.0.2.1", allowPrivate: true, expected: false},
+	}
+
+	for _, test := range tests {
+		result := isPublicIP(net.ParseIP(test.ip), test.allowPrivate)
+		if result != test.expected {
+			t.Errorf("isPublicIP(%s, %t): expected %t but got %t", test.ip, test.allowPrivate, test.expected, result)
+		}
+	}
+}
+
+func TestNetGroup(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"1.2.3.4", "1.2.0.0"},
+		{"::ffff:1.2.3.4", "1.2.0.0"},
+		{"2002:102:304::1", "1.2.0.0"},
+		{"2001:0:4136:e378:8000:63bf:fefd:fcfb", "1.2.0.0"},
+		{"64:ff9b::102:304", "1.2.0.0"},
+		{"2001:470:1f0b:1::1", "2001:470:1000::"},
+		{"2a01:4f8:1::1", "2a01:4f8::"},
+	}
+	for _, test := range tests {
+		if group := netGroup(net.ParseIP(test.ip)); group != test.expected {
+			t.Errorf("expected the group of %s to be %s but got %s", test.ip, test.expected, group)
+		}
+	}
+}
+
+func TestSanitizeTimestamp(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		expected  time.Time
+		ok        bool
+	}{
+		{name: "recent", timestamp: now.Add(-time.Hour), expected: now.Add(-time.Hour), ok: true},
+		{name: "slightly in the future", timestamp: now.Add(time.Minute), expected: now.Add(time.Minute), ok: true},
+		{name: "far in the future", timestamp: now.Add(24 * time.Hour), expected: now, ok: true},
+		{name: "too old", timestamp: now.Add(-maxAddressAge - time.Hour), ok: false},
+		{name: "unset", timestamp: time.Unix(0, 0), ok: false},
+	}
+
+	for _, test := range tests {
+		timestamp, ok := sanitizeTimestamp(mstime.ToMSTime(test.timestamp), now)
+		if ok != test.ok {
+			t.Errorf("%s: expected ok to be %t but got %t", test.name, test.ok, ok)
+			continue
+		}
+		if ok && !timestamp.ToNativeTime().Equal(test.expected) {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expected, timestamp.ToNativeTime())
+		}
+	}
+}
+
+func TestDecodePeers(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expectedIPs []string
+		expectErr   bool
+	}{
+		{
+			name:        "unversioned",
+			data:        `{"1.2.3.4": {"Addr": {"IP": "1.2.3.4", "Port": 16111}}}`,
+			expectedIPs: []string{"1.2.3.4"},
+		},
+		{
+			name:        "version 1",
+			data:        `{"Version": 1, "Nodes": {"1.2.3.4:16111": {"Addr": {"IP": "1.2.3.4", "Port": 16111}}}}`,
+			expectedIPs: []string{"1.2.3.4"},
+		},
+		{
+			name:        "version 2",
+			data:        `{"Version": 2, "Nodes": {"1.2.3.4:16111": {"Addr": {"IP": "1.2.3.4", "Port": 16111}, "Quality": 0.5}}}`,
+			expectedIPs: []string{"1.2.3.4"},
+		},
+		{
+			name:      "future version",
+			data:      `{"Version": 1000, "Nodes": {}}`,
+			expectErr: true,
+		},
+		{
+			name:      "corrupt",
+			data:      `{"Version": 1, "Nodes": {`,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		nodes, err := decodePeers([]byte(test.data))
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if len(nodes) != len(test.expectedIPs) {
+			t.Errorf("%s: expected %d nodes but got %d", test.name, len(test.expectedIPs), len(nodes))
+			continue
+		}
+		for _, node := range nodes {
+			found := false
+			for _, ip := range test.expectedIPs {
+				if node.Addr.IP.Equal(net.ParseIP(ip)) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: unexpected node %s", test.name, node.Addr.IP)
+			}
+		}
+	}
+}
+
+// newTestManager returns a manager holding no nodes, with the default
+// configuration and a fake clock.
+func newTestManager(t *testing.T) (*Manager, *fakeClock) {
+	useDefaultConfig(t)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	m := &Manager{
+		nodes: make(map[string]*Node),
+		bans:  make(map[string]*Ban),
+		clock: clock,
+	}
+	return m, clock
+}
+
+func TestNewBucketEviction(t *testing.T) {
+	m, _ := newTestManager(t)
+	start := time.Now()
+
+	// All addresses share a network group and a source, so they all land
+	// in the same new bucket.
+	var keys []string
+	for i := 0; i <= bucketSize; i++ {
+		addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, byte(i/256), byte(i%256)).To4(), 16111)
+		key := nodeKey(addr)
+		keys = append(keys, key)
+		m.insertNew(key, &Node{Addr: addr, LastSeen: start.Add(time.Duration(i) * time.Second), SourceGroup: "3.4.0.0"})
+	}
+
+	if len(m.nodes) != bucketSize {
+		t.Fatalf("expected %d nodes but got %d", bucketSize, len(m.nodes))
+	}
+	if _, exists := m.nodes[keys[0]]; exists {
+		t.Errorf("expected the least recently seen node %s to be evicted", keys[0])
+	}
+
+	node := m.nodes[keys[1]]
+	m.makeTried(keys[1], node)
+	if !node.tried {
+		t.Errorf("expected node %s to be tried", keys[1])
+	}
+	if len(m.nodes) != bucketSize {
+		t.Errorf("expected %d nodes after promotion but got %d", bucketSize, len(m.nodes))
+	}
+	for _, b := range m.newTable {
+		if _, exists := b[keys[1]]; exists {
+			t.Errorf("expected node %s to be removed from the new table", keys[1])
+		}
+	}
+}
+
+func TestMakeRoom(t *testing.T) {
+	m, _ := newTestManager(t)
+	now := time.Now()
+
+	nodes := []*Node{
+		{LastSeen: now, LastSuccess: now},
+		{LastSeen: now.Add(-time.Hour)},
+		{LastSeen: now, Failures: 2},
+	}
+	var keys []string
+	for i, node := range nodes {
+		node.Addr = appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, byte(i)).To4(), 16111)
+		key := nodeKey(node.Addr)
+		keys = append(keys, key)
+		m.insertNew(key, node)
+	}
+	m.makeTried(keys[0], nodes[0])
+
+	if !m.makeRoom(4) || len(m.nodes) != 3 {
+		t.Fatalf("expected room without eviction below the limit")
+	}
+	for _, expectedKey := range []string{keys[2], keys[1]} {
+		if !m.makeRoom(len(m.nodes)) {
+			t.Fatalf("expected room to be made")
+		}
+		if _, exists := m.nodes[expectedKey]; exists {
+			t.Errorf("expected node %s to be evicted", expectedKey)
+		}
+	}
+	if m.makeRoom(len(m.nodes)) {
+		t.Errorf("expected the tried node not to be evicted")
+	}
+}
+
+func TestMakeRoomDiversity(t *testing.T) {
+	m, _ := newTestManager(t)
+	now := time.Now()
+
+	// Three nodes share a network group, and the least recently seen node
+	// is alone in its own.
+	ips := []net.IP{net.IPv4(1, 2, 0, 1), net.IPv4(1, 2, 0, 2), net.IPv4(1, 2, 0, 3), net.IPv4(5, 6, 0, 1)}
+	var keys []string
+	for i, ip := range ips {
+		node := &Node{Addr: appmessage.NewNetAddressIPPort(ip.To4(), 16111), LastSeen: now}
+		if i == len(ips)-1 {
+			node.LastSeen = now.Add(-time.Hour)
+		}
+		key := nodeKey(node.Addr)
+		keys = append(keys, key)
+		m.insertNew(key, node)
+	}
+
+	if !m.makeRoom(len(m.nodes)) {
+		t.Fatalf("expected room to be made")
+	}
+	if _, exists := m.nodes[keys[len(keys)-1]]; !exists {
+		t.Errorf("expected the only node of its network group to be kept")
+	}
+	if m.netGroupCounts["1.2.0.0"] != 2 || m.netGroupCounts["5.6.0.0"] != 1 {
+		t.Errorf("unexpected network group counts %v", m.netGroupCounts)
+	}
+}
+
+func TestMultiPortPolicy(t *testing.T) {
+	peersDefaultPort = 16111
+	ip := net.IPv4(1, 2, 3, 4).To4()
+	otherPort := appmessage.NewNetAddressIPPort(ip, 16112)
+	defaultPort := appmessage.NewNetAddressIPPort(ip, uint16(peersDefaultPort))
+	newManager := func(policy string) *Manager {
+		m, _ := newTestManager(t)
+		activeConfig.NetworkFlags = config.NetworkFlags{Devnet: true}
+		err := activeConfig.NetworkFlags.ResolveNetwork(nil)
+		if err != nil {
+			t.Fatalf("ResolveNetwork: %s", err)
+		}
+		activeConfig.MultiPort = policy
+		m.blacklist = &ipRangeList{}
+		return m
+	}
+
+	m := newManager(multiPortAll)
+	m.AddAddresses([]*appmessage.NetAddress{otherPort, defaultPort})
+	if len(m.nodes) != 2 {
+		t.Errorf("expected all ports to be kept but got %d nodes", len(m.nodes))
+	}
+
+	m = newManager(multiPortDefault)
+	m.AddAddresses([]*appmessage.NetAddress{otherPort, defaultPort})
+	m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, 16113)})
+	if _, exists := m.nodes[nodeKey(defaultPort)]; !exists || len(m.nodes) != 1 {
+		t.Errorf("expected only the default port to be kept but got %d nodes", len(m.nodes))
+	}
+
+	m = newManager(multiPortVerified)
+	m.AddAddresses([]*appmessage.NetAddress{otherPort, defaultPort})
+	m.Good(otherPort, nil)
+	if _, exists := m.nodes[nodeKey(otherPort)]; !exists || len(m.nodes) != 1 {
+		t.Errorf("expected only the verified port to be kept but got %d nodes", len(m.nodes))
+	}
+}
+
+func TestGossipScoring(t *testing.T) {
+	m, _ := newTestManager(t)
+	activeConfig.NetworkFlags = config.NetworkFlags{Devnet: true}
+	err := activeConfig.NetworkFlags.ResolveNetwork(nil)
+	if err != nil {
+		t.Fatalf("ResolveNetwork: %s", err)
+	}
+	m.sources = make(map[string]*addrSource)
+	m.blacklist = &ipRangeList{}
+	source := appmessage.NewNetAddressIPPort(net.IPv4(9, 9, 9, 9).To4(), 16111)
+
+	var addrs []*appmessage.NetAddress
+	for i := 0; i < minGossipSample; i++ {
+		addrs = append(addrs, appmessage.NewNetAddressIPPort(net.IPv4(1, 2, byte(i), 1).To4(), 16111))
+	}
+	evicted := appmessage.NewNetAddressIPPort(net.IPv4(1, 3, 0, 1).To4(), 16111)
+	m.AddAddressesFromPeer(source, append(addrs, evicted))
+	m.Good(addrs[0], nil)
+	m.mtx.Lock()
+	// Removing nodes for other reasons than expiry, such as eviction,
+	// doesn't debit their source.
+	m.nodes[nodeKey(evicted)].LastAttempt = m.clock.Now()
+	m.removeNode(nodeKey(evicted))
+	for _, addr := range addrs[1:] {
+		node := m.nodes[nodeKey(addr)]
+		node.LastAttempt = m.clock.Now()
+		m.expireNode(nodeKey(addr), node)
+	}
+	m.mtx.Unlock()
+
+	record := m.gossip[source.IP.String()]
+	if record == nil || record.reached != 1 || record.unreached != minGossipSample-1 {
+		t.Fatalf("unexpected gossip record %+v", record)
+	}
+	if ratio, judged := record.reachRatio(); !judged || ratio >= gossipPenaltyRatio {
+		t.Fatalf("expected the source to be judged below the penalty ratio but got %f", ratio)
+	}
+	if m.IsBanned(source.IP) {
+		t.Errorf("expected a penalized source not to be banned")
+	}
+
+	record.unreached = minGossipSample * 100
+	m.AddAddressesFromPeer(source, addrs[:1])
+	if !m.IsBanned(source.IP) {
+		t.Errorf("expected a source of mostly unreachable addresses to be banned")
+	}
+
+	// The records of peers that left the address book are dropped.
+	m.gossip[source.IP.String()] = &gossipRecord{}
+	m.gossip[addrs[0].IP.String()] = &gossipRecord{}
+	m.mtx.Lock()
+	m.pruneGossip()
+	m.mtx.Unlock()
+	if _, exists := m.gossip[source.IP.String()]; exists || m.gossip[addrs[0].IP.String()] == nil {
+		t.Errorf("expected only the records of peers in the address book to be kept but got %v", m.gossip)
+	}
+}
+
+func TestSubnetworkIndex(t *testing.T) {
+	m, _ := newTestManager(t)
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	node := &Node{Addr: addr}
+	m.insertNew(key, node)
+	if _, exists := m.subnetworks[""][key]; !exists {
+		t.Fatalf("expected a node of an unknown subnetwork to be indexed under the empty key")
+	}
+
+	subnetworkID := &externalapi.DomainSubnetworkID{1}
+	m.setSubnetwork(key, node, subnetworkID)
+	if _, exists := m.subnetworks[""]; exists {
+		t.Errorf("expected the node to be removed from the unknown subnetwork index")
+	}
+	if _, exists := m.subnetworks[subnetworkKey(subnetworkID)][key]; !exists {
+		t.Errorf("expected the node to be indexed under its subnetwork")
+	}
+
+	m.removeNode(key)
+	if len(m.subnetworks) != 0 {
+		t.Errorf("expected the index to be empty after removing the node")
+	}
+}
+
+func TestDemoteIfPoor(t *testing.T) {
+	m, _ := newTestManager(t)
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	node := &Node{Addr: addr, Quality: initialQuality}
+	m.insertNew(key, node)
+	m.makeTried(key, node)
+
+	for i := 1; i <= 3; i++ {
+		node.decayQuality()
+		m.demoteIfPoor(key, node)
+		expectedTried := node.Quality >= qualityDemoteThreshold
+		if node.tried != expectedTried {
+			t.Fatalf("after %d failures with quality %f: expected tried to be %t", i, node.Quality, expectedTried)
+		}
+	}
+	if node.tried {
+		t.Fatalf("expected the node to be demoted")
+	}
+	if _, exists := m.nodes[key]; !exists {
+		t.Errorf("expected the demoted node to remain in the address book")
+	}
+
+	node.boostQuality()
+	node.boostQuality()
+	node.boostQuality()
+	if node.Quality != initialQuality {
+		t.Errorf("expected the quality to recover to %f but got %f", initialQuality, node.Quality)
+	}
+}
+
+func TestMinSuccesses(t *testing.T) {
+	m, clock := newTestManager(t)
+	activeConfig.MinSuccesses = 2
+	activeConfig.MinSuccessSpan = time.Hour
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	m.insertNew(key, &Node{Addr: addr, Quality: initialQuality})
+
+	servable := func() bool {
+		return m.nodes[key].isServable(m.activeServingCriteria())
+	}
+	m.Good(addr, nil)
+	if servable() {
+		t.Errorf("expected a node with a single success not to be servable")
+	}
+	clock.advance(time.Hour)
+	m.Good(addr, nil)
+	if !servable() {
+		t.Errorf("expected a node with two successes an hour apart to be servable")
+	}
+	m.Bad(addr, FailureTimeout)
+	clock.advance(time.Hour)
+	m.Good(addr, nil)
+	if servable() {
+		t.Errorf("expected a failure to restart the streak")
+	}
+}
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestExpiryWithFakeClock(t *testing.T) {
+	m, clock := newTestManager(t)
+
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	m.insertNew(key, &Node{Addr: addr, LastSeen: clock.Now(), Quality: initialQuality})
+
+	clock.advance(activeConfig.ExpireNew - time.Minute)
+	m.prunePeers()
+	if _, exists := m.nodes[key]; !exists {
+		t.Fatalf("expected the node not to expire before %s", activeConfig.ExpireNew)
+	}
+	clock.advance(2 * time.Minute)
+	m.prunePeers()
+	if _, exists := m.nodes[key]; exists {
+		t.Fatalf("expected the node to expire after %s", activeConfig.ExpireNew)
+	}
+
+	bannedIP := net.IPv4(5, 6, 7, 8)
+	for _, port := range []uint16{16111, 16112} {
+		addr := appmessage.NewNetAddressIPPort(bannedIP.To4(), port)
+		m.insertNew(nodeKey(addr), &Node{Addr: addr, LastSeen: clock.Now(), Quality: initialQuality})
+	}
+	m.Ban(bannedIP, "test")
+	if len(m.nodes) != 0 {
+		t.Fatalf("expected the nodes of the banned address to be removed on all ports, %d left", len(m.nodes))
+	}
+	clock.advance(activeConfig.BanDuration - time.Minute)
+	if !m.IsBanned(bannedIP) {
+		t.Fatalf("expected the ban to last %s", activeConfig.BanDuration)
+	}
+	clock.advance(2 * time.Minute)
+	if m.IsBanned(bannedIP) {
+		t.Fatalf("expected the ban to expire after %s", activeConfig.BanDuration)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	const plain = `{"Version":1,"Nodes":{}}`
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(plain))
+	gz.Close()
+
+	for _, data := range [][]byte{[]byte(plain), buf.Bytes()} {
+		decompressed, err := decompress(data)
+		if err != nil {
+			t.Fatalf("decompress: %v", err)
+		}
+		if string(decompressed) != plain {
+			t.Errorf("expected %s but got %s", plain, decompressed)
+		}
+	}
+}
+
+func TestNodeMigrations(t *testing.T) {
+	if len(nodeMigrations) != addressBookVersion-1 {
+		t.Fatalf("expected %d node migrations for address book version %d but got %d",
+			addressBookVersion-1, addressBookVersion, len(nodeMigrations))
+	}
+
+	data := []byte(`{"Addr": {"IP": "1.2.3.4", "Port": 16111}}`)
+	node, err := decodeNode(data, 1)
+	if err != nil {
+		t.Fatalf("decodeNode: %v", err)
+	}
+	if node.Quality != initialQuality {
+		t.Errorf("expected a version 1 node to be migrated to quality %f but got %f", initialQuality, node.Quality)
+	}
+
+	node, err = decodeNode([]byte(`{"Addr": {"IP": "1.2.3.4", "Port": 16111}, "Quality": 0.5}`), addressBookVersion)
+	if err != nil {
+		t.Fatalf("decodeNode: %v", err)
+	}
+	if node.Quality != 0.5 {
+		t.Errorf("expected a current node to keep its quality but got %f", node.Quality)
+	}
+
+	data = []byte(`{"Addr": {"IP": "1.2.3.4", "Port": 16111}, "Failures": 0, "LastSuccess": "2023-01-01T00:00:00Z"}`)
+	node, err = decodeNode(data, 2)
+	if err != nil {
+		t.Fatalf("decodeNode: %v", err)
+	}
+	if node.Successes != 1 || !node.StreakStart.Equal(node.LastSuccess) {
+		t.Errorf("expected a good version 2 node to be migrated to a streak of one success but got %d since %s",
+			node.Successes, node.StreakStart)
+	}
+
+	node, err = decodeNode([]byte("null"), 1)
+	if err != nil || node != nil {
+		t.Errorf("expected null to decode to nil but got %v, %v", node, err)
+	}
+}
+
+// recordingObserver records the transitions it is notified of.
+type recordingObserver struct {
+	transitions []string
+}
+
+func (o *recordingObserver) NodeAdded(addr *appmessage.NetAddress) {
+	o.transitions = append(o.transitions, "added "+nodeKey(addr))
+}
+
+func (o *recordingObserver) NodeGood(addr *appmessage.NetAddress) {
+	o.transitions = append(o.transitions, "good "+nodeKey(addr))
+}
+
+func (o *recordingObserver) NodeBad(addr *appmessage.NetAddress, reason FailureReason) {
+	o.transitions = append(o.transitions, "bad "+nodeKey(addr)+" "+string(reason))
+}
+
+func (o *recordingObserver) NodeRemoved(addr *appmessage.NetAddress) {
+	o.transitions = append(o.transitions, "removed "+nodeKey(addr))
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	m, clock := newTestManager(t)
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	m.insertNew(key, &Node{Addr: addr, Quality: initialQuality})
+
+	snapshot := m.snapshot(clock.Now())
+	published := snapshot.nodes[0]
+	clock.advance(time.Minute)
+	if m.snapshot(clock.Now()) != snapshot {
+		t.Errorf("expected the snapshot to be kept while no node changed")
+	}
+
+	m.Attempt(addr)
+	m.Bad(addr, FailureTimeout)
+	if !published.LastAttempt.IsZero() || published.Failures != 0 || published.FailureCounts != nil {
+		t.Errorf("expected the published node not to be modified but got %+v", published)
+	}
+	node := m.nodes[key]
+	if node == published || node.Failures != 1 {
+		t.Fatalf("expected the node to be replaced by an updated copy")
+	}
+	if m.newTable[m.newBucket(node)][key] != node || m.ips["1.2.3.4"][key] != node || m.subnetworks[""][key] != node {
+		t.Errorf("expected the tables and indexes to hold the updated node")
+	}
+	if s := m.snapshot(clock.Now()); s == snapshot || s.nodes[0] != node {
+		t.Errorf("expected a new snapshot holding the updated node")
+	}
+}
+
+func TestManagerObserver(t *testing.T) {
+	m, _ := newTestManager(t)
+	observer := &recordingObserver{}
+	m.AddObserver(observer)
+
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	m.insertNew(key, &Node{Addr: addr, Quality: initialQuality})
+	m.Good(addr, nil)
+	m.Bad(addr, FailureTimeout)
+	m.mtx.Lock()
+	m.removeNode(key)
+	m.mtx.Unlock()
+
+	expected := []string{
+		"good " + key,
+		"bad " + key + " " + string(FailureTimeout),
+		"removed " + key,
+	}
+	if len(observer.transitions) != len(expected) {
+		t.Fatalf("expected transitions %v but got %v", expected, observer.transitions)
+	}
+	for i := range expected {
+		if observer.transitions[i] != expected[i] {
+			t.Errorf("expected transition %d to be %s but got %s", i, expected[i], observer.transitions[i])
+		}
+	}
+}
+
+func TestRetest(t *testing.T) {
+	m, _ := newTestManager(t)
+	m.retests = make(map[string]struct{})
+	m.retestRequested = make(chan struct{}, 1)
+
+	var keys []string
+	for _, port := range []uint16{16111, 16112} {
+		addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), port)
+		keys = append(keys, nodeKey(addr))
+		m.insertNew(nodeKey(addr), &Node{Addr: addr, Quality: initialQuality})
+	}
+	other := appmessage.NewNetAddressIPPort(net.IPv4(5, 6, 7, 8).To4(), 16111)
+	m.insertNew(nodeKey(other), &Node{Addr: other, Quality: initialQuality})
+
+	if count := m.Retest(net.ParseIP("9.9.9.9")); count != 0 {
+		t.Errorf("expected no nodes to be scheduled for an unknown IP but got %d", count)
+	}
+	select {
+	case <-m.RetestRequested():
+		t.Errorf("expected no signal when no nodes were scheduled")
+	default:
+	}
+
+	// net.ParseIP returns the 16-byte form, which must match the 4-byte
+	// addresses of the nodes.
+	if count := m.Retest(net.ParseIP("1.2.3.4")); count != 2 {
+		t.Fatalf("expected 2 nodes to be scheduled but got %d", count)
+	}
+	if count := m.Retest(net.ParseIP("1.2.3.4")); count != 2 {
+		t.Fatalf("expected 2 nodes to be scheduled again but got %d", count)
+	}
+	select {
+	case <-m.RetestRequested():
+	default:
+		t.Fatalf("expected a signal after nodes were scheduled")
+	}
+
+	m.mtx.Lock()
+	m.removeNode(keys[1])
+	m.mtx.Unlock()
+
+	addrs := m.takeRetests()
+	if len(addrs) != 1 || addrs[keys[0]] == nil {
+		t.Errorf("expected only %s to be returned but got %v", keys[0], addrs)
+	}
+	if addrs := m.takeRetests(); len(addrs) != 0 {
+		t.Errorf("expected the retests to be cleared but got %v", addrs)
+	}
+}
+
+func TestSampleNodesSeeded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var nodes []*Node
+	for i := 0; i < 100; i++ {
+		nodes = append(nodes, &Node{LastSuccess: now.Add(-time.Duration(i) * time.Minute)})
+	}
+
+	sample := func(seed int64) []*Node {
+		return sampleNodes(append([]*Node(nil), nodes...), 0.1, now, 8*time.Hour, newLockedRand(seed))
+	}
+	first, second := sample(1), sample(1)
+	if len(first) != 10 {
+		t.Fatalf("expected 10 sampled nodes but got %d", len(first))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected samples with the same seed to be identical")
+		}
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	m, _ := newTestManager(t)
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	key := nodeKey(addr)
+	m.insertNew(key, &Node{Addr: addr, Quality: initialQuality})
+
+	m.RecordLatency(addr, 10*time.Millisecond, 200*time.Millisecond, 0)
+	node := m.nodes[key]
+	if node.PingLatency != 0 || node.latency() != 200*time.Millisecond {
+		t.Errorf("expected the handshake latency to be used until the node is probed but got %s",
+			node.latency())
+	}
+
+	m.RecordLatency(addr, 10*time.Millisecond, 200*time.Millisecond, 50*time.Millisecond)
+	node = m.nodes[key]
+	if node.PingLatency != 50*time.Millisecond || node.latency() != 50*time.Millisecond {
+		t.Errorf("expected the ping latency to be used once the node is probed but got %s",
+			node.latency())
+	}
+
+	// A connection without a probe leaves the ping latency alone.
+	m.RecordLatency(addr, 10*time.Millisecond, 200*time.Millisecond, 0)
+	if node := m.nodes[key]; node.PingLatency != 50*time.Millisecond {
+		t.Errorf("expected the ping latency to be kept but got %s", node.PingLatency)
+	}
+
+	exports := m.ExportNodes()
+	if len(exports) != 1 || exports[0].PingLatency != 50*time.Millisecond {
+		t.Errorf("expected the ping latency to be exported but got %+v", exports)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	m := &Manager{rng: newLockedRand(1)}
+	reliable := &Node{HandshakeLatency: 100 * time.Millisecond}
+	reliable.Reliability.Stat1D.Reliability = 0.95
+	slow := &Node{HandshakeLatency: 5 * time.Second}
+	slow.Reliability.Stat1D.Reliability = 0.95
+	unproven := &Node{}
+
+	firsts := make(map[*Node]int)
+	for i := 0; i < 1000; i++ {
+		nodes := []*Node{unproven, slow, reliable}
+		m.weightedShuffle(nodes)
+		firsts[nodes[0]]++
+	}
+	if firsts[reliable] < 700 {
+		t.Errorf("expected the reliable node to come first most of the time but got %d/1000", firsts[reliable])
+	}
+	if firsts[slow] == 0 || firsts[unproven] == 0 {
+		t.Errorf("expected every node to come first sometimes but got %d and %d/1000",
+			firsts[slow], firsts[unproven])
+	}
+}
+
+func TestAnswerCache(t *testing.T) {
+	m, clock := newTestManager(t)
+	m.rng = newLockedRand(1)
+	m.whitelist = &ipRangeList{}
+	m.answers = newAnswerCache()
+	peersDefaultPort = 16111
+	now := clock.Now()
+	subnetworkID := &externalapi.DomainSubnetworkID{1}
+	addGood := func(ip net.IP, subnetworkID *externalapi.DomainSubnetworkID) *Node {
+		addr := appmessage.NewNetAddressIPPort(ip, uint16(peersDefaultPort))
+		node := &Node{Addr: addr, SubnetworkID: subnetworkID, LastSuccess: now, Successes: 1, StreakStart: now}
+		node.Reliability.update(true, now)
+		m.nodes[nodeKey(addr)] = node
+		return node
+	}
+	addGood(net.IPv4(1, 2, 3, 4), nil)
+	addGood(net.IPv4(5, 6, 7, 8), subnetworkID)
+	addGood(net.ParseIP("2001:db8::1"), subnetworkID)
+
+	tests := []struct {
+		qtype          uint16
+		allSubnetworks bool
+		subnetworkID   *externalapi.DomainSubnetworkID
+		expected       int
+	}{
+		{dns.TypeA, true, nil, 2},
+		{dns.TypeAAAA, true, nil, 1},
+		{dns.TypeA, false, nil, 1},
+		{dns.TypeA, false, subnetworkID, 1},
+		{dns.TypeAAAA, false, nil, 0},
+		{dns.TypeNS, true, nil, 0},
+	}
+	for i, test := range tests {
+		addrs := m.GoodAddresses(test.qtype, test.allSubnetworks, test.subnetworkID, true)
+		if len(addrs) != test.expected {
+			t.Errorf("test %d: expected %d addresses but got %d", i, test.expected, len(addrs))
+		}
+	}
+	if !m.IsServed(net.ParseIP("2001:db8::1")) || m.IsServed(net.IPv4(9, 10, 11, 12)) {
+		t.Errorf("expected exactly the nodes in the answer pools to be served")
+	}
+
+	// Rebuilding the answers doesn't update them unless their nodes
+	// changed.
+	if !m.LastUpdate().Equal(now) {
+		t.Errorf("expected the answers to be updated at %s but got %s", now, m.LastUpdate())
+	}
+	m.answers.NodeGood(nil)
+	clock.now = now.Add(snapshotMaxAge / 2)
+	m.refreshAnswerPools()
+	if !m.LastUpdate().Equal(now) {
+		t.Errorf("expected answers rebuilt from the same nodes not to be updated but got %s", m.LastUpdate())
+	}
+
+	// Answers come from the cache until it is refreshed after a change.
+	addGood(net.IPv4(9, 10, 11, 12), nil)
+	if addrs := m.GoodAddresses(dns.TypeA, true, nil, true); len(addrs) != 2 {
+		t.Errorf("expected the cached 2 addresses but got %d", len(addrs))
+	}
+	m.answers.NodeGood(nil)
+	clock.now = now.Add(2 * snapshotMaxAge)
+	m.refreshAnswerPools()
+	addrs := m.GoodAddresses(dns.TypeA, true, nil, true)
+	if len(addrs) != 3 {
+		t.Errorf("expected 3 addresses after the refresh but got %d", len(addrs))
+	}
+	if !m.LastUpdate().Equal(clock.now) {
+		t.Errorf("expected the answers to be updated at %s but got %s", clock.now, m.LastUpdate())
+	}
+
+	// Appending to an answer must not change the cached ones.
+	_ = append(addrs, appmessage.NewNetAddressIPPort(net.IPv4(13, 14, 15, 16), 16111))
+	for i := 0; i < answerSetsPerPool; i++ {
+		for _, addr := range m.GoodAddresses(dns.TypeA, true, nil, true) {
+			if addr.IP.Equal(net.IPv4(13, 14, 15, 16)) {
+				t.Fatalf("expected cached answers not to be modified")
+			}
+		}
+	}
+}
+
+func TestChurnTracker(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 23, 0, 0, 0, time.UTC)}
+	tracker := newChurnTracker(clock)
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+
+	tracker.NodeAdded(addr)
+	tracker.NodeGood(addr)
+	tracker.NodeGood(addr)
+	tracker.NodeBad(addr, FailureTimeout)
+	clock.advance(2 * time.Hour)
+	tracker.NodeGood(addr)
+	tracker.NodeRemoved(addr)
+
+	expected := []ChurnDay{
+		{Date: "2023-01-01", Joins: 1, Flaps: 1},
+		{Date: "2023-01-02", Departures: 1, Flaps: 1},
+	}
+	report := tracker.report()
+	if len(report) != len(expected) {
+		t.Fatalf("expected %d days but got %d", len(expected), len(report))
+	}
+	for i := range expected {
+		if report[i] != expected[i] {
+			t.Errorf("expected day %d to be %+v but got %+v", i, expected[i], report[i])
+		}
+	}
+
+	for i := 0; i < churnReportDays; i++ {
+		clock.advance(24 * time.Hour)
+		tracker.NodeAdded(addr)
+	}
+	if len(tracker.report()) != churnReportDays {
+		t.Errorf("expected the report to be capped at %d days", churnReportDays)
+	}
+}
+
+func TestSizeHistory(t *testing.T) {
+	m, clock := newTestManager(t)
+	history, err := openSizeHistory(filepath.Join(t.TempDir(), historyDirname))
+	if err != nil {
+		t.Fatalf("openSizeHistory: %v", err)
+	}
+	defer history.close()
+	m.history = history
+
+	addr := appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111)
+	m.insertNew(nodeKey(addr), &Node{Addr: addr, Quality: initialQuality})
+
+	start := clock.Now()
+	for i := 0; i < 3; i++ {
+		m.recordSizeSample()
+		clock.advance(time.Hour)
+	}
+
+	samples, err := m.SizeHistory(start.Add(time.Hour), clock.Now())
+	if err != nil {
+		t.Fatalf("SizeHistory: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples but got %d", len(samples))
+	}
+	if !samples[0].Time.Equal(start.Add(time.Hour)) || samples[0].Known != 1 || samples[0].Subnetworks[""].Known != 1 {
+		t.Errorf("unexpected sample %+v", samples[0])
+	}
+
+	// Samples older than the retention are removed when recording.
+	activeConfig.HistoryRetention = time.Hour
+	m.recordSizeSample()
+	samples, err = m.SizeHistory(start, clock.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("SizeHistory: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Errorf("expected 2 samples within the retention but got %d", len(samples))
+	}
+}
+
+func TestGauges(t *testing.T) {
+	m, _ := newTestManager(t)
+	addrs := []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 2, 3, 4).To4(), 16111),
+		appmessage.NewNetAddressIPPort(net.IPv4(5, 6, 7, 8).To4(), 16111),
+	}
+	for _, addr := range addrs {
+		m.insertNew(nodeKey(addr), &Node{Addr: addr, Quality: initialQuality})
+		m.Attempt(addr)
+	}
+	if gauges := m.Gauges(); gauges.Known != 2 || gauges.InFlight != 2 {
+		t.Errorf("unexpected gauges %+v", gauges)
+	}
+
+	m.Good(addrs[0], nil)
+	m.Ban(addrs[1].IP, "test")
+	m.snapshot(m.clock.Now())
+	expected := Gauges{Known: 1, Good: 1, Banned: 1, InFlight: 0}
+	if gauges := m.Gauges(); gauges != expected {
+		t.Errorf("expected gauges %+v but got %+v", expected, gauges)
+	}
+}
+
+func TestDeadAddressFilter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	filter := newDeadAddressFilter([]byte("key"), now)
+	filter.add("1.2.3.4:16111")
+	if !filter.contains("1.2.3.4:16111") {
+		t.Fatalf("expected an added address to be contained")
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.contains(net.JoinHostPort(net.IPv4(5, 6, byte(i>>8), byte(i)).String(), "16111")) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 10 {
+		t.Errorf("expected few false positives but got %d", falsePositives)
+	}
+
+	filter.rotate(now.Add(deadFilterRotation))
+	if !filter.contains("1.2.3.4:16111") {
+		t.Errorf("expected the address to be remembered for another rotation")
+	}
+	filter.rotate(now.Add(2 * deadFilterRotation))
+	if filter.contains("1.2.3.4:16111") {
+		t.Errorf("expected the address to be forgotten after two rotations")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// addressBookVersion is the version of the node encoding written by this
+// version of the seeder, which all storage backends record along with the
+// nodes. Version 1 is the first versioned encoding.
+const addressBookVersion = 3
+
+// nodeMigration upgrades the JSON fields of a single node by one version.
+type nodeMigration func(fields map[string]json.RawMessage) error
+
+// nodeMigrations holds, at index i, the migration of nodes from version i+1
+// to version i+2. Adding a Node field whose zero value is wrong for existing
+// nodes takes a new migration here and a bump of addressBookVersion, so that
+// existing address books are upgraded rather than discarded.
+var nodeMigrations = []nodeMigration{
+	migrateNodeV1ToV2,
+	migrateNodeV2ToV3,
+}
+
+// migrateNodeV1ToV2 gives nodes saved before nodes had a quality the initial
+// quality.
+func migrateNodeV1ToV2(fields map[string]json.RawMessage) error {
+	if _, ok := fields["Quality"]; ok {
+		return nil
+	}
+	quality, err := json.Marshal(initialQuality)
+	if err != nil {
+		return err
+	}
+	fields["Quality"] = quality
+	return nil
+}
+
+// migrateNodeV2ToV3 counts the last connection attempt of nodes saved before
+// consecutive successes were counted as a streak of one success, if it
+// succeeded, so that they are not withheld until they are crawled again.
+func migrateNodeV2ToV3(fields map[string]json.RawMessage) error {
+	if _, ok := fields["Successes"]; ok {
+		return nil
+	}
+	var failures int
+	var lastSuccess time.Time
+	if raw, ok := fields["Failures"]; ok {
+		err := json.Unmarshal(raw, &failures)
+		if err != nil {
+			return err
+		}
+	}
+	if raw, ok := fields["LastSuccess"]; ok {
+		err := json.Unmarshal(raw, &lastSuccess)
+		if err != nil {
+			return err
+		}
+	}
+	if failures != 0 || lastSuccess.IsZero() {
+		return nil
+	}
+
+	successes, err := json.Marshal(1)
+	if err != nil {
+		return err
+	}
+	streakStart, err := json.Marshal(lastSuccess)
+	if err != nil {
+		return err
+	}
+	fields["Successes"] = successes
+	fields["StreakStart"] = streakStart
+	return nil
+}
+
+// decodeNode decodes a node encoded by the given address book version, and
+// migrates it to the current version. A null encoding decodes to nil.
+func decodeNode(data []byte, version int) (*Node, error) {
+	if version < 1 || version > addressBookVersion {
+		return nil, errors.Errorf("unsupported version %d, the latest supported version is %d",
+			version, addressBookVersion)
+	}
+
+	if version < addressBookVersion {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(data, &fields)
+		if err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			return nil, nil
+		}
+		for v := version; v < addressBookVersion; v++ {
+			err := nodeMigrations[v-1](fields)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to migrate from version %d", v)
+			}
+		}
+		data, err = json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var node *Node
+	err := json.Unmarshal(data, &node)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB
+// file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSectionSeparator is the size of the zero filled gap between the
+// search tree and the data section.
+const mmdbDataSectionSeparator = 16
+
+// mmdbMaxDepth is the maximum nesting of maps, arrays and pointers in a
+// decoded value. It keeps a malformed file, such as one whose pointers form
+// a loop, from exhausting the stack.
+const mmdbMaxDepth = 32
+
+// Data field types of the MaxMind DB format.
+const (
+	mmdbTypeExtended  = 0
+	mmdbTypePointer   = 1
+	mmdbTypeString    = 2
+	mmdbTypeDouble    = 3
+	mmdbTypeBytes     = 4
+	mmdbTypeUint16    = 5
+	mmdbTypeUint32    = 6
+	mmdbTypeMap       = 7
+	mmdbTypeInt32     = 8
+	mmdbTypeUint64    = 9
+	mmdbTypeUint128   = 10
+	mmdbTypeArray     = 11
+	mmdbTypeContainer = 12
+	mmdbTypeEnd       = 13
+	mmdbTypeBool      = 14
+	mmdbTypeFloat     = 15
+)
+
+// mmdbReader looks up IP addresses in a MaxMind DB file, such as the
+// GeoLite2 ASN and country databases. The whole file is held in memory.
+//
+// Decoded values are map[string]interface{}, []interface{}, string, []byte,
+// float64, uint64 (for all unsigned types, uint128 excluded), int64 or bool.
+type mmdbReader struct {
+	buf        []byte
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	ipv4Start  uint64
+}
+
+// openMMDB reads the MaxMind DB file at path.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("%s error opening file: %v", path, err)
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, errors.Errorf("error reading %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// newMMDBReader returns a reader of the MaxMind DB held in buf.
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	markerIndex := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if markerIndex < 0 {
+		return nil, errors.New("metadata marker not found")
+	}
+	metadataSection := buf[markerIndex+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDBValue(metadataSection, 0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid metadata")
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	r := &mmdbReader{buf: buf}
+	for key, field := range map[string]*uint64{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		value, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, errors.Errorf("metadata field %s is missing", key)
+		}
+		*field = value
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSectionSeparator > uint64(markerIndex) {
+		return nil, errors.New("search tree exceeds the file")
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+mmdbDataSectionSeparator : markerIndex]
+
+	// IPv4 addresses are stored in IPv6 databases as IPv4-compatible
+	// addresses, so their lookups start 96 zero bits down the tree.
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start, err = r.readRecord(r.ipv4Start, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of the search
+// tree node with the given number.
+func (r *mmdbReader) readRecord(node uint64, bit uint) (uint64, error) {
+	nodeSize := r.recordSize / 4
+	offset := node * nodeSize
+	if offset+nodeSize > uint64(len(r.tree)) {
+		return 0, errors.Errorf("node %d exceeds the search tree", node)
+	}
+	b := r.tree[offset : offset+nodeSize]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6]), nil
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// lookup returns the record of ip, and false if the database holds none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, bool, error) {
+	addr := ip.To4()
+	node := uint64(0)
+	if addr == nil {
+		if r.ipVersion == 4 {
+			return nil, false, nil
+		}
+		addr = ip.To16()
+	} else if r.ipVersion == 6 {
+		node = r.ipv4Start
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		var err error
+		node, err = r.readRecord(node, bit)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if node <= r.nodeCount {
+		return nil, false, nil
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	if offset >= uint64(len(r.data)) {
+		return nil, false, errors.Errorf("record of %s exceeds the data section", ip)
+	}
+	value, _, err := decodeMMDBValue(r.data, int(offset), 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// decodeMMDBValue decodes the value at offset in section, and returns it along
+// with the offset following it. Pointers are resolved relative to section.
+// depth is the nesting of the value within the value being decoded.
+func decodeMMDBValue(section []byte, offset int, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.Errorf("value at offset %d is nested too deeply", offset)
+	}
+	if offset >= len(section) {
+		return nil, 0, errors.Errorf("offset %d exceeds the section", offset)
+	}
+	ctrl := section[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == mmdbTypePointer {
+		size := int(ctrl>>3) & 0x3
+		if offset+size+1 > len(section) {
+			return nil, 0, errors.New("pointer exceeds the section")
+		}
+		b := section[offset : offset+size+1]
+		var pointer int
+		switch size {
+		case 0:
+			pointer = int(ctrl&0x7)<<8 | int(b[0])
+		case 1:
+			pointer = (int(ctrl&0x7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			pointer = (int(ctrl&0x7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			pointer = int(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := decodeMMDBValue(section, pointer, depth+1)
+		return value, offset + size + 1, err
+	}
+
+	if typ == mmdbTypeExtended {
+		if offset >= len(section) {
+			return nil, 0, errors.New("extended type exceeds the section")
+		}
+		typ = 7 + int(section[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > len(section) {
+			return nil, 0, errors.New("size exceeds the section")
+		}
+		b := section[offset : offset+extra]
+		switch extra {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+		offset += extra
+	}
+
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := decodeMMDBValue(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, next, err := decodeMMDBValue(section, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := decodeMMDBValue(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeContainer, mmdbTypeEnd:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(section) {
+		return nil, 0, errors.Errorf("value of type %d exceeds the section", typ)
+	}
+	b := section[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errors.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errors.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, offset, nil
+	case mmdbTypeInt32:
+		var value uint32
+		for _, c := range b {
+			value = value<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(value)), offset, nil
+		}
+		return int64(value), offset, nil
+	default:
+		return nil, 0, errors.Errorf("unknown data type %d", typ)
+	}
+}
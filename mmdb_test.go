@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// mmdbString encodes a string of up to 284 bytes in the MaxMind DB data
+// format.
+func mmdbString(s string) []byte {
+	if len(s) < 29 {
+		return append([]byte{byte(mmdbTypeString<<5 | len(s))}, s...)
+	}
+	return append([]byte{mmdbTypeString<<5 | 29, byte(len(s) - 29)}, s...)
+}
+
+func TestMMDBLookup(t *testing.T) {
+	// An IPv4 database with a single search tree node, mapping 0.0.0.0/1 to
+	// a record and leaving 128.0.0.0/1 empty.
+	var buf []byte
+	buf = append(buf, 0, 0, 17, 0, 0, 1)
+	buf = append(buf, make([]byte, mmdbDataSectionSeparator)...)
+	buf = append(buf, mmdbTypeMap<<5|2)
+	buf = append(buf, mmdbString("autonomous_system_number")...)
+	buf = append(buf, mmdbTypeUint32<<5|2, 0x34, 0x17)
+	buf = append(buf, mmdbString("autonomous_system_organization")...)
+	buf = append(buf, mmdbString("Example")...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbTypeMap<<5|3)
+	buf = append(buf, mmdbString("node_count")...)
+	buf = append(buf, mmdbTypeUint32<<5|1, 1)
+	buf = append(buf, mmdbString("record_size")...)
+	buf = append(buf, mmdbTypeUint16<<5|1, 24)
+	buf = append(buf, mmdbString("ip_version")...)
+	buf = append(buf, mmdbTypeUint16<<5|1, 4)
+
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		t.Fatalf("newMMDBReader: %s", err)
+	}
+
+	record, ok, err := r.lookup(net.ParseIP("1.2.3.4"))
+	if err != nil || !ok {
+		t.Fatalf("lookup(1.2.3.4): expected a record, got ok=%t err=%v", ok, err)
+	}
+	fields, _ := record.(map[string]interface{})
+	if asn, _ := fields["autonomous_system_number"].(uint64); asn != 13335 {
+		t.Errorf("lookup(1.2.3.4): expected ASN 13335 but got %v", fields["autonomous_system_number"])
+	}
+	if org, _ := fields["autonomous_system_organization"].(string); org != "Example" {
+		t.Errorf("lookup(1.2.3.4): expected organization Example but got %v", fields["autonomous_system_organization"])
+	}
+
+	_, ok, err = r.lookup(net.ParseIP("200.2.3.4"))
+	if err != nil || ok {
+		t.Errorf("lookup(200.2.3.4): expected no record, got ok=%t err=%v", ok, err)
+	}
+
+	_, ok, err = r.lookup(net.ParseIP("2001:db8::1"))
+	if err != nil || ok {
+		t.Errorf("lookup(2001:db8::1): expected no record in an IPv4 database, got ok=%t err=%v", ok, err)
+	}
+}
+
+func TestMMDBPointerLoop(t *testing.T) {
+	// A pointer to itself, followed by a map holding a pointer to the map.
+	section := []byte{mmdbTypePointer << 5, 0, mmdbTypeMap<<5 | 1}
+	section = append(section, mmdbString("a")...)
+	section = append(section, mmdbTypePointer<<5, 2)
+
+	_, _, err := decodeMMDBValue(section, 0, 0)
+	if err == nil {
+		t.Errorf("expected an error decoding a pointer to itself")
+	}
+	_, _, err = decodeMMDBValue(section, 2, 0)
+	if err == nil {
+		t.Errorf("expected an error decoding a map that contains itself")
+	}
+}
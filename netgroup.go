@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPv6 ranges that need special handling when grouping.
+var (
+	// sixToFourNet (6to4, RFC 3056) embeds the IPv4 address of the tunnel
+	// endpoint in bits 16-47.
+	sixToFourNet = mustParseCIDR("2002::/16")
+
+	// teredoNet (RFC 4380) embeds the IPv4 address of the client,
+	// inverted, in the last 32 bits.
+	teredoNet = mustParseCIDR("2001::/32")
+
+	// nat64Net (RFC 6052) embeds an IPv4 address in the last 32 bits.
+	nat64Net = mustParseCIDR("64:ff9b::/96")
+
+	// heTunnelNet is the range of Hurricane Electric's tunnel broker, whose
+	// /32 holds the tunnels of many unrelated users. Its addresses are
+	// grouped by /36 instead.
+	heTunnelNet = mustParseCIDR("2001:470::/32")
+)
+
+// heTunnelGroupBits is the prefix length addresses in heTunnelNet are grouped
+// by.
+const heTunnelGroupBits = 36
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// netGroup returns the network group of ip, which is used to identify
+// addresses likely operated by the same provider. IPv4 addresses are grouped
+// by /16 and IPv6 addresses by /32. IPv6 addresses that tunnel to an IPv4
+// address (6to4, Teredo and NAT64) are grouped with that IPv4 address, and
+// addresses of Hurricane Electric's tunnel broker by /36.
+func netGroup(ip net.IP) string {
+	if ip4 := embeddedIPv4(ip); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	if heTunnelNet.Contains(ip) {
+		return ip.Mask(net.CIDRMask(heTunnelGroupBits, 128)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// embeddedIPv4 returns the IPv4 address ip is or tunnels to, or nil if there
+// is none.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+	switch {
+	case sixToFourNet.Contains(ip):
+		return net.IP(append([]byte(nil), ip[2:6]...))
+	case teredoNet.Contains(ip):
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15]).To4()
+	case nat64Net.Contains(ip):
+		return net.IP(append([]byte(nil), ip[12:16]...))
+	}
+	return nil
+}
+
+// netGroupLimiter spaces out dials to addresses in the same network group.
+type netGroupLimiter struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+// newNetGroupLimiter returns a limiter that allows one dial per network
+// group every interval. An interval of 0 disables limiting.
+func newNetGroupLimiter(interval time.Duration) *netGroupLimiter {
+	return &netGroupLimiter{
+		interval: interval,
+		next:     make(map[string]time.Time),
+	}
+}
+
+// wait blocks until a dial to ip is allowed. It returns false if ctx is
+// canceled while waiting.
+func (l *netGroupLimiter) wait(ctx context.Context, ip net.IP) bool {
+	if l.interval == 0 {
+		return true
+	}
+
+	group := netGroup(ip)
+	now := time.Now()
+
+	l.mtx.Lock()
+	slot := l.next[group]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[group] = slot.Add(l.interval)
+
+	// Forget groups whose slots are all in the past so the map doesn't
+	// grow with every group ever dialed.
+	for g, next := range l.next {
+		if next.Before(now) {
+			delete(l.next, g)
+		}
+	}
+	l.mtx.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// groupCap counts addresses per group, such as network group or autonomous
+// system, up to a maximum per group.
+type groupCap struct {
+	maxPerGroup int
+	counts      map[string]int
+}
+
+// newGroupCap returns a groupCap that allows maxPerGroup addresses per group.
+// A maxPerGroup of 0 disables the cap.
+func newGroupCap(maxPerGroup int) *groupCap {
+	return &groupCap{
+		maxPerGroup: maxPerGroup,
+		counts:      make(map[string]int),
+	}
+}
+
+// allows returns whether another address of group may be added. Addresses
+// of an unknown, empty, group are always allowed.
+func (c *groupCap) allows(group string) bool {
+	return c.maxPerGroup == 0 || group == "" || c.counts[group] < c.maxPerGroup
+}
+
+// add counts an address of group.
+func (c *groupCap) add(group string) {
+	c.counts[group]++
+}
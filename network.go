@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+	"github.com/kaspanet/kaspad/infrastructure/config"
+	"github.com/pkg/errors"
+)
+
+// seederNetwork is a network crawled by an address manager of its own, other
+// than the active network, for serving the zone of another network. A nil
+// *seederNetwork stands for the active network, whose settings are global.
+type seederNetwork struct {
+	flags config.NetworkFlags
+	port  uint16
+	ttl   time.Duration
+}
+
+// seederZone is a zone served for a network other than the active network.
+type seederZone struct {
+	hostname string
+	network  *seederNetwork
+}
+
+// newSeederNetwork returns the network called name, one of mainnet, testnet,
+// simnet and devnet, with the good TTL set for it by goodTTLs.
+func newSeederNetwork(name string, goodTTLs []string) (*seederNetwork, error) {
+	var networkFlags config.NetworkFlags
+	switch name {
+	case "mainnet":
+	case "testnet":
+		networkFlags.Testnet = true
+	case "simnet":
+		networkFlags.Simnet = true
+	case "devnet":
+		networkFlags.Devnet = true
+	default:
+		return nil, errors.Errorf("unknown network %s", name)
+	}
+	err := networkFlags.ResolveNetwork(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(networkFlags.NetParams().DefaultPort, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("invalid default port %s of %s", networkFlags.NetParams().DefaultPort, name)
+	}
+	n := &seederNetwork{flags: networkFlags, port: uint16(port)}
+	n.ttl, err = resolveGoodTTL(goodTTLs, n.name())
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// networkFlags returns the flags selecting the network.
+func (n *seederNetwork) networkFlags() config.NetworkFlags {
+	if n == nil {
+		return ActiveConfig().NetworkFlags
+	}
+	return n.flags
+}
+
+// params returns the parameters of the network.
+func (n *seederNetwork) params() *dagconfig.Params {
+	if n == nil {
+		return ActiveConfig().NetParams()
+	}
+	return n.flags.NetParams()
+}
+
+// name returns the name of the network without the kaspa- prefix.
+func (n *seederNetwork) name() string {
+	return strings.TrimPrefix(n.params().Name, "kaspa-")
+}
+
+// defaultPort returns the port nodes of the network listen on by default.
+func (n *seederNetwork) defaultPort() uint16 {
+	if n == nil {
+		return uint16(peersDefaultPort)
+	}
+	return n.port
+}
+
+// goodTTL returns the good TTL that applies to the network.
+func (n *seederNetwork) goodTTL() time.Duration {
+	if n == nil {
+		return ActiveConfig().goodTTL
+	}
+	return n.ttl
+}
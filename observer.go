@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// ManagerObserver is notified of transitions of the nodes in the address
+// book, so that metrics, event publishers and the like can follow them
+// without the manager knowing about them. Its methods are called with the
+// manager lock held, so they must return quickly and must not call back into
+// the manager.
+type ManagerObserver interface {
+	// NodeAdded is called when a previously unknown address is added.
+	NodeAdded(addr *appmessage.NetAddress)
+
+	// NodeGood is called when a node was successfully crawled.
+	NodeGood(addr *appmessage.NetAddress)
+
+	// NodeBad is called when crawling a node failed for the given reason.
+	NodeBad(addr *appmessage.NetAddress, reason FailureReason)
+
+	// NodeRemoved is called when a node is removed from the address book,
+	// whether it expired, was evicted or was banned.
+	NodeRemoved(addr *appmessage.NetAddress)
+}
+
+// AddObserver registers observer to be notified of node transitions from
+// now on.
+func (m *Manager) AddObserver(observer ManagerObserver) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.observers = append(m.observers, observer)
+}
+
+// notifyObservers calls notify for every registered observer. It must be
+// called with the manager lock held for writes.
+func (m *Manager) notifyObservers(notify func(observer ManagerObserver)) {
+	for _, observer := range m.observers {
+		notify(observer)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/standalone"
+	"github.com/pkg/errors"
+)
+
+// sessionConfig holds the time limits applied to the stages of a crawl
+// session, and how addresses are requested from the peer.
+type sessionConfig struct {
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	getAddrTimeout   time.Duration
+
+	// getAddrRounds is the number of address requests sent to the peer
+	// per session, getAddrInterval apart.
+	getAddrRounds   int
+	getAddrInterval time.Duration
+
+	// livenessProbe is set if peers must answer a ping before they are
+	// considered good.
+	livenessProbe bool
+
+	// halfOpen limits the number of connections of all sessions that are
+	// being established at the same time.
+	halfOpen halfOpenLimiter
+}
+
+// halfOpenLimiter caps the number of connections that have been dialed but
+// have not completed the handshake yet, so that a wave of unreachable
+// addresses cannot exhaust file descriptors.
+type halfOpenLimiter chan struct{}
+
+// newHalfOpenLimiter returns a halfOpenLimiter that allows up to max
+// connections to be established at the same time.
+func newHalfOpenLimiter(max int) halfOpenLimiter {
+	return make(halfOpenLimiter, max)
+}
+
+// acquire blocks until a connection may be established. It returns false if
+// ctx is canceled first.
+func (l halfOpenLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release marks a connection acquired earlier as established or failed, or,
+// for a connection given up on, as no longer pending.
+func (l halfOpenLimiter) release() {
+	<-l
+}
+
+// connectResult is the outcome of a net adapter connection attempt.
+type connectResult struct {
+	routes *standalone.Routes
+	err    error
+}
+
+// peerSession holds the state of a single crawl connection. Every polled
+// address gets its own session, so handshake and address-request outcomes
+// are always attributed to the peer that produced them.
+type peerSession struct {
+	addr        *appmessage.NetAddress
+	peerAddress string
+	routes      *standalone.Routes
+	config      sessionConfig
+
+	// dialed is set once a TCP connection to the peer has been
+	// established, so that failures that happen afterwards can be told
+	// apart from the peer simply being unreachable.
+	dialed bool
+
+	// dialLatency and handshakeLatency are the time it took to establish
+	// the TCP connection and to complete the handshake.
+	dialLatency      time.Duration
+	handshakeLatency time.Duration
+
+	// failure is the reason the last failed operation of the session
+	// failed.
+	failure FailureReason
+}
+
+// newPeerSession returns a new, not yet connected, session for addr.
+func newPeerSession(addr *appmessage.NetAddress, config sessionConfig) *peerSession {
+	return &peerSession{
+		addr:        addr,
+		peerAddress: net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port))),
+		config:      config,
+	}
+}
+
+// connect dials the peer and performs the handshake.
+//
+// TODO: The handshake is performed internally by standalone.MinimalNetAdapter,
+// which does not expose the peer's version message. Until it does, data
+// advertised there (user agent, protocol version, services, subnetwork ID,
+// self-advertised address) cannot be recorded per node. This is the single
+// blocker of every feature that needs that data: filtering served nodes by
+// protocol version, services, user agent or DAG tip, verifying advertised
+// services, crawling a specific subnetwork, tracking subnetwork changes and
+// detecting self-advertised address mismatches. Good is called with a nil
+// subnetwork ID until then.
+func (s *peerSession) connect(ctx context.Context, netAdapter *standalone.MinimalNetAdapter) error {
+	if !s.config.halfOpen.acquire(ctx) {
+		return ctx.Err()
+	}
+	// A connection attempt given up on keeps its slot until the net
+	// adapter gives up on it as well, see disconnectLate.
+	release := true
+	defer func() {
+		if release {
+			s.config.halfOpen.release()
+		}
+	}()
+
+	// Probe the peer with a plain TCP dial first. The net adapter serializes
+	// connection attempts, so unreachable hosts should be weeded out before
+	// they get a chance to hold it up.
+	dialer := net.Dialer{Timeout: s.config.dialTimeout}
+	dialStart := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", s.peerAddress)
+	if err != nil {
+		s.failure = dialFailureReason(err)
+		return errors.Wrapf(err, "could not dial %s", s.peerAddress)
+	}
+	s.dialLatency = time.Since(dialStart)
+	conn.Close()
+	s.dialed = true
+
+	handshakeStart := time.Now()
+	resultChan := make(chan connectResult, 1)
+	spawn("peerSession.connect-netAdapter.Connect", func() {
+		routes, err := netAdapter.Connect(s.peerAddress)
+		resultChan <- connectResult{routes: routes, err: err}
+	})
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			s.failure = FailureHandshake
+			return errors.Wrapf(result.err, "could not connect to %s", s.peerAddress)
+		}
+		s.routes = result.routes
+		s.handshakeLatency = time.Since(handshakeStart)
+		return nil
+	case <-time.After(s.config.handshakeTimeout):
+		release = false
+		s.disconnectLate(resultChan)
+		s.failure = FailureTimeout
+		return errors.Errorf("handshake with %s timed out after %s", s.peerAddress, s.config.handshakeTimeout)
+	case <-ctx.Done():
+		release = false
+		s.disconnectLate(resultChan)
+		return ctx.Err()
+	}
+}
+
+// disconnectLate makes sure that a connection attempt we gave up on does not
+// leave a dangling connection behind if it completes after all, and releases
+// its half-open slot once it is over.
+func (s *peerSession) disconnectLate(resultChan <-chan connectResult) {
+	spawn("peerSession.disconnectLate", func() {
+		result := <-resultChan
+		s.config.halfOpen.release()
+		if result.routes != nil {
+			result.routes.Disconnect()
+		}
+	})
+}
+
+// requestAddresses asks the peer for its known addresses and returns its
+// response.
+func (s *peerSession) requestAddresses() ([]*appmessage.NetAddress, error) {
+	msgRequestAddresses := appmessage.NewMsgRequestAddresses(true, nil)
+	err := s.routes.OutgoingRoute.Enqueue(msgRequestAddresses)
+	if err != nil {
+		s.failure = FailureProtocol
+		return nil, errors.Wrapf(err, "failed to request addresses from %s", s.peerAddress)
+	}
+
+	message, err := s.routes.WaitForMessageOfType(appmessage.CmdAddresses, s.config.getAddrTimeout)
+	if err != nil {
+		s.failure = requestFailureReason(err)
+		return nil, errors.Wrapf(err, "failed to receive addresses from %s", s.peerAddress)
+	}
+	return message.(*appmessage.MsgAddresses).AddressList, nil
+}
+
+// ping sends a ping to the peer and returns the time it took to receive the
+// matching pong. A pong is expected as promptly as a handshake response, so
+// the handshake timeout applies.
+func (s *peerSession) ping() (time.Duration, error) {
+	nonce := rand.Uint64()
+	start := time.Now()
+	err := s.routes.OutgoingRoute.Enqueue(appmessage.NewMsgPing(nonce))
+	if err != nil {
+		s.failure = FailureProtocol
+		return 0, errors.Wrapf(err, "failed to ping %s", s.peerAddress)
+	}
+
+	message, err := s.routes.WaitForMessageOfType(appmessage.CmdPong, s.config.handshakeTimeout)
+	if err != nil {
+		s.failure = requestFailureReason(err)
+		return 0, errors.Wrapf(err, "failed to receive pong from %s", s.peerAddress)
+	}
+	pong := message.(*appmessage.MsgPong)
+	if pong.Nonce != nonce {
+		s.failure = FailureProtocol
+		return 0, errors.Errorf("peer %s answered ping with nonce %d, expected %d",
+			s.peerAddress, pong.Nonce, nonce)
+	}
+	return time.Since(start), nil
+}
+
+// close disconnects the session if it is connected.
+func (s *peerSession) close() {
+	if s.routes != nil {
+		s.routes.Disconnect()
+		s.routes = nil
+	}
+}
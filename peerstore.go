@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// storageJSON and storageLevelDB are the names of the supported
+	// address book storage backends.
+	storageJSON    = "json"
+	storageLevelDB = "leveldb"
+
+	// peersFilename is the name of the file.
+	peersFilename = "nodes.json"
+)
+
+// gzipMagic starts every gzip compressed file.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// peerStore persists the nodes of the address book.
+type peerStore interface {
+	// load returns all persisted nodes.
+	load() (map[string]*Node, error)
+
+	// save persists nodes, replacing all previously persisted ones.
+	save(nodes map[string]*Node) error
+
+	// close releases the resources held by the store.
+	close() error
+}
+
+// newPeerStore returns the storage backend with the given name, keeping its
+// data in dataDir.
+func newPeerStore(storage string, dataDir string) (peerStore, error) {
+	switch storage {
+	case storageJSON:
+		return newJSONPeerStore(filepath.Join(dataDir, peersFilename)), nil
+	case storageLevelDB:
+		return newLevelDBPeerStore(filepath.Join(dataDir, levelDBDirname), filepath.Join(dataDir, peersFilename))
+	default:
+		return nil, errors.Errorf("unknown storage backend %s", storage)
+	}
+}
+
+// memoryPeerStore persists nothing. It backs ephemeral managers.
+type memoryPeerStore struct{}
+
+func (memoryPeerStore) load() (map[string]*Node, error) {
+	return make(map[string]*Node), nil
+}
+
+func (memoryPeerStore) save(nodes map[string]*Node) error {
+	return nil
+}
+
+func (memoryPeerStore) close() error {
+	return nil
+}
+
+// jsonPeerStore keeps all nodes in a single JSON file, which is rewritten
+// as a whole on every save.
+type jsonPeerStore struct {
+	filePath string
+}
+
+// newJSONPeerStore returns a store keeping its nodes in the file at filePath.
+// The configured backups of the file are rotated once here, at startup, so
+// that they hold the files of previous runs rather than those of the last
+// few saves, which are minutes apart.
+func newJSONPeerStore(filePath string) *jsonPeerStore {
+	backups := ActiveConfig().PeersBackups
+	if backups > 0 {
+		err := rotateBackups(filePath, backups)
+		if err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	return &jsonPeerStore{filePath: filePath}
+}
+
+// peersFileContents is the format of the peers file. Files that carry no
+// version hold the nodes map only.
+type peersFileContents struct {
+	Version int
+	Nodes   map[string]*Node
+}
+
+func (s *jsonPeerStore) load() (map[string]*Node, error) {
+	data, err := os.ReadFile(s.filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("%s error opening file: %v", s.filePath, err)
+	}
+
+	data, err = decompress(data)
+	if err != nil {
+		return nil, errors.Errorf("error decompressing %s: %v", s.filePath, err)
+	}
+	nodes, err := decodePeers(data)
+	if err != nil {
+		return nil, errors.Errorf("error reading %s: %v", s.filePath, err)
+	}
+	return nodes, nil
+}
+
+func (s *jsonPeerStore) save(nodes map[string]*Node) error {
+	contents := peersFileContents{
+		Version: addressBookVersion,
+		Nodes:   nodes,
+	}
+	return writeJSONFile(s.filePath, &contents, ActiveConfig().CompressPeers)
+}
+
+func (s *jsonPeerStore) close() error {
+	return nil
+}
+
+// decompress returns data decompressed if it is gzip compressed, and as is
+// otherwise.
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// decodePeers decodes the contents of a peers file of any known version,
+// migrating its nodes to the current version.
+func decodePeers(data []byte) (map[string]*Node, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files written before the format was versioned hold the nodes map
+	// only, with nodes of the first version.
+	version := 1
+	rawNodes := fields
+	if _, ok := fields["Version"]; ok {
+		var contents struct {
+			Version int
+			Nodes   map[string]json.RawMessage
+		}
+		err := json.Unmarshal(data, &contents)
+		if err != nil {
+			return nil, err
+		}
+		version, rawNodes = contents.Version, contents.Nodes
+	}
+	if version < 1 || version > addressBookVersion {
+		return nil, errors.Errorf("unsupported version %d, the latest supported version is %d",
+			version, addressBookVersion)
+	}
+
+	nodes := make(map[string]*Node, len(rawNodes))
+	for key, rawNode := range rawNodes {
+		node, err := decodeNode(rawNode, version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding node %s", key)
+		}
+		nodes[key] = node
+	}
+	return nodes, nil
+}
+
+// rotateBackups keeps up to count backups of the file at filePath, named
+// filePath.1 (the most recent) to filePath.count, and makes the current file
+// the most recent backup. The current file is copied rather than moved, so
+// it stays in place until it is replaced.
+func rotateBackups(filePath string, count int) error {
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	backupPath := func(i int) string {
+		return filePath + "." + strconv.Itoa(i)
+	}
+	for i := count - 1; i >= 1; i-- {
+		err := os.Rename(backupPath(i), backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Errorf("Error rotating backup %s: %v", backupPath(i), err)
+		}
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return errors.Errorf("Error reading file %s: %v", filePath, err)
+	}
+	err = os.WriteFile(backupPath(1), data, 0600)
+	if err != nil {
+		return errors.Errorf("Error backing up %s: %v", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// Policies for IP addresses advertised on several ports.
+const (
+	// multiPortAll keeps a node for every advertised port.
+	multiPortAll = "all"
+
+	// multiPortDefault drops the other ports of an IP address once it is
+	// known on the network's default port, and ignores them from then on.
+	multiPortDefault = "default-port"
+
+	// multiPortVerified keeps only the port an IP address was last crawled
+	// successfully on. Other ports are still added, so that a node that
+	// moved to another port is found again.
+	multiPortVerified = "verified"
+)
+
+// indexIP adds the node to the index of its IP address. It must be called
+// with the manager lock held for writes.
+func (m *Manager) indexIP(key string, node *Node) {
+	if m.ips == nil {
+		m.ips = make(map[string]map[string]*Node)
+	}
+	ip := node.Addr.IP.String()
+	nodes, exists := m.ips[ip]
+	if !exists {
+		nodes = make(map[string]*Node)
+		m.ips[ip] = nodes
+	}
+	nodes[key] = node
+}
+
+// unindexIP removes the node from the index of its IP address. It must be
+// called with the manager lock held for writes.
+func (m *Manager) unindexIP(key string, node *Node) {
+	ip := node.Addr.IP.String()
+	nodes := m.ips[ip]
+	delete(nodes, key)
+	if len(nodes) == 0 {
+		delete(m.ips, ip)
+	}
+}
+
+// admitsPort returns whether addr may be added under the multi-port policy.
+// It must be called with the manager lock held.
+func (m *Manager) admitsPort(addr *appmessage.NetAddress) bool {
+	if ActiveConfig().MultiPort != multiPortDefault || addr.Port == m.network.defaultPort() {
+		return true
+	}
+	defaultAddr := appmessage.NewNetAddressIPPort(addr.IP, m.network.defaultPort())
+	_, exists := m.nodes[nodeKey(defaultAddr)]
+	return !exists
+}
+
+// dropOtherPorts removes the nodes with the IP address of the node with the
+// given key but on other ports. It must be called with the manager lock held
+// for writes.
+func (m *Manager) dropOtherPorts(key string, node *Node) {
+	for otherKey := range m.ips[node.Addr.IP.String()] {
+		if otherKey != key {
+			m.removeNode(otherKey)
+		}
+	}
+}
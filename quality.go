@@ -0,0 +1,42 @@
+package main
+
+const (
+	// initialQuality is the quality of nodes that were not attempted yet.
+	initialQuality = 1.0
+
+	// qualityFailureDecay is the factor the quality of a node is multiplied
+	// by on each failed connection attempt, and qualitySuccessBoost the
+	// amount it grows by, up to initialQuality, on each successful one.
+	qualityFailureDecay = 0.5
+	qualitySuccessBoost = 0.5
+
+	// qualityDemoteThreshold is the quality below which a node is moved
+	// back from the tried table to the new table.
+	qualityDemoteThreshold = 0.25
+)
+
+// decayQuality lowers the quality of the node after a failed connection
+// attempt.
+func (n *Node) decayQuality() {
+	n.Quality *= qualityFailureDecay
+}
+
+// boostQuality raises the quality of the node after a successful
+// connection attempt.
+func (n *Node) boostQuality() {
+	n.Quality += qualitySuccessBoost
+	if n.Quality > initialQuality {
+		n.Quality = initialQuality
+	}
+}
+
+// demoteIfPoor moves the node back to the new table if it is tried and its
+// quality fell below qualityDemoteThreshold. It must be called with the
+// manager lock held for writes.
+func (m *Manager) demoteIfPoor(key string, node *Node) {
+	if !node.tried || node.Quality >= qualityDemoteThreshold {
+		return
+	}
+	delete(m.triedTable[m.triedBucket(node)], key)
+	m.insertNew(key, node)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLogger logs a random sample of the answered DNS queries, one line of
+// key=value pairs per query, so they can be analyzed with common tools.
+type queryLogger struct {
+	sampleRate float64
+}
+
+// newQueryLogger returns a logger of the sampleRate fraction of queries, or
+// nil if sampleRate is 0, which disables query logging.
+func newQueryLogger(sampleRate float64) *queryLogger {
+	if sampleRate == 0 {
+		return nil
+	}
+	return &queryLogger{sampleRate: sampleRate}
+}
+
+// log logs the query for question received from client, if it is sampled,
+// along with the packed response sent latency after the query was received.
+// It is a no-op on a nil logger.
+func (l *queryLogger) log(client net.Addr, question dns.Question, response []byte, latency time.Duration) {
+	if l == nil || rand.Float64() >= l.sampleRate || len(response) < dns.MsgHeaderSize {
+		return
+	}
+	rcode := int(response[3] & 0xf)
+	answers := binary.BigEndian.Uint16(response[6:8])
+	qlog.Infof("client=%s qname=%s qtype=%s rcode=%s answers=%d latency=%s",
+		client, question.Name, dns.TypeToString[question.Qtype], dns.RcodeToString[rcode], answers, latency)
+}
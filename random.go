@@ -0,0 +1,54 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"math/rand"
+	"sync"
+)
+
+// secretKeySize is the size of the keys of the hashes that place addresses,
+// in bytes.
+const secretKeySize = 32
+
+// newSecretKey returns a key drawn from crypto/rand, for hashes whose
+// outputs must not be predictable by peers. Unlike the choices of lockedRand,
+// they are never reproduced.
+func newSecretKey() ([]byte, error) {
+	key := make([]byte, secretKeySize)
+	_, err := cryptorand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// lockedRand is a source of pseudo-random numbers that is safe for
+// concurrent use. Unlike the global source of math/rand, it can be seeded
+// separately, so that the random choices of a manager can be reproduced.
+type lockedRand struct {
+	mtx sync.Mutex
+	r   *rand.Rand
+}
+
+// newLockedRand returns a lockedRand seeded with seed.
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Uint64() uint64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.r.Uint64()
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.r.Float64()
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.r.Intn(n)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// queryLimiterBuckets is the number of buckets clients are hashed into. The
+// table has a fixed size, so that a flood of queries from spoofed addresses
+// can neither grow it nor make it slower to use. Clients hashed into the same
+// bucket share their limit.
+const queryLimiterBuckets = 1 << 16
+
+// queryBucket is the token bucket of the clients hashed into it. last is the
+// time, in Unix nanoseconds, tokens were last added to it, or 0 if it was
+// never used.
+type queryBucket struct {
+	tokens float64
+	last   int64
+}
+
+// queryLimiter limits the rate of DNS queries answered per client, so that
+// the seeder can neither be used to amplify reflection attacks nor be
+// exhausted by a single client. Clients are keyed by IP address, and IPv6
+// clients by /64, since a single host usually has a whole /64. It is safe for
+// concurrent use.
+type queryLimiter struct {
+	mtx sync.Mutex
+
+	// perSecond is the rate at which a client's bucket refills, and burst
+	// its size.
+	perSecond float64
+	burst     float64
+
+	// exempt holds the ranges of the clients that are never limited, such
+	// as known recursive resolvers.
+	exempt *ipRangeList
+
+	// seed keys the hash of clients to buckets, so that which clients
+	// share a bucket cannot be predicted.
+	seed    maphash.Seed
+	buckets []queryBucket
+}
+
+// newQueryLimiter returns a limiter that answers perSecond queries per second
+// per client, of which up to burst may be made at once, except for the
+// clients in exempt. It returns nil if perSecond is 0, which disables the
+// limit.
+func newQueryLimiter(perSecond float64, burst int, exempt *ipRangeList) *queryLimiter {
+	if perSecond == 0 {
+		return nil
+	}
+	return &queryLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		exempt:    exempt,
+		seed:      maphash.MakeSeed(),
+		buckets:   make([]queryBucket, queryLimiterBuckets),
+	}
+}
+
+// clientKey returns the key of the bucket of the client at ip.
+func clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// bucket returns the bucket of the client at ip.
+func (l *queryLimiter) bucket(ip net.IP) *queryBucket {
+	var h maphash.Hash
+	h.SetSeed(l.seed)
+	h.WriteString(clientKey(ip))
+	return &l.buckets[h.Sum64()%queryLimiterBuckets]
+}
+
+// allow returns whether a query received from ip at now may be answered, and
+// takes a token from the client's bucket if it may.
+func (l *queryLimiter) allow(ip net.IP, now time.Time) bool {
+	if l == nil || l.exempt.contains(ip) {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	bucket := l.bucket(ip)
+	if bucket.last == 0 {
+		bucket.tokens = l.burst
+	} else {
+		bucket.tokens += now.Sub(time.Unix(0, bucket.last)).Seconds() * l.perSecond
+		bucket.tokens = math.Min(bucket.tokens, l.burst)
+	}
+	bucket.last = now.UnixNano()
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// connLimiter limits the number of connections open at the same time, in
+// total and per client, keyed like the clients of queryLimiter. It is safe
+// for concurrent use.
+type connLimiter struct {
+	mtx sync.Mutex
+
+	max          int
+	maxPerClient int
+
+	total   int
+	clients map[string]int
+}
+
+// newConnLimiter returns a limiter that allows up to max connections, of
+// which up to maxPerClient may be those of a single client.
+func newConnLimiter(max, maxPerClient int) *connLimiter {
+	return &connLimiter{
+		max:          max,
+		maxPerClient: maxPerClient,
+		clients:      make(map[string]int),
+	}
+}
+
+// acquire returns whether the client at ip may open another connection, and
+// counts it if it may. The connection must then be released once closed.
+func (l *connLimiter) acquire(ip net.IP) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	key := clientKey(ip)
+	if l.total >= l.max || l.clients[key] >= l.maxPerClient {
+		return false
+	}
+	l.total++
+	l.clients[key]++
+	return true
+}
+
+// release marks a connection of the client at ip acquired earlier as closed.
+func (l *connLimiter) release(ip net.IP) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	key := clientKey(ip)
+	l.total--
+	l.clients[key]--
+	if l.clients[key] == 0 {
+		delete(l.clients, key)
+	}
+}
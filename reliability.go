@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// minAnswerWeight is added to the reliability of every node when
+	// answers are weighted, so that nodes without a track record are still
+	// served once in a while.
+	minAnswerWeight = 0.05
+
+	// answerLatencyScale is the handshake latency that halves the weight
+	// of a node when answers are weighted.
+	answerLatencyScale = 500 * time.Millisecond
+)
+
+// reliabilityWindow is the decay time constant of a reliabilityStat, and the
+// thresholds a node must meet in it to be considered reliable.
+type reliabilityWindow struct {
+	tau            time.Duration
+	minReliability float64
+	minCount       float64
+}
+
+var (
+	window2H = reliabilityWindow{tau: 2 * time.Hour, minReliability: 0.85, minCount: 2}
+	window8H = reliabilityWindow{tau: 8 * time.Hour, minReliability: 0.70, minCount: 4}
+	window1D = reliabilityWindow{tau: 24 * time.Hour, minReliability: 0.55, minCount: 8}
+	window1W = reliabilityWindow{tau: 7 * 24 * time.Hour, minReliability: 0.45, minCount: 16}
+)
+
+// ReliabilityStat is an exponentially decaying success ratio of connection
+// attempts to a node over a time window
+type ReliabilityStat struct {
+	Reliability float64
+	Count       float64
+	Weight      float64
+}
+
+// update adds the result of a connection attempt made age after the
+// previous one, with tau being the window's decay time constant.
+func (s *ReliabilityStat) update(good bool, age, tau time.Duration) {
+	f := math.Exp(-age.Seconds() / tau.Seconds())
+	s.Reliability *= f
+	if good {
+		s.Reliability += 1.0 - f
+	}
+	s.Count = s.Count*f + 1
+	s.Weight = s.Weight*f + (1.0 - f)
+}
+
+// meets returns whether the stat satisfies the thresholds of window.
+func (s *ReliabilityStat) meets(window reliabilityWindow) bool {
+	return s.Reliability > window.minReliability && s.Count > window.minCount
+}
+
+// Reliability holds the reliability statistics of a node over several time
+// windows, in the style of the bitcoin seeder
+type Reliability struct {
+	Stat2H ReliabilityStat
+	Stat8H ReliabilityStat
+	Stat1D ReliabilityStat
+	Stat1W ReliabilityStat
+
+	Total      int
+	Success    int
+	LastUpdate time.Time
+}
+
+// update records the result of a connection attempt made at now.
+func (r *Reliability) update(good bool, now time.Time) {
+	age := now.Sub(r.LastUpdate)
+	r.Stat2H.update(good, age, window2H.tau)
+	r.Stat8H.update(good, age, window8H.tau)
+	r.Stat1D.update(good, age, window1D.tau)
+	r.Stat1W.update(good, age, window1W.tau)
+
+	r.Total++
+	if good {
+		r.Success++
+	}
+	r.LastUpdate = now
+}
+
+// uptimeThresholds are the minimum reliabilities a node must have in each
+// window to be handed out, on top of the criteria of isGood. A threshold of
+// 0 disables the requirement for that window.
+type uptimeThresholds struct {
+	min2H float64
+	min8H float64
+	min1D float64
+	min1W float64
+}
+
+// activeUptimeThresholds returns the uptime thresholds set in the active
+// configuration.
+func activeUptimeThresholds() uptimeThresholds {
+	cfg := ActiveConfig()
+	return uptimeThresholds{
+		min2H: cfg.MinUptime2H,
+		min8H: cfg.MinUptime8H,
+		min1D: cfg.MinUptime1D,
+		min1W: cfg.MinUptime1W,
+	}
+}
+
+// meetsUptime returns whether the node's reliability reaches every
+// threshold in thresholds.
+func (r *Reliability) meetsUptime(thresholds uptimeThresholds) bool {
+	return r.Stat2H.Reliability >= thresholds.min2H &&
+		r.Stat8H.Reliability >= thresholds.min8H &&
+		r.Stat1D.Reliability >= thresholds.min1D &&
+		r.Stat1W.Reliability >= thresholds.min1W
+}
+
+// servingCriteria are the criteria a node must meet at now to be served.
+type servingCriteria struct {
+	now     time.Time
+	uptime  uptimeThresholds
+	goodTTL time.Duration
+
+	// minSuccesses is the number of consecutive successful connection
+	// attempts a node needs, and minSuccessSpan how long ago the first of
+	// them must have been.
+	minSuccesses   int
+	minSuccessSpan time.Duration
+}
+
+// activeServingCriteria returns the serving criteria set in the active
+// configuration for the manager's network, as of the current time of the
+// manager's clock.
+func (m *Manager) activeServingCriteria() servingCriteria {
+	return servingCriteria{
+		now:     m.clock.Now(),
+		uptime:  activeUptimeThresholds(),
+		goodTTL: m.network.goodTTL(),
+
+		minSuccesses:   ActiveConfig().MinSuccesses,
+		minSuccessSpan: ActiveConfig().MinSuccessSpan,
+	}
+}
+
+// isServable returns whether the node meets criteria: it must be good,
+// reach the uptime thresholds, have succeeded the required number of
+// consecutive connection attempts over the required span and, unless the
+// good TTL is 0, have been crawled successfully within the good TTL.
+func (n *Node) isServable(criteria servingCriteria) bool {
+	if n.Successes < criteria.minSuccesses || criteria.now.Sub(n.StreakStart) < criteria.minSuccessSpan {
+		return false
+	}
+	if criteria.goodTTL != 0 && criteria.now.Sub(n.LastSuccess) > criteria.goodTTL {
+		return false
+	}
+	return n.Reliability.isGood() && n.Reliability.meetsUptime(criteria.uptime)
+}
+
+// latency returns the best estimate of the round trip to the node: the ping
+// latency if the node was probed, and its handshake latency otherwise.
+func (n *Node) latency() time.Duration {
+	if n.PingLatency > 0 {
+		return n.PingLatency
+	}
+	return n.HandshakeLatency
+}
+
+// answerWeight returns how likely the node is to be served relative to
+// other nodes when answers are weighted: it grows with the node's
+// reliability over the last day and shrinks with its handshake latency.
+func (n *Node) answerWeight() float64 {
+	weight := minAnswerWeight + n.Reliability.Stat1D.Reliability
+	if n.HandshakeLatency > 0 {
+		weight *= float64(answerLatencyScale) / float64(answerLatencyScale+n.HandshakeLatency)
+	}
+	return weight
+}
+
+// isGood returns whether the node is reliable enough to be handed out to
+// other peers. Nodes with only a few attempts are judged by their plain
+// success ratio, all others by their reliability in any of the windows.
+func (r *Reliability) isGood() bool {
+	if r.Success == 0 {
+		return false
+	}
+	if r.Total <= 3 && r.Success*2 >= r.Total {
+		return true
+	}
+	return r.Stat2H.meets(window2H) ||
+		r.Stat8H.meets(window8H) ||
+		r.Stat1D.meets(window1D) ||
+		r.Stat1W.meets(window1W)
+}
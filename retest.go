@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// Retest schedules all known nodes with the given IP, on any port, to be
+// crawled in the next crawl cycle regardless of when they were last crawled
+// and of their retry backoff, and wakes up the crawler if it is idle. It
+// returns the number of nodes scheduled.
+func (m *Manager) Retest(ip net.IP) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	m.mtx.Lock()
+	count := 0
+	for key := range m.ips[ip.String()] {
+		m.retests[key] = struct{}{}
+		count++
+	}
+	m.mtx.Unlock()
+
+	if count > 0 {
+		select {
+		case m.retestRequested <- struct{}{}:
+		default:
+		}
+	}
+	return count
+}
+
+// RetestRequested returns a channel that receives whenever nodes were
+// scheduled with Retest.
+func (m *Manager) RetestRequested() <-chan struct{} {
+	return m.retestRequested
+}
+
+// takeRetests returns the addresses of the nodes scheduled with Retest that
+// are still known, keyed by node key, and unschedules them.
+func (m *Manager) takeRetests() map[string]*appmessage.NetAddress {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	addrs := make(map[string]*appmessage.NetAddress, len(m.retests))
+	for key := range m.retests {
+		if node, exists := m.nodes[key]; exists {
+			addrs[key] = node.Addr
+		}
+		delete(m.retests, key)
+	}
+	return addrs
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/util/mstime"
+	"github.com/pkg/errors"
+)
+
+// parseSeederDump parses a dnsseed.dump file as written by the bitcoin
+// seeder, and returns its addresses. Each address is timestamped with the
+// last time the seeder reached it, or now if it never did.
+//
+// Lines are whitespace separated columns, of which only the first three are
+// used: the address with its port, whether the node is good, and the unix
+// time of the last success. Comment lines start with #.
+func parseSeederDump(r io.Reader, now time.Time) ([]*appmessage.NetAddress, error) {
+	var addrs []*appmessage.NetAddress
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.Errorf("line %d: expected at least 3 columns", lineNumber)
+		}
+
+		host, portString, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return nil, errors.Errorf("line %d: invalid address %s: %v", lineNumber, fields[0], err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			// Tor addresses and the like cannot be crawled.
+			continue
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("line %d: invalid port %s", lineNumber, portString)
+		}
+		lastSuccess, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("line %d: invalid last success time %s", lineNumber, fields[2])
+		}
+
+		timestamp := now
+		if lastSuccess > 0 {
+			timestamp = time.Unix(lastSuccess, 0)
+		}
+		addr := appmessage.NewNetAddressIPPort(ip, uint16(port))
+		addr.Timestamp = mstime.ToMSTime(timestamp)
+		addrs = append(addrs, addr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// importSeederDump adds the addresses of the bitcoin seeder dump file at
+// filePath to the address manager.
+func importSeederDump(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Errorf("%s error opening file: %v", filePath, err)
+	}
+	defer file.Close()
+
+	addrs, err := parseSeederDump(file, time.Now())
+	if err != nil {
+		return errors.Errorf("error reading %s: %v", filePath, err)
+	}
+	newAddrs := amgr.AddAddresses(addrs)
+	log.Infof("Imported %d new addresses out of %d from %s", len(newAddrs), len(addrs), filePath)
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSeederDump(t *testing.T) {
+	const dump = `# address                                        good  lastSuccess    %(2h)   %(8h)   %(1d)   %(7d)  %(30d)  blocks      svcs  version
+1.2.3.4:16111                                       1  1600000000  100.00%  99.00%  98.00%  97.00%  96.00%  100000  0000000000000001  70015 "/kaspad:0.10.4/"
+[2a01:4f8::1]:16111                                 0           0    0.00%   0.00%   0.00%   0.00%   0.00%       0  0000000000000000      0 ""
+abcdefghijklmnop.onion:16111                        0           0    0.00%   0.00%   0.00%   0.00%   0.00%       0  0000000000000000      0 ""
+`
+	now := time.Unix(1700000000, 0)
+	addrs, err := parseSeederDump(strings.NewReader(dump), now)
+	if err != nil {
+		t.Fatalf("parseSeederDump: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses but got %d", len(addrs))
+	}
+
+	if addrs[0].IP.String() != "1.2.3.4" || addrs[0].Port != 16111 {
+		t.Errorf("unexpected first address %s:%d", addrs[0].IP, addrs[0].Port)
+	}
+	if !addrs[0].Timestamp.ToNativeTime().Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("expected the first address to be timestamped at its last success but got %s", addrs[0].Timestamp.ToNativeTime())
+	}
+	if addrs[1].IP.String() != "2a01:4f8::1" {
+		t.Errorf("unexpected second address %s", addrs[1].IP)
+	}
+	if !addrs[1].Timestamp.ToNativeTime().Equal(now) {
+		t.Errorf("expected the never reached address to be timestamped now but got %s", addrs[1].Timestamp.ToNativeTime())
+	}
+
+	_, err = parseSeederDump(strings.NewReader("1.2.3.4:16111 1\n"), now)
+	if err == nil {
+		t.Errorf("expected an error for a truncated line")
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startSignalListener exports all known nodes, the churn report and the
+// network size history and dumps the state of the address book whenever the
+// seeder receives SIGUSR1, until ctx is canceled.
+func startSignalListener(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	spawn("startSignalListener", func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				exportNodesToFile()
+				exportChurnToFile()
+				exportHistoryToFile()
+				dumpStateToFile()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
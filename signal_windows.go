@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+)
+
+// startSignalListener does nothing, since there is no signal to trigger
+// exports and state dumps with on Windows.
+func startSignalListener(ctx context.Context) {
+	log.Infof("Node exports and state dumps on signal are not supported on Windows")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// snapshotMaxAge is the maximum age of the snapshot that DNS answers and
+// ForEachNode use.
+const snapshotMaxAge = time.Second
+
+// nodeSnapshot is an immutable list of the nodes of the address book. Nodes
+// are never modified once published, see updateNode, so the list shares them
+// with the address book rather than copying them, and they must not be
+// modified.
+type nodeSnapshot struct {
+	taken   time.Time
+	version uint64
+	nodes   []*Node
+}
+
+// snapshot returns a snapshot of the address book taken at or after
+// notBefore, or taken earlier if no node was added, changed or removed since.
+// The current snapshot is shared by all callers until a caller needs a newer
+// one, so readers only hold the manager lock while the node list is being
+// built, and never while iterating it.
+func (m *Manager) snapshot(notBefore time.Time) *nodeSnapshot {
+	s, ok := m.currentSnapshot.Load().(*nodeSnapshot)
+	if ok && m.snapshotIsCurrent(s, notBefore) {
+		return s
+	}
+
+	m.snapshotMtx.Lock()
+	defer m.snapshotMtx.Unlock()
+
+	// Another caller may have taken a new enough snapshot while this one
+	// was waiting.
+	s, ok = m.currentSnapshot.Load().(*nodeSnapshot)
+	if ok && m.snapshotIsCurrent(s, notBefore) {
+		return s
+	}
+	s = m.takeSnapshot()
+	m.currentSnapshot.Store(s)
+
+	criteria := m.activeServingCriteria()
+	good := 0
+	for _, node := range s.nodes {
+		if node.isServable(criteria) {
+			good++
+		}
+	}
+	m.setGoodGauge(good)
+	return s
+}
+
+// snapshotIsCurrent returns whether s was taken at or after notBefore, or
+// still holds the current nodes of the address book.
+func (m *Manager) snapshotIsCurrent(s *nodeSnapshot, notBefore time.Time) bool {
+	return !s.taken.Before(notBefore) || s.version == atomic.LoadUint64(&m.nodesVersion)
+}
+
+func (m *Manager) takeSnapshot() *nodeSnapshot {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	s := &nodeSnapshot{
+		taken:   m.clock.Now(),
+		version: atomic.LoadUint64(&m.nodesVersion),
+		nodes:   make([]*Node, 0, len(m.nodes)),
+	}
+	for _, node := range m.nodes {
+		s.nodes = append(s.nodes, node)
+	}
+	return s
+}
+
+// ForEachNode calls fn for each node of a recent snapshot of the address
+// book, until fn returns false. The nodes passed to fn must not be modified.
+func (m *Manager) ForEachNode(fn func(node *Node) bool) {
+	for _, node := range m.snapshot(m.clock.Now().Add(-snapshotMaxAge)).nodes {
+		if !fn(node) {
+			return
+		}
+	}
+}
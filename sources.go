@@ -0,0 +1,174 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+const (
+	// sourceWindow is the period over which the addresses advertised by a
+	// single peer are limited and their acceptance ratio is tracked.
+	sourceWindow = time.Hour
+
+	// minSourceSample is the number of addresses a peer must advertise
+	// within a window before its acceptance ratio is judged.
+	minSourceSample = 100
+
+	// minAcceptanceRatio is the minimum fraction of the addresses
+	// advertised by a peer that must be usable. Peers that mostly advertise
+	// unroutable or banned addresses are banned themselves.
+	minAcceptanceRatio = 0.5
+
+	// minGossipSample is the number of the addresses first advertised by a
+	// peer whose fate must be known before its gossip is judged.
+	minGossipSample = 50
+
+	// gossipPenaltyRatio is the fraction of the addresses first advertised
+	// by a peer that must have been reached for its gossip to be taken in
+	// full. Below it, only a gossipPenaltyDivisor-th of the addresses the
+	// peer sends is considered.
+	gossipPenaltyRatio   = 0.05
+	gossipPenaltyDivisor = 10
+
+	// gossipBanRatio is the fraction of the addresses first advertised by
+	// a peer that were reached below which the peer is banned.
+	gossipBanRatio = 0.01
+)
+
+// addrSource tracks the addresses a single peer advertised within the
+// current window.
+type addrSource struct {
+	windowStart time.Time
+	received    int
+	accepted    int
+}
+
+// gossipRecord tracks what became of the addresses a peer was the first to
+// advertise: how many of them were reached, and how many were removed after
+// failed attempts without ever being reached.
+type gossipRecord struct {
+	reached   int
+	unreached int
+}
+
+// reachRatio returns the fraction of the judged addresses that were reached,
+// and false if too few were judged yet.
+func (r *gossipRecord) reachRatio() (float64, bool) {
+	judged := r.reached + r.unreached
+	if judged < minGossipSample {
+		return 0, false
+	}
+	return float64(r.reached) / float64(judged), true
+}
+
+// creditSource records in the gossip record of the peer that first advertised
+// the node whether the node was reached. It must be called with the manager
+// lock held for writes.
+func (m *Manager) creditSource(node *Node, reached bool) {
+	if node.Source == "" {
+		return
+	}
+	if m.gossip == nil {
+		m.gossip = make(map[string]*gossipRecord)
+	}
+	record, exists := m.gossip[node.Source]
+	if !exists {
+		record = &gossipRecord{}
+		m.gossip[node.Source] = record
+	}
+	if reached {
+		record.reached++
+	} else {
+		record.unreached++
+	}
+}
+
+// pruneGossip drops the gossip records of the peers that are no longer in the
+// address book, since they are not crawled anymore and so cannot advertise
+// addresses. It must be called with the manager lock held for writes.
+func (m *Manager) pruneGossip() {
+	for source := range m.gossip {
+		if _, exists := m.ips[source]; !exists {
+			delete(m.gossip, source)
+		}
+	}
+}
+
+// AddAddressesFromPeer adds addresses advertised by the peer at source to
+// this dnsseeder manager, and returns the ones that were not known before.
+// Only up to the configured number of addresses per message and per peer
+// per hour are considered, so that a single peer cannot flood the manager,
+// and fewer still if few of the addresses the peer advertised before could be
+// reached. Peers whose addresses can hardly ever be reached are banned.
+func (m *Manager) AddAddressesFromPeer(source *appmessage.NetAddress,
+	addrs []*appmessage.NetAddress) []*appmessage.NetAddress {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := m.clock.Now()
+	key := source.IP.String()
+	var ratio float64
+	var judged bool
+	if record, exists := m.gossip[key]; exists {
+		ratio, judged = record.reachRatio()
+	}
+	if judged && ratio < gossipBanRatio {
+		m.ban(source.IP, "advertised mostly unreachable addresses")
+		delete(m.gossip, key)
+		return nil
+	}
+
+	src, exists := m.sources[key]
+	if !exists || now.Sub(src.windowStart) >= sourceWindow {
+		src = &addrSource{windowStart: now}
+		m.sources[key] = src
+	}
+
+	limit := ActiveConfig().MaxAddrsPerMsg
+	if remaining := ActiveConfig().MaxAddrsPerPeerHour - src.received; remaining < limit {
+		limit = remaining
+	}
+	if judged && ratio < gossipPenaltyRatio {
+		limit /= gossipPenaltyDivisor
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	if len(addrs) > limit {
+		log.Debugf("Ignoring %d of the %d addresses sent by %s", len(addrs)-limit, len(addrs), key)
+		addrs = addrs[:limit]
+	}
+
+	added, accepted := m.addAddresses(addrs, netGroup(source.IP))
+	for _, addr := range added {
+		// The node may have been evicted again to make room for a later
+		// address of the same message.
+		if node, exists := m.nodes[nodeKey(addr)]; exists {
+			node.Source = key
+		}
+	}
+	src.received += len(addrs)
+	src.accepted += accepted
+
+	if src.received >= minSourceSample &&
+		float64(src.accepted) < float64(src.received)*minAcceptanceRatio {
+
+		m.ban(source.IP, "advertised mostly unusable addresses")
+		delete(m.sources, key)
+	}
+
+	return added
+}
+
+func (m *Manager) pruneSources() {
+	now := m.clock.Now()
+	m.mtx.Lock()
+	for k, src := range m.sources {
+		if now.Sub(src.windowStart) >= sourceWindow {
+			delete(m.sources, k)
+		}
+	}
+	m.mtx.Unlock()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// stateDumpNewestGood is the number of most recently good nodes listed
+	// in state dumps.
+	stateDumpNewestGood = 20
+
+	// stateDumpTimeFormat is the format of the timestamp in the names of
+	// state dump files.
+	stateDumpTimeFormat = "20060102T150405Z"
+)
+
+// newestGoodNodes returns up to count good nodes, most recently good first.
+func (m *Manager) newestGoodNodes(count int) []*Node {
+	criteria := m.activeServingCriteria()
+	var nodes []*Node
+	m.ForEachNode(func(node *Node) bool {
+		if node.state(criteria) == nodeStateGood {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].LastSuccess.After(nodes[j].LastSuccess)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// writeStateDump writes a human readable summary of the address book, taken
+// at now, to w.
+func writeStateDump(w io.Writer, now time.Time, stats *Stats, newestGood []*Node) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "State of the address book at %s\n\n", now.UTC().Format(time.RFC3339))
+
+	fmt.Fprintf(bw, "Known:           %d\n", stats.Known)
+	fmt.Fprintf(bw, "Tried:           %d\n", stats.Tried)
+	fmt.Fprintf(bw, "Good:            %d\n", stats.Good)
+	fmt.Fprintf(bw, "Recently failed: %d\n", stats.RecentlyFailed)
+	fmt.Fprintf(bw, "Banned:          %d\n", stats.Banned)
+
+	fmt.Fprintf(bw, "\nKnown nodes per address family:\n")
+	writeSortedCounts(bw, stats.Families)
+
+	fmt.Fprintf(bw, "\nGood nodes per subnetwork:\n")
+	writeSortedCounts(bw, stats.Subnetworks)
+
+	fmt.Fprintf(bw, "\nTop failure reasons:\n")
+	failureReasons := make(map[string]int, len(stats.FailureReasons))
+	for reason, count := range stats.FailureReasons {
+		failureReasons[string(reason)] = count
+	}
+	writeSortedCounts(bw, failureReasons)
+
+	fmt.Fprintf(bw, "\nNewest good nodes:\n")
+	for _, node := range newestGood {
+		fmt.Fprintf(bw, "  %-47s last success %s\n", nodeKey(node.Addr), node.LastSuccess.UTC().Format(time.RFC3339))
+	}
+
+	return bw.Flush()
+}
+
+// writeSortedCounts writes counts to w, highest first.
+func writeSortedCounts(w io.Writer, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		name := key
+		if name == "" {
+			name = "(unknown)"
+		}
+		fmt.Fprintf(w, "  %-47s %d\n", name, counts[key])
+	}
+}
+
+// dumpStateToFile writes a human readable summary of the address book to a
+// timestamped file in the home directory.
+func dumpStateToFile() {
+	now := time.Now()
+	filePath, ok := homeDirFile("state-" + now.UTC().Format(stateDumpTimeFormat) + ".txt")
+	if !ok {
+		return
+	}
+
+	w, err := os.Create(filePath)
+	if err != nil {
+		log.Errorf("Error opening file %s: %v", filePath, err)
+		return
+	}
+	err = writeStateDump(w, now, amgr.Stats(), amgr.newestGoodNodes(stateDumpNewestGood))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Failed to dump the state to %s: %v", filePath, err)
+		return
+	}
+	log.Infof("Dumped the state to %s", filePath)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+)
+
+// recentFailureWindow is how long ago the last failed attempt to a node may
+// have been for Stats to count it as recently failed.
+const recentFailureWindow = time.Hour
+
+// Address families as reported by Stats.
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+)
+
+// Stats summarizes the state of the address book.
+//
+// Per-service counts are not included, since the services a node advertises
+// in its version message are not exposed by the net adapter.
+type Stats struct {
+	// Known is the number of nodes in the address book, and Tried the
+	// number of them that were ever crawled successfully.
+	Known int
+	Tried int
+
+	// Good is the number of nodes that are good enough to be served,
+	// regardless of any per network group or per ASN limits.
+	Good int
+
+	// RecentlyFailed is the number of nodes whose last attempt, made
+	// within recentFailureWindow, failed.
+	RecentlyFailed int
+
+	// Banned is the number of banned IP addresses.
+	Banned int
+
+	// Families is the number of known nodes per address family.
+	Families map[string]int
+
+	// Subnetworks is the number of good nodes per subnetwork ID. Nodes of
+	// an unknown subnetwork are counted under the empty string.
+	Subnetworks map[string]int
+
+	// FailureReasons is the number of nodes per the reason their last
+	// attempt failed, among the nodes whose last attempt failed.
+	FailureReasons map[FailureReason]int
+}
+
+// Stats returns a summary of the state of the address book.
+func (m *Manager) Stats() *Stats {
+	now := m.clock.Now()
+	criteria := m.activeServingCriteria()
+	stats := &Stats{
+		Families:       make(map[string]int),
+		Subnetworks:    make(map[string]int),
+		FailureReasons: make(map[FailureReason]int),
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	stats.Known = len(m.nodes)
+	stats.Banned = len(m.bans)
+	for _, node := range m.nodes {
+		if node.tried {
+			stats.Tried++
+		}
+		if node.Addr.IP.To4() != nil {
+			stats.Families[addressFamilyIPv4]++
+		} else {
+			stats.Families[addressFamilyIPv6]++
+		}
+
+		if node.state(criteria) == nodeStateGood {
+			stats.Good++
+			stats.Subnetworks[subnetworkKey(node.SubnetworkID)]++
+		}
+		if node.LastAttempt.After(node.LastSuccess) {
+			if now.Sub(node.LastAttempt) < recentFailureWindow {
+				stats.RecentlyFailed++
+			}
+			if node.LastFailure != "" {
+				stats.FailureReasons[node.LastFailure]++
+			}
+		}
+	}
+
+	return stats
+}
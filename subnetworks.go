@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+)
+
+// subnetworkKey returns the key of subnetworkID in the subnetwork index,
+// which is empty for nodes of an unknown subnetwork.
+func subnetworkKey(subnetworkID *externalapi.DomainSubnetworkID) string {
+	if subnetworkID == nil {
+		return ""
+	}
+	return subnetworkID.String()
+}
+
+// indexSubnetwork adds the node to the index of its subnetwork. It must be
+// called with the manager lock held for writes.
+func (m *Manager) indexSubnetwork(key string, node *Node) {
+	if m.subnetworks == nil {
+		m.subnetworks = make(map[string]map[string]*Node)
+	}
+	subnetwork := subnetworkKey(node.SubnetworkID)
+	nodes, exists := m.subnetworks[subnetwork]
+	if !exists {
+		nodes = make(map[string]*Node)
+		m.subnetworks[subnetwork] = nodes
+	}
+	nodes[key] = node
+}
+
+// unindexSubnetwork removes the node from the index of its subnetwork. It
+// must be called with the manager lock held for writes.
+func (m *Manager) unindexSubnetwork(key string, node *Node) {
+	subnetwork := subnetworkKey(node.SubnetworkID)
+	nodes := m.subnetworks[subnetwork]
+	delete(nodes, key)
+	if len(nodes) == 0 {
+		delete(m.subnetworks, subnetwork)
+	}
+}
+
+// setSubnetwork moves the node to the index of subnetworkID. It must be
+// called with the manager lock held for writes.
+func (m *Manager) setSubnetwork(key string, node *Node, subnetworkID *externalapi.DomainSubnetworkID) {
+	if node.SubnetworkID.Equal(subnetworkID) {
+		node.SubnetworkID = subnetworkID
+		return
+	}
+	m.unindexSubnetwork(key, node)
+	node.SubnetworkID = subnetworkID
+	m.indexSubnetwork(key, node)
+}
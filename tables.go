@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// newBucketCount and triedBucketCount are the number of buckets of the
+	// new and tried tables.
+	newBucketCount   = 1024
+	triedBucketCount = 256
+
+	// bucketSize is the maximum number of nodes in a single bucket.
+	bucketSize = 64
+
+	// newBucketsPerSourceGroup is the number of new buckets the addresses
+	// advertised by peers in a single network group can end up in. It
+	// bounds how much of the new table a single source can fill.
+	newBucketsPerSourceGroup = 64
+
+	// triedBucketsPerGroup is the number of tried buckets the nodes of a
+	// single network group can end up in.
+	triedBucketsPerGroup = 8
+
+	// evictionSampleSize is the number of nodes of the new table that are
+	// considered for eviction when the address book is full.
+	evictionSampleSize = 32
+)
+
+// bucket holds the nodes of a single bucket of the new or tried table, keyed
+// by node key.
+//
+// Nodes are kept in one of two tables. The new table holds nodes that were
+// only advertised so far, bucketed by the network group of the peer that
+// advertised them, and the tried table holds nodes that were successfully
+// crawled, bucketed by their own network group. Since buckets are bounded,
+// unverified addresses gossiped by a few sources cannot crowd out either
+// other unverified addresses or the verified nodes.
+type bucket map[string]*Node
+
+// bucketIndex returns the bucket, out of count, that the hash of parts and
+// the manager's bucket key selects.
+func (m *Manager) bucketIndex(count int, parts ...string) int {
+	return int(m.bucketHash(parts...) % uint64(count))
+}
+
+// bucketHash returns the HMAC of parts keyed by the manager's bucket key,
+// truncated to 64 bits.
+func (m *Manager) bucketHash(parts ...string) uint64 {
+	h := hmac.New(sha256.New, m.bucketKey)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// newBucket returns the index of the new bucket of node.
+func (m *Manager) newBucket(node *Node) int {
+	group := netGroup(node.Addr.IP)
+	slot := m.bucketHash(node.SourceGroup, group) % newBucketsPerSourceGroup
+	return m.bucketIndex(newBucketCount, node.SourceGroup, strconv.FormatUint(slot, 10))
+}
+
+// triedBucket returns the index of the tried bucket of node.
+func (m *Manager) triedBucket(node *Node) int {
+	group := netGroup(node.Addr.IP)
+	slot := m.bucketHash(nodeKey(node.Addr)) % triedBucketsPerGroup
+	return m.bucketIndex(triedBucketCount, group, strconv.FormatUint(slot, 10))
+}
+
+// insertNew adds the node to the address book and the new table. If its
+// bucket is full, the node in it that was advertised least recently is
+// removed from the address book. It must be called with the manager lock
+// held for writes.
+func (m *Manager) insertNew(key string, node *Node) {
+	i := m.newBucket(node)
+	if m.newTable[i] == nil {
+		m.newTable[i] = make(bucket)
+	}
+	b := m.newTable[i]
+	if len(b) >= bucketSize {
+		oldestKey := ""
+		for k, n := range b {
+			if oldestKey == "" || n.LastSeen.Before(b[oldestKey].LastSeen) {
+				oldestKey = k
+			}
+		}
+		m.removeNode(oldestKey)
+	}
+
+	node.tried = false
+	b[key] = node
+	if _, exists := m.nodes[key]; !exists {
+		m.countDiversity(node, 1)
+	}
+	m.nodes[key] = node
+	m.updateSizeGauges()
+	m.indexSubnetwork(key, node)
+	m.indexIP(key, node)
+	atomic.AddUint64(&m.nodesVersion, 1)
+}
+
+// updateNode replaces the node stored under key with a copy of it in the
+// address book, its table and its indexes, and returns the copy for the
+// caller to modify. Snapshots share nodes with the address book and are read
+// without the manager lock, so nodes are never modified in place once the
+// manager lock was released after adding them. It must be called with the
+// manager lock held for writes, for a key of the address book.
+func (m *Manager) updateNode(key string) *Node {
+	node := m.nodes[key]
+	updated := *node
+	if node.FailureCounts != nil {
+		updated.FailureCounts = make(map[FailureReason]int, len(node.FailureCounts))
+		for reason, count := range node.FailureCounts {
+			updated.FailureCounts[reason] = count
+		}
+	}
+
+	if node.tried {
+		m.triedTable[m.triedBucket(node)][key] = &updated
+	} else {
+		m.newTable[m.newBucket(node)][key] = &updated
+	}
+	m.nodes[key] = &updated
+	m.subnetworks[subnetworkKey(node.SubnetworkID)][key] = &updated
+	m.ips[node.Addr.IP.String()][key] = &updated
+	atomic.AddUint64(&m.nodesVersion, 1)
+	return &updated
+}
+
+// makeTried moves the node from the new table to the tried table. If its
+// bucket is full, the node in it that was good least recently is moved back
+// to the new table. It must be called with the manager lock held for writes.
+func (m *Manager) makeTried(key string, node *Node) {
+	if node.tried {
+		return
+	}
+	delete(m.newTable[m.newBucket(node)], key)
+
+	i := m.triedBucket(node)
+	if m.triedTable[i] == nil {
+		m.triedTable[i] = make(bucket)
+	}
+	b := m.triedTable[i]
+	if len(b) >= bucketSize {
+		oldestKey := ""
+		for k, n := range b {
+			if oldestKey == "" || n.LastSuccess.Before(b[oldestKey].LastSuccess) {
+				oldestKey = k
+			}
+		}
+		oldest := m.updateNode(oldestKey)
+		delete(b, oldestKey)
+		m.insertNew(oldestKey, oldest)
+	}
+
+	node.tried = true
+	b[key] = node
+	m.nodes[key] = node
+}
+
+// makeRoom evicts a node from the new table if the address book holds
+// maxNodes nodes or more, and returns whether there is room for another node.
+// The evicted node is the worst of a sample of the new table: preferably one
+// that was never reached, then the one of the most crowded network group or
+// autonomous system, so that the address book stays diverse, then the one
+// with the most consecutive failures, then the one advertised least recently.
+// Nodes in the tried table are never evicted. It must be called with the
+// manager lock held for writes.
+func (m *Manager) makeRoom(maxNodes int) bool {
+	if maxNodes == 0 || len(m.nodes) < maxNodes {
+		return true
+	}
+
+	var worstKey string
+	var worst *Node
+	sampled := 0
+	for key, node := range m.nodes {
+		if node.tried {
+			continue
+		}
+		if worst == nil || m.evictsBefore(node, worst) {
+			worstKey, worst = key, node
+		}
+		sampled++
+		if sampled == evictionSampleSize {
+			break
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	m.removeNode(worstKey)
+	return true
+}
+
+// evictsBefore returns whether a should be evicted before b. It must be
+// called with the manager lock held.
+func (m *Manager) evictsBefore(a, b *Node) bool {
+	if a.LastSuccess.IsZero() != b.LastSuccess.IsZero() {
+		return a.LastSuccess.IsZero()
+	}
+	aRepresentation, bRepresentation := m.representation(a), m.representation(b)
+	if aRepresentation != bRepresentation {
+		return aRepresentation > bRepresentation
+	}
+	if a.Failures != b.Failures {
+		return a.Failures > b.Failures
+	}
+	return a.LastSeen.Before(b.LastSeen)
+}
+
+// removeNode removes the node with the given key from the address book and
+// its table. It must be called with the manager lock held for writes.
+func (m *Manager) removeNode(key string) {
+	node, exists := m.nodes[key]
+	if !exists {
+		return
+	}
+	if node.tried {
+		delete(m.triedTable[m.triedBucket(node)], key)
+	} else {
+		delete(m.newTable[m.newBucket(node)], key)
+	}
+	m.unindexSubnetwork(key, node)
+	m.unindexIP(key, node)
+	m.countDiversity(node, -1)
+	if node.attempting {
+		atomic.AddInt64(&m.gauges.inFlight, -1)
+	}
+	delete(m.nodes, key)
+	m.updateSizeGauges()
+	atomic.AddUint64(&m.nodesVersion, 1)
+	m.notifyObservers(func(observer ManagerObserver) { observer.NodeRemoved(node.Addr) })
+}
+
+// balanceTables returns up to count of the passed tried and new nodes, half
+// of them from each table if both have enough.
+func balanceTables(tried, untried []*Node, count int) []*Node {
+	triedCount := count / 2
+	if len(untried) < count-triedCount {
+		triedCount = count - len(untried)
+	}
+	if triedCount > len(tried) {
+		triedCount = len(tried)
+	}
+	untriedCount := count - triedCount
+	if untriedCount > len(untried) {
+		untriedCount = len(untried)
+	}
+
+	nodes := make([]*Node, 0, triedCount+untriedCount)
+	nodes = append(nodes, tried[:triedCount]...)
+	return append(nodes, untried[:untriedCount]...)
+}